@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Runner starts the programs of prepared runs. Docker is the default, the
+// local sandbox runs them on hosts without it and fakeRunner stands in for
+// both in tests.
+type Runner interface {
+	// Ready returns a runnerNotReady error while runs of the language cannot start
+	Ready(language string) error
+	// Start starts the program of spec, writing its output to stdout and
+	// stderr. Cancelling ctx kills it.
+	Start(ctx context.Context, spec *runSpec, stdout, stderr io.Writer) (Process, error)
+}
+
+// Process is a started program
+type Process interface {
+	// Stdin is the input of the program, closing it sends end of file
+	Stdin() io.WriteCloser
+	// Wait waits until the program exited and its output was written. It
+	// returns the exit code, -1 if the program was killed by a signal, and
+	// an error unless the program exited with 0.
+	Wait() (int, error)
+}
+
+var backend Runner = dockerRunner{}
+
+// selectBackend sets the backend named in the runner config
+func selectBackend(name string) error {
+	switch name {
+	case "", "docker":
+		backend = dockerRunner{}
+	case "sandbox":
+		backend = sandboxRunner{}
+	default:
+		return fmt.Errorf("unknown backend %q", name)
+	}
+	return nil
+}
+
+// cmdProcess is a Process run by os/exec
+type cmdProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// startCommand starts cmd with its output going to stdout and stderr
+func startCommand(cmd *exec.Cmd, stdout, stderr io.Writer) (Process, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdProcess{cmd: cmd, stdin: stdin}, nil
+}
+
+func (p *cmdProcess) Stdin() io.WriteCloser { return p.stdin }
+
+func (p *cmdProcess) Wait() (int, error) {
+	err := p.cmd.Wait()
+	if p.cmd.ProcessState == nil {
+		return -1, err
+	}
+	return p.cmd.ProcessState.ExitCode(), err
+}
+
+// dockerRunner runs every program in a container of its language's image,
+// taken from the warm pool when it has one
+type dockerRunner struct{}
+
+// Images are built in the background, runs do not wait for them
+func (dockerRunner) Ready(language string) error {
+	return images.ready(language)
+}
+
+func (d dockerRunner) Start(ctx context.Context, s *runSpec, stdout, stderr io.Writer) (Process, error) {
+	return startCommand(d.command(ctx, s), stdout, stderr)
+}
+
+// command returns the docker run of the spec within its limits, on a
+// read-only root filesystem with scratch space in /tmp. The entrypoint is
+// passed as an argument of the script, never spliced into it. Cancelling ctx
+// kills the container, not only the docker client. A warm container is used
+// instead of starting one when the pool has one, and removed when the spec
+// runs again, as test cases do.
+func (dockerRunner) command(ctx context.Context, s *runSpec) *exec.Cmd {
+	if s.warm != nil {
+		go s.warm.remove()
+		s.warm = nil
+	}
+	if c := pool.take(s.language, s.limits); c != nil {
+		err := c.load(s.dir)
+		pool.record(s.language, err == nil)
+		if err == nil {
+			s.warm = c
+			return c.command(ctx, s)
+		}
+		log.Printf("pool: loading project into %s: %v", c.name, err)
+		go c.remove()
+	}
+	name := "cocode-run-" + strings.ToLower(rand.Text())
+	args := append([]string{"run", "--rm", "-i", "--name", name}, s.limits.dockerArgs()...)
+	args = append(args, "-v", s.dir+":"+sandboxProjectDir+":ro", "-w", sandboxProjectDir,
+		s.runner.Image, "sh", "-c", s.script(), "sh", "./"+s.entry.Path)
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Cancel = func() error {
+		exec.Command("docker", "kill", name).Run()
+		return cmd.Process.Kill()
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
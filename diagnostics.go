@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Severities of a diagnostic
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityNote    = "note"
+)
+
+// Diagnostic is a problem a compiler or the runtime reported at a place in
+// the project, for the editor to mark
+type Diagnostic struct {
+	File     string `json:"file"` // path in the project
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"` // from 1, 0 if only the line is known
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Source   string `json:"source,omitempty"` // the linter that reported it
+}
+
+// diagnosticParsers read the error output of a failed run or of a linter in
+// the format named by LanguageRunner.Errors or Linter.Errors. resolve turns a
+// path of the output into the project file it names, and reports false for
+// files outside the project.
+var diagnosticParsers = map[string]func(output string, resolve func(string) (string, bool)) []Diagnostic{
+	"python": parsePythonErrors,
+	"go":     parseGoErrors,
+	"gcc":    parseGCCErrors,
+	"javac":  parseJavacErrors,
+	"lint":   parseLintOutput,
+	"eslint": parseESLintJSON,
+}
+
+// diagnostics returns what the output of a failed run of spec says about its files
+func (s *runSpec) diagnostics(output string) []Diagnostic {
+	parse := diagnosticParsers[s.runner.Errors]
+	if parse == nil {
+		return nil
+	}
+	return parse(output, s.projectFile)
+}
+
+// projectFile resolves a path printed by a compiler or the runtime. Absolute
+// paths name the project where it is mounted, relative ones are taken from
+// the project root or, for builds that change into it, the entrypoint's
+// directory.
+func (s *runSpec) projectFile(p string) (string, bool) {
+	p = strings.TrimPrefix(p, sandboxProjectDir+"/")
+	if path.IsAbs(p) {
+		return "", false
+	}
+	for _, candidate := range []string{path.Clean(p), path.Join(path.Dir(s.entry.Path), p)} {
+		if candidate == ".." || strings.HasPrefix(candidate, "../") {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(candidate))); err == nil && info.Mode().IsRegular() {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+var (
+	pythonFrame = regexp.MustCompile(`^\s*File "(.+)", line (\d+)`)
+	goPosition  = regexp.MustCompile(`^(?:vet: )?(\S+\.go):(\d+)(?::(\d+))?: (.*)$`)
+	goFrame     = regexp.MustCompile(`^\t(\S+\.go):(\d+)`)
+	gccPosition = regexp.MustCompile(`^(\S+?):(\d+):(\d+): (fatal error|error|warning|note): (.*)$`)
+	javacError  = regexp.MustCompile(`^(\S+\.java):(\d+): (error|warning): (.*)$`)
+	javaFrame   = regexp.MustCompile(`^\s+at ([\w$.]+)\(([\w$]+\.java):(\d+)\)`)
+	lintFinding = regexp.MustCompile(`^(\S+?):(\d+):(?:(\d+):)? (.*)$`)
+)
+
+// parsePythonErrors reads tracebacks and syntax errors. Each points at the
+// innermost frame in the project, with the exception as the message.
+func parsePythonErrors(output string, resolve func(string) (string, bool)) []Diagnostic {
+	var diags []Diagnostic
+	var frame *Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		if m := pythonFrame.FindStringSubmatch(line); m != nil {
+			if file, ok := resolve(m[1]); ok {
+				n, _ := strconv.Atoi(m[2])
+				frame = &Diagnostic{File: file, Line: n, Severity: severityError}
+			}
+			continue
+		}
+		if frame == nil || line == "" || line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(line, "Traceback ") {
+			continue
+		}
+		frame.Message = line
+		diags = append(diags, *frame)
+		frame = nil
+	}
+	return diags
+}
+
+// parseGoErrors reads compiler and vet errors, and panics and fatal errors
+// of the runtime, which point at the innermost frame in the project
+func parseGoErrors(output string, resolve func(string) (string, bool)) []Diagnostic {
+	var diags []Diagnostic
+	panicked := ""
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "panic: ") || strings.HasPrefix(line, "fatal error: ") {
+			panicked = line
+			continue
+		}
+		if panicked != "" {
+			if m := goFrame.FindStringSubmatch(line); m != nil {
+				if file, ok := resolve(m[1]); ok {
+					n, _ := strconv.Atoi(m[2])
+					diags = append(diags, Diagnostic{File: file, Line: n, Severity: severityError, Message: panicked})
+					panicked = ""
+				}
+			}
+			continue
+		}
+		if m := goPosition.FindStringSubmatch(line); m != nil {
+			if file, ok := resolve(m[1]); ok {
+				n, _ := strconv.Atoi(m[2])
+				col, _ := strconv.Atoi(m[3])
+				diags = append(diags, Diagnostic{File: file, Line: n, Column: col, Severity: severityError, Message: m[4]})
+			}
+		}
+	}
+	return diags
+}
+
+// parseGCCErrors reads the errors, warnings and notes of gcc and clang
+func parseGCCErrors(output string, resolve func(string) (string, bool)) []Diagnostic {
+	var diags []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		m := gccPosition.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		file, ok := resolve(m[1])
+		if !ok {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		severity := m[4]
+		if severity == "fatal error" {
+			severity = severityError
+		}
+		diags = append(diags, Diagnostic{File: file, Line: n, Column: col, Severity: severity, Message: m[5]})
+	}
+	return diags
+}
+
+// parseJavacErrors reads javac errors, whose column is shown by a caret
+// below the quoted source line, and uncaught exceptions, which point at the
+// innermost frame in the project
+func parseJavacErrors(output string, resolve func(string) (string, bool)) []Diagnostic {
+	var diags []Diagnostic
+	lines := strings.Split(output, "\n")
+	exception := ""
+	for i, line := range lines {
+		if m := javacError.FindStringSubmatch(line); m != nil {
+			file, ok := resolve(m[1])
+			if !ok {
+				continue
+			}
+			n, _ := strconv.Atoi(m[2])
+			d := Diagnostic{File: file, Line: n, Severity: m[3], Message: m[4]}
+			if i+2 < len(lines) && strings.TrimSpace(lines[i+2]) == "^" {
+				d.Column = strings.Index(lines[i+2], "^") + 1
+			}
+			diags = append(diags, d)
+			continue
+		}
+		if msg, ok := strings.CutPrefix(line, "Exception in thread "); ok {
+			// Exception in thread "main" java.lang.Exception: message
+			if _, rest, found := strings.Cut(msg, "\" "); found {
+				exception = rest
+			}
+			continue
+		}
+		if exception == "" {
+			continue
+		}
+		if m := javaFrame.FindStringSubmatch(line); m != nil {
+			// The package of the method's class is the file's directory
+			parts := strings.Split(m[1], ".")
+			dir := strings.Join(parts[:max(len(parts)-2, 0)], "/")
+			if file, ok := resolve(path.Join(dir, m[2])); ok {
+				n, _ := strconv.Atoi(m[3])
+				diags = append(diags, Diagnostic{File: file, Line: n, Severity: severityError, Message: exception})
+				exception = ""
+			}
+		}
+	}
+	return diags
+}
+
+// parseLintOutput reads the file:line:column: message lines most linters
+// print, as warnings
+func parseLintOutput(output string, resolve func(string) (string, bool)) []Diagnostic {
+	var diags []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		m := lintFinding.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if file, ok := resolve(m[1]); ok {
+			n, _ := strconv.Atoi(m[2])
+			col, _ := strconv.Atoi(m[3])
+			diags = append(diags, Diagnostic{File: file, Line: n, Column: col, Severity: severityWarning, Message: m[4]})
+		}
+	}
+	return diags
+}
+
+// parseESLintJSON reads the report of `eslint -f json`
+func parseESLintJSON(output string, resolve func(string) (string, bool)) []Diagnostic {
+	var report []struct {
+		FilePath string `json:"filePath"`
+		Messages []struct {
+			RuleID   string `json:"ruleId"`
+			Severity int    `json:"severity"` // 1 warning, 2 error
+			Message  string `json:"message"`
+			Line     int    `json:"line"`
+			Column   int    `json:"column"`
+		} `json:"messages"`
+	}
+	if json.Unmarshal([]byte(output), &report) != nil {
+		return nil
+	}
+	var diags []Diagnostic
+	for _, f := range report {
+		file, ok := resolve(f.FilePath)
+		if !ok {
+			continue
+		}
+		for _, m := range f.Messages {
+			d := Diagnostic{File: file, Line: m.Line, Column: m.Column, Severity: severityWarning, Message: m.Message}
+			if m.Severity == 2 {
+				d.Severity = severityError
+			}
+			if m.RuleID != "" {
+				d.Message += " (" + m.RuleID + ")"
+			}
+			diags = append(diags, d)
+		}
+	}
+	return diags
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testProject writes empty files at paths into a temporary project and
+// returns a spec of it whose entrypoint is entry
+func testProject(t *testing.T, entry string, paths ...string) *runSpec {
+	t.Helper()
+	dir := t.TempDir()
+	for _, p := range append(paths, entry) {
+		target := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &runSpec{entry: SessionFile{Path: entry}, dir: dir}
+}
+
+type diagnosticsTest struct {
+	name   string
+	output string
+	want   []Diagnostic
+}
+
+// testDiagnostics checks what parse finds in the output of each test,
+// resolving paths in the project of s
+func testDiagnostics(t *testing.T, parse func(string, func(string) (string, bool)) []Diagnostic, s *runSpec, tests []diagnosticsTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parse(tt.output, s.projectFile); !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePythonErrors(t *testing.T) {
+	s := testProject(t, "main.py", "lib/util.py")
+	testDiagnostics(t, parsePythonErrors, s, []diagnosticsTest{
+		{
+			name: "innermost project frame",
+			output: `Traceback (most recent call last):
+  File "/home/runner/project/main.py", line 3, in <module>
+    print(util.div(1, 0))
+          ^^^^^^^^^^^^^^
+  File "/home/runner/project/lib/util.py", line 2, in div
+    return a / b
+           ~~^~~
+ZeroDivisionError: division by zero
+`,
+			want: []Diagnostic{{File: "lib/util.py", Line: 2, Severity: severityError, Message: "ZeroDivisionError: division by zero"}},
+		},
+		{
+			name: "library frames are skipped",
+			output: `Traceback (most recent call last):
+  File "/home/runner/project/./main.py", line 2, in <module>
+    json.loads("{")
+  File "/usr/lib/python3.12/json/__init__.py", line 346, in loads
+    return _default_decoder.decode(s)
+           ^^^^^^^^^^^^^^^^^^^^^^^^^^
+  File "/usr/lib/python3.12/json/decoder.py", line 353, in raw_decode
+    obj, end = self.scan_once(s, idx)
+               ^^^^^^^^^^^^^^^^^^^^^^
+json.decoder.JSONDecodeError: Expecting property name enclosed in double quotes: line 1 column 2 (char 1)
+`,
+			want: []Diagnostic{{File: "main.py", Line: 2, Severity: severityError,
+				Message: "json.decoder.JSONDecodeError: Expecting property name enclosed in double quotes: line 1 column 2 (char 1)"}},
+		},
+		{
+			name: "syntax error",
+			output: `  File "/home/runner/project/main.py", line 1
+    print(
+         ^
+SyntaxError: '(' was never closed
+`,
+			want: []Diagnostic{{File: "main.py", Line: 1, Severity: severityError, Message: "SyntaxError: '(' was never closed"}},
+		},
+		{
+			name: "chained exceptions",
+			output: `Traceback (most recent call last):
+  File "/home/runner/project/main.py", line 2, in <module>
+    int("x")
+ValueError: invalid literal for int() with base 10: 'x'
+
+During handling of the above exception, another exception occurred:
+
+Traceback (most recent call last):
+  File "/home/runner/project/main.py", line 4, in <module>
+    raise RuntimeError("bad input")
+RuntimeError: bad input
+`,
+			want: []Diagnostic{
+				{File: "main.py", Line: 2, Severity: severityError, Message: "ValueError: invalid literal for int() with base 10: 'x'"},
+				{File: "main.py", Line: 4, Severity: severityError, Message: "RuntimeError: bad input"},
+			},
+		},
+		{
+			name:   "outside the project",
+			output: "Traceback (most recent call last):\n  File \"/usr/lib/python3.12/runpy.py\", line 198, in _run_module_as_main\nSystemExit: 2\n",
+		},
+		{
+			name:   "no traceback",
+			output: "hello\n",
+		},
+	})
+}
+
+func TestParseGoErrors(t *testing.T) {
+	s := testProject(t, "main.go", "util/util.go")
+	testDiagnostics(t, parseGoErrors, s, []diagnosticsTest{
+		{
+			name: "compiler errors",
+			output: `# command-line-arguments
+./main.go:5:6: undefined: fmt.Printn
+./main.go:9:9: cannot use "x" (untyped string constant) as int value in return statement
+`,
+			want: []Diagnostic{
+				{File: "main.go", Line: 5, Column: 6, Severity: severityError, Message: "undefined: fmt.Printn"},
+				{File: "main.go", Line: 9, Column: 9, Severity: severityError, Message: `cannot use "x" (untyped string constant) as int value in return statement`},
+			},
+		},
+		{
+			name: "vet",
+			output: `# cocode-test/util
+vet: util/util.go:4:2: declared and not used: x
+# cocode-test
+./main.go:7:2: fmt.Printf format %d has arg s of wrong type string
+`,
+			want: []Diagnostic{
+				{File: "util/util.go", Line: 4, Column: 2, Severity: severityError, Message: "declared and not used: x"},
+				{File: "main.go", Line: 7, Column: 2, Severity: severityError, Message: "fmt.Printf format %d has arg s of wrong type string"},
+			},
+		},
+		{
+			name: "panic",
+			output: `panic: runtime error: index out of range [5] with length 3
+
+goroutine 1 [running]:
+cocode-test/util.Get(...)
+	/home/runner/project/util/util.go:8
+main.main()
+	/home/runner/project/main.go:6 +0x1d
+exit status 2
+`,
+			want: []Diagnostic{{File: "util/util.go", Line: 8, Severity: severityError, Message: "panic: runtime error: index out of range [5] with length 3"}},
+		},
+		{
+			name: "panic below runtime frames",
+			output: `panic: assignment to entry in nil map
+
+goroutine 1 [running]:
+internal/runtime/maps.(*Map).putSlotSmall(...)
+	/usr/local/go/src/internal/runtime/maps/map.go:450 +0x1f4
+main.main()
+	/home/runner/project/main.go:5 +0x2e
+exit status 2
+`,
+			want: []Diagnostic{{File: "main.go", Line: 5, Severity: severityError, Message: "panic: assignment to entry in nil map"}},
+		},
+		{
+			name: "fatal error",
+			output: `fatal error: all goroutines are asleep - deadlock!
+
+goroutine 1 [chan receive]:
+main.main()
+	/home/runner/project/main.go:5 +0x2d
+exit status 2
+`,
+			want: []Diagnostic{{File: "main.go", Line: 5, Severity: severityError, Message: "fatal error: all goroutines are asleep - deadlock!"}},
+		},
+		{
+			name:   "outside the project",
+			output: "/usr/local/go/src/fmt/print.go:10:1: something\n",
+		},
+	})
+}
+
+func TestParseGoErrorsOfEntrypointDirectory(t *testing.T) {
+	// go build runs in the directory of the entrypoint
+	s := testProject(t, "cmd/app/main.go")
+	testDiagnostics(t, parseGoErrors, s, []diagnosticsTest{{
+		name:   "relative to the entrypoint",
+		output: "# command-line-arguments\n./main.go:3:8: \"os\" imported and not used\n",
+		want:   []Diagnostic{{File: "cmd/app/main.go", Line: 3, Column: 8, Severity: severityError, Message: `"os" imported and not used`}},
+	}})
+}
+
+func TestParseGCCErrors(t *testing.T) {
+	s := testProject(t, "main.cpp", "util.h")
+	testDiagnostics(t, parseGCCErrors, s, []diagnosticsTest{
+		{
+			name: "errors with source excerpts",
+			output: `main.cpp: In function 'int main()':
+main.cpp:5:5: error: 'cout' was not declared in this scope; did you mean 'std::cout'?
+    5 |     cout << x;
+      |     ^~~~
+      |     std::cout
+In file included from /usr/include/c++/13/iostream:41,
+                 from main.cpp:1:
+/usr/include/c++/13/ostream:61:18: note: 'std::cout' declared here
+main.cpp:5:13: error: 'x' was not declared in this scope
+    5 |     cout << x;
+      |             ^
+`,
+			want: []Diagnostic{
+				{File: "main.cpp", Line: 5, Column: 5, Severity: severityError, Message: "'cout' was not declared in this scope; did you mean 'std::cout'?"},
+				{File: "main.cpp", Line: 5, Column: 13, Severity: severityError, Message: "'x' was not declared in this scope"},
+			},
+		},
+		{
+			name: "warnings and notes",
+			output: `In file included from main.cpp:2:
+util.h: In function 'int twice(int)':
+util.h:3:1: warning: no return statement in function returning non-void [-Wreturn-type]
+    3 | }
+      | ^
+main.cpp:7:9: note: in expansion of macro 'TWICE'
+`,
+			want: []Diagnostic{
+				{File: "util.h", Line: 3, Column: 1, Severity: severityWarning, Message: "no return statement in function returning non-void [-Wreturn-type]"},
+				{File: "main.cpp", Line: 7, Column: 9, Severity: severityNote, Message: "in expansion of macro 'TWICE'"},
+			},
+		},
+		{
+			name: "fatal error",
+			output: `main.cpp:1:10: fatal error: missing.h: No such file or directory
+    1 | #include "missing.h"
+      |          ^~~~~~~~~~~
+compilation terminated.
+`,
+			want: []Diagnostic{{File: "main.cpp", Line: 1, Column: 10, Severity: severityError, Message: "missing.h: No such file or directory"}},
+		},
+		{
+			name:   "runtime errors are not parsed",
+			output: "Segmentation fault (core dumped)\n",
+		},
+	})
+}
+
+func TestParseJavacErrors(t *testing.T) {
+	s := testProject(t, "Main.java", "com/example/Calc.java")
+	testDiagnostics(t, parseJavacErrors, s, []diagnosticsTest{
+		{
+			name: "caret two lines down",
+			output: `Main.java:5: error: cannot find symbol
+        System.out.println(x);
+                           ^
+  symbol:   variable x
+  location: class Main
+Main.java:3: warning: [removal] Integer(int) in Integer has been deprecated and marked for removal
+        Integer i = new Integer(3);
+                    ^
+1 error
+1 warning
+`,
+			want: []Diagnostic{
+				{File: "Main.java", Line: 5, Column: 28, Severity: severityError, Message: "cannot find symbol"},
+				{File: "Main.java", Line: 3, Column: 21, Severity: severityWarning,
+					Message: "[removal] Integer(int) in Integer has been deprecated and marked for removal"},
+			},
+		},
+		{
+			name:   "no caret",
+			output: "./com/example/Calc.java:1: error: class Calculator is public, should be declared in a file named Calculator.java\npublic class Calculator {\n1 error\n",
+			want: []Diagnostic{{File: "com/example/Calc.java", Line: 1, Severity: severityError,
+				Message: "class Calculator is public, should be declared in a file named Calculator.java"}},
+		},
+		{
+			name: "uncaught exception",
+			output: `Exception in thread "main" java.lang.ArithmeticException: / by zero
+	at com.example.Calc.div(Calc.java:4)
+	at Main.main(Main.java:3)
+`,
+			want: []Diagnostic{{File: "com/example/Calc.java", Line: 4, Severity: severityError, Message: "java.lang.ArithmeticException: / by zero"}},
+		},
+		{
+			name: "exception in the JDK",
+			output: `Exception in thread "main" java.lang.NumberFormatException: For input string: "x"
+	at java.base/java.lang.NumberFormatException.forInputString(NumberFormatException.java:67)
+	at java.base/java.lang.Integer.parseInt(Integer.java:662)
+	at Main.main(Main.java:7)
+`,
+			want: []Diagnostic{{File: "Main.java", Line: 7, Severity: severityError, Message: `java.lang.NumberFormatException: For input string: "x"`}},
+		},
+	})
+}
+
+func TestParseLintOutput(t *testing.T) {
+	s := testProject(t, "main.py", "lib/util.py")
+	testDiagnostics(t, parseLintOutput, s, []diagnosticsTest{
+		{
+			name: "ruff",
+			output: "main.py:1:8: F401 [*] `os` imported but unused\nlib/util.py:4:5: F841 Local variable `x` is assigned to but never used\n" +
+				"Found 2 errors.\n[*] 1 fixable with the `--fix` option.\n",
+			want: []Diagnostic{
+				{File: "main.py", Line: 1, Column: 8, Severity: severityWarning, Message: "F401 [*] `os` imported but unused"},
+				{File: "lib/util.py", Line: 4, Column: 5, Severity: severityWarning, Message: "F841 Local variable `x` is assigned to but never used"},
+			},
+		},
+		{
+			name:   "pyflakes",
+			output: "./main.py:3:1: undefined name 'y'\n./lib/util.py:2: 'sys' imported but unused\n",
+			want: []Diagnostic{
+				{File: "main.py", Line: 3, Column: 1, Severity: severityWarning, Message: "undefined name 'y'"},
+				{File: "lib/util.py", Line: 2, Severity: severityWarning, Message: "'sys' imported but unused"},
+			},
+		},
+		{
+			name:   "outside the project",
+			output: "/etc/passwd:1:1: nope\n../main.py:1:1: nope\n",
+		},
+	})
+}
+
+func TestParseESLintJSON(t *testing.T) {
+	s := testProject(t, "src/app.js")
+	testDiagnostics(t, parseESLintJSON, s, []diagnosticsTest{
+		{
+			name: "report",
+			output: `[{"filePath":"/home/runner/project/src/app.js","messages":[` +
+				`{"ruleId":"no-unused-vars","severity":2,"message":"'x' is assigned a value but never used.","line":1,"column":7,"nodeType":"Identifier","endLine":1,"endColumn":8},` +
+				`{"ruleId":null,"severity":1,"message":"Unused eslint-disable directive (no problems were reported).","line":3,"column":1}` +
+				`],"errorCount":1,"warningCount":1,"source":"const x = 1;\n"},` +
+				`{"filePath":"/home/runner/project/node_modules/left-pad/index.js","messages":[{"ruleId":"semi","severity":2,"message":"Missing semicolon.","line":1,"column":9}]}]`,
+			want: []Diagnostic{
+				{File: "src/app.js", Line: 1, Column: 7, Severity: severityError, Message: "'x' is assigned a value but never used. (no-unused-vars)"},
+				{File: "src/app.js", Line: 3, Column: 1, Severity: severityWarning, Message: "Unused eslint-disable directive (no problems were reported)."},
+			},
+		},
+		{
+			name:   "not a report",
+			output: "Oops! Something went wrong! :(\n\nESLint: 9.0.0\n",
+		},
+	})
+}
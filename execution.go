@@ -0,0 +1,669 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Interactive runs wait for input, so they may take longer than the
+	// runner's own timeout, though not longer than the admin maximum
+	interactiveRunTimeout = 2 * time.Minute
+	// Output is streamed in chunks of at most this many bytes
+	runChunkSize = 4096
+	// Lines of input that may wait for the program to read them
+	runInputBuffer    = 64
+	runMaxMessageSize = 1 << 20
+	// Output of a run kept for collaborators who open the session while it runs
+	runReplayLimit = 1 << 20
+)
+
+// runSetupError is a reason a run could not start that the user can act on
+type runSetupError string
+
+func (e runSetupError) Error() string { return string(e) }
+
+// runSpec is a run of a session's project that is ready to start: the runner
+// of its language, its limits, the entrypoint and the project tree written to dir.
+type runSpec struct {
+	sessionID int
+	language  string
+	runner    LanguageRunner
+	limits    Limits
+	warm      *warmContainer // the run uses, if any
+	command   string         // runs instead of the program, like the runner's Test
+	entry     SessionFile
+	dir       string
+	codeHash  string
+}
+
+// sessionLanguage returns the language of the session
+func sessionLanguage(sessionID int) (string, error) {
+	var language string
+	err := db.QueryRow("SELECT COALESCE(language, '') FROM sessions WHERE session_id = ?", sessionID).Scan(&language)
+	return language, err
+}
+
+// prepareRun resolves the runner and the entrypoint of the session (or the
+// file at path entrypoint) and writes the project to a temporary directory.
+// The caller must call cleanup when the run is over.
+func prepareRun(sessionID int, entrypoint string) (*runSpec, error) {
+	language, err := sessionLanguage(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	runner, ok := runners[language]
+	if !ok {
+		return nil, runSetupError("Interpretation is not supported for " + language + " sessions")
+	}
+
+	if err := backend.Ready(language); err != nil {
+		return nil, err
+	}
+
+	limits, err := effectiveLimits(sessionID, runner)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the file to run
+	entry, err := getSessionFile(sessionID, 0)
+	if entrypoint != "" {
+		var p string
+		if p, err = cleanFilePath(entrypoint); err != nil {
+			return nil, runSetupError(err.Error())
+		}
+		err = db.QueryRow("SELECT file_id, path FROM session_files WHERE session_id = ? AND path = ?", sessionID, p).Scan(&entry.FileID, &entry.Path)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, runSetupError("Entrypoint not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Write the project to a temporary directory that is mounted into the
+	// container, so stdin stays reserved for the program input
+	dir, err := os.MkdirTemp("", "cocode-run-*")
+	if err != nil {
+		return nil, err
+	}
+	var codeHash string
+	if err = os.Chmod(dir, 0o755); err == nil {
+		codeHash, err = writeSessionTree(sessionID, dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &runSpec{sessionID: sessionID, language: language, runner: runner, limits: limits,
+		entry: entry, dir: dir, codeHash: codeHash}, nil
+}
+
+// script returns the shell script of the run, called with the entrypoint as "$1"
+func (s *runSpec) script() string {
+	if s.command != "" {
+		return s.command
+	}
+	return s.runner.script()
+}
+
+func (s *runSpec) cleanup() {
+	os.RemoveAll(s.dir)
+	if s.warm != nil {
+		go s.warm.remove()
+	}
+}
+
+// batchRun is a finished run whose whole input was given up front, as for
+// /interpret and test cases
+type batchRun struct {
+	stdin     string
+	began     time.Time
+	duration  time.Duration
+	exitCode  int
+	err       error // as returned by Process.Wait
+	timedOut  bool
+	outputHit bool
+	truncated bool // the output was too long to be kept whole
+	// Output of both streams interleaved, and of each
+	combined, stdout, stderr string
+}
+
+// runBatch runs the program of spec with stdin as its input for at most
+// timeout. The error is only about starting it.
+func (s *runSpec) runBatch(stdin string, timeout time.Duration) (*batchRun, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output := &outputLimiter{limit: int64(s.limits.OutputBytes), exceeded: cancel}
+	var combined, stdout, stderr runOutput
+	began := time.Now()
+	proc, err := backend.Start(ctx, s,
+		limitedWriter{output, io.MultiWriter(&combined, &stdout)},
+		limitedWriter{output, io.MultiWriter(&combined, &stderr)})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		in := proc.Stdin()
+		io.WriteString(in, stdin)
+		in.Close()
+	}()
+	code, err := proc.Wait()
+	return &batchRun{
+		stdin:     stdin,
+		began:     began,
+		duration:  time.Since(began),
+		exitCode:  code,
+		err:       err,
+		timedOut:  errors.Is(ctx.Err(), context.DeadlineExceeded),
+		outputHit: output.hit.Load(),
+		truncated: stdout.isTruncated() || stderr.isTruncated(),
+		combined:  combined.String(),
+		stdout:    stdout.String(),
+		stderr:    stderr.String(),
+	}, nil
+}
+
+// prepareBatchRun prepares a run of the session for a request and waits for
+// a worker, reporting problems to the client itself. finish must be called
+// once the run is over.
+func prepareBatchRun(w http.ResponseWriter, r *http.Request, username string, sid int, entrypoint string) (*runSpec, func(), bool) {
+	spec, err := prepareRun(sid, entrypoint)
+	var setupErr runSetupError
+	var notReady runnerNotReady
+	if errors.As(err, &setupErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	} else if errors.As(err, &notReady) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, nil, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	release, err := queue.acquire(r.Context(), username, sid, nil)
+	if errors.Is(err, errQueueFull) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	} else if errors.Is(err, errTooManyQueued) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	}
+	if err != nil {
+		spec.cleanup()
+		return nil, nil, false
+	}
+	return spec, func() {
+		release()
+		spec.cleanup()
+	}, true
+}
+
+// record returns the run as it is stored for author
+func (b *batchRun) record(s *runSpec, author string) RunRecord {
+	rec := RunRecord{
+		Author:     author,
+		Language:   s.language,
+		Entrypoint: s.entry.Path,
+		CodeHash:   s.codeHash,
+		StartedAt:  b.began.UTC().Format(time.RFC3339),
+		DurationMs: b.duration.Milliseconds(),
+		ExitCode:   &b.exitCode,
+		TimedOut:   b.timedOut,
+		Stdin:      b.stdin,
+		Stdout:     b.stdout,
+		Stderr:     b.stderr,
+	}
+	rec.OOMKilled = oomKilled(b.exitCode, b.outputHit, b.timedOut)
+	rec.LimitHit = limitHit(b.outputHit, b.timedOut, rec.OOMKilled)
+	return rec
+}
+
+// RunMessage is one JSON message on a /run-ws connection. Clients send "run"
+// (with the optional entrypoint and initial stdin in Data), "stdin", "eof"
+// and "kill". The server answers everyone in the session with "queued" while
+// the run waits for a worker, "started", then "stdout", "stderr" and "stdin"
+// chunks as they are written or typed, and finally "exit"; "error" reports
+// a message that could not be handled to its sender only. "lint" carries the
+// diagnostics of linting the session after a save, see lintOnSave.
+type RunMessage struct {
+	Type       string `json:"type"`
+	Data       string `json:"data,omitempty"`
+	Entrypoint string `json:"entrypoint,omitempty"`
+	Author     string `json:"author,omitempty"`
+	StartedAt  string `json:"started_at,omitempty"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	Killed     bool   `json:"killed,omitempty"`
+	OOMKilled  bool   `json:"oom_killed,omitempty"`
+	LimitHit   string `json:"limit_hit,omitempty"` // see limitHit
+	RunID      int    `json:"run_id,omitempty"`    // of the stored run, on "exit"
+	Position   int    `json:"position,omitempty"`  // in the run queue, on "queued"
+	Error      string `json:"error,omitempty"`
+	// Where the errors of a failed run point, on "exit", or the findings of
+	// the linters, on "lint"
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// execution is the program running in a session's console. It exists from
+// the "run" message on, so input and kill work while the project is being
+// prepared or waits in the queue.
+type execution struct {
+	author      string
+	startedAt   time.Time
+	ctx         context.Context
+	cancel      context.CancelFunc
+	input       chan string
+	inputClosed bool // guarded by runConsole.mu
+	killed      atomic.Bool
+
+	// What the program read and wrote, for the runs table
+	stdin, stdout, stderr runOutput
+}
+
+func (run *execution) kill() {
+	run.killed.Store(true)
+	run.cancel()
+}
+
+// runConsole is the shared console of a session: everyone who has the
+// session open sees the same run, whoever started it.
+type runConsole struct {
+	sessionID int
+
+	mu    sync.Mutex
+	conns map[*runConn]bool
+	run   *execution // nil while no program is running
+	// Messages of the current or last run, replayed to late joiners
+	replay     []RunMessage
+	replaySize int
+	// Held while queueing a message to the clients, so everyone gets the
+	// messages in the same order. Taken before mu.
+	sendMu sync.Mutex
+}
+
+var (
+	consolesMu sync.Mutex
+	consoles   = make(map[int]*runConsole) // by session id
+)
+
+type runConn struct {
+	wsConn
+	username string
+	readOnly bool       // a viewer, who watches the output but does not run
+	sendMu   sync.Mutex // held while catching up, so broadcasts come after the replay
+}
+
+// queue sends m to the client. Unlike sendMessage it waits for room instead
+// of dropping the client, which slows a chatty program down to the speed of
+// the connection.
+func (c *runConn) queue(m RunMessage) {
+	msg, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	select {
+	case c.send <- msg:
+	case <-c.done:
+	}
+}
+
+func (c *runConn) queueError(text string) {
+	c.queue(RunMessage{Type: "error", Error: text})
+}
+
+// joinConsole adds c to the console of the session and catches it up on the
+// current or last run. The replay is queued outside the lock, like broadcasts.
+func joinConsole(sessionID int, c *runConn) *runConsole {
+	consolesMu.Lock()
+	console := consoles[sessionID]
+	if console == nil {
+		console = &runConsole{sessionID: sessionID, conns: make(map[*runConn]bool)}
+		consoles[sessionID] = console
+	}
+	console.mu.Lock()
+	consolesMu.Unlock()
+	console.conns[c] = true
+	replay := append([]RunMessage(nil), console.replay...)
+	c.sendMu.Lock()
+	console.mu.Unlock()
+	defer c.sendMu.Unlock()
+	for _, m := range replay {
+		c.queue(m)
+	}
+	return console
+}
+
+// leaveConsole removes c from the console. A program nobody is watching any
+// more is killed.
+func leaveConsole(console *runConsole, c *runConn) {
+	consolesMu.Lock()
+	defer consolesMu.Unlock()
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	delete(console.conns, c)
+	if len(console.conns) > 0 {
+		return
+	}
+	if console.run != nil {
+		console.run.kill()
+	}
+	delete(consoles, console.sessionID)
+}
+
+// broadcast sends m to everyone in the console and keeps it for late joiners.
+// Messages are queued outside the lock, so a slow client doesn't hold up
+// input and kill from the others.
+func (console *runConsole) broadcast(m RunMessage) {
+	console.send(m, true)
+}
+
+// send queues m to everyone in the console, in the same order for all, and
+// keeps it for late joiners if replay is set.
+func (console *runConsole) send(m RunMessage, replay bool) {
+	console.sendMu.Lock()
+	defer console.sendMu.Unlock()
+	console.mu.Lock()
+	if replay && m.Type == "started" {
+		console.replay, console.replaySize = nil, 0
+	}
+	if replay && console.replaySize+len(m.Data) <= runReplayLimit {
+		console.replay = append(console.replay, m)
+		console.replaySize += len(m.Data)
+	}
+	conns := make([]*runConn, 0, len(console.conns))
+	for c := range console.conns {
+		conns = append(conns, c)
+	}
+	console.mu.Unlock()
+	for _, c := range conns {
+		c.sendMu.Lock()
+		c.queue(m)
+		c.sendMu.Unlock()
+	}
+}
+
+// publishRun shows a run that did not go through the console, like one from
+// /interpret, to everyone who has the session open. It is kept for late
+// joiners unless a console run is going on, whose replay it would replace.
+func publishRun(sessionID int, msgs ...RunMessage) {
+	consolesMu.Lock()
+	console := consoles[sessionID]
+	consolesMu.Unlock()
+	if console == nil {
+		return
+	}
+	console.mu.Lock()
+	running := console.run != nil
+	console.mu.Unlock()
+	for _, m := range msgs {
+		console.send(m, !running)
+	}
+}
+
+// handleMessage handles a message of c. Errors and the echo of input are
+// queued after the console is unlocked, so a slow client holds up nobody else.
+func (console *runConsole) handleMessage(c *runConn, m RunMessage) {
+	problem, echo := console.apply(c, m)
+	if problem != "" {
+		c.queueError(problem)
+	}
+	if echo != nil {
+		console.broadcast(*echo)
+	}
+}
+
+// apply acts on a message of c under the console lock. It returns the
+// problem to report to c and the input to echo to everyone, if any.
+func (console *runConsole) apply(c *runConn, m RunMessage) (string, *RunMessage) {
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	run := console.run
+	if c.readOnly {
+		return roleRequired(roleEditor).Error(), nil
+	}
+	switch m.Type {
+	case "run":
+		if run != nil {
+			return run.author + " is already running the program", nil
+		}
+		run = &execution{
+			author:    c.username,
+			startedAt: time.Now().UTC(),
+			input:     make(chan string, runInputBuffer),
+		}
+		run.ctx, run.cancel = context.WithCancel(context.Background())
+		if m.Data != "" {
+			run.input <- m.Data
+		}
+		console.run = run
+		go console.execute(c, run, m.Entrypoint)
+	case "stdin", "eof":
+		if run == nil || run.inputClosed {
+			return "The program is not reading input", nil
+		}
+		if m.Type == "eof" {
+			close(run.input)
+			run.inputClosed = true
+			return "", nil
+		}
+		select {
+		case run.input <- m.Data:
+			return "", &RunMessage{Type: "stdin", Data: m.Data, Author: c.username}
+		default:
+			return "Input is arriving faster than the program reads it", nil
+		}
+	case "kill":
+		if run != nil {
+			run.kill()
+		}
+	default:
+		return "Unknown message type " + m.Type, nil
+	}
+	return "", nil
+}
+
+// execute prepares and runs the project, streaming its output to everyone in
+// the console. Problems starting it are reported to starter only.
+func (console *runConsole) execute(starter *runConn, run *execution, entrypoint string) {
+	defer func() {
+		run.cancel()
+		console.mu.Lock()
+		if !run.inputClosed {
+			close(run.input)
+			run.inputClosed = true
+		}
+		console.run = nil
+		console.mu.Unlock()
+	}()
+
+	spec, err := prepareRun(console.sessionID, entrypoint)
+	if err != nil {
+		starter.queueError(err.Error())
+		return
+	}
+	defer spec.cleanup()
+	started := RunMessage{
+		Type:       "started",
+		Entrypoint: spec.entry.Path,
+		Author:     run.author,
+		StartedAt:  run.startedAt.Format(time.RFC3339),
+	}
+	// Killed before it started, possibly while it waited for a worker
+	killedEarly := func() {
+		console.broadcast(started)
+		console.broadcast(RunMessage{Type: "exit", Author: run.author, StartedAt: started.StartedAt, Killed: true})
+	}
+	if run.ctx.Err() != nil {
+		killedEarly()
+		return
+	}
+	release, err := queue.acquire(run.ctx, run.author, console.sessionID, func(pos int) {
+		console.broadcast(RunMessage{Type: "queued", Entrypoint: spec.entry.Path, Author: run.author, Position: pos})
+	})
+	if err != nil && run.ctx.Err() != nil {
+		killedEarly()
+		return
+	} else if err != nil {
+		starter.queueError(err.Error())
+		return
+	}
+	defer release()
+
+	timeout := max(spec.limits.timeout(), min(interactiveRunTimeout, runnerConfig.Max.timeout()))
+	ctx, cancel := context.WithTimeout(run.ctx, timeout)
+	defer cancel()
+	output := &outputLimiter{limit: int64(spec.limits.OutputBytes), exceeded: cancel}
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+	began := time.Now()
+	proc, err := backend.Start(ctx, spec, stdoutW, stderrW)
+	if err != nil {
+		starter.queueError(err.Error())
+		return
+	}
+	console.broadcast(started)
+
+	go func() {
+		stdin := proc.Stdin()
+		for data := range run.input {
+			// Input the program no longer reads is dropped
+			io.WriteString(stdin, data)
+			run.stdin.Write([]byte(data))
+		}
+		stdin.Close()
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go console.stream("stdout", io.TeeReader(stdoutR, &run.stdout), output, &wg)
+	go console.stream("stderr", io.TeeReader(stderrR, &run.stderr), output, &wg)
+	code, err := proc.Wait()
+	stdoutW.Close()
+	stderrW.Close()
+	wg.Wait()
+
+	exit := RunMessage{Type: "exit", Author: run.author, StartedAt: started.StartedAt, Killed: run.killed.Load(), ExitCode: &code}
+	exit.TimedOut = !exit.Killed && errors.Is(ctx.Err(), context.DeadlineExceeded)
+	exit.OOMKilled = oomKilled(code, exit.Killed || output.hit.Load(), exit.TimedOut)
+	exit.LimitHit = limitHit(output.hit.Load(), exit.TimedOut, exit.OOMKilled)
+	if err != nil && !exit.Killed && exit.LimitHit == "" {
+		exit.Error = err.Error()
+		exit.Diagnostics = spec.diagnostics(run.stderr.String())
+	}
+	rec := RunRecord{
+		Author:     run.author,
+		Language:   spec.language,
+		Entrypoint: spec.entry.Path,
+		CodeHash:   spec.codeHash,
+		StartedAt:  started.StartedAt,
+		DurationMs: time.Since(began).Milliseconds(),
+		ExitCode:   exit.ExitCode,
+		TimedOut:   exit.TimedOut,
+		Killed:     exit.Killed,
+		OOMKilled:  exit.OOMKilled,
+		LimitHit:   exit.LimitHit,
+		Stdin:      run.stdin.String(),
+		Stdout:     run.stdout.String(),
+		Stderr:     run.stderr.String(),
+	}
+	if err := recordRun(console.sessionID, &rec); err != nil {
+		log.Printf("run: storing run of session %d: %v", console.sessionID, err)
+	}
+	exit.RunID = rec.RunID
+	console.broadcast(exit)
+}
+
+// stream forwards output of the program in chunks as it is written, until
+// the run's output limit is reached. Chunks never end inside a UTF-8
+// sequence, so multi-byte characters survive.
+func (console *runConsole) stream(kind string, r io.Reader, output *outputLimiter, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, runChunkSize)
+	pending := 0
+	for {
+		n, err := r.Read(buf[pending:])
+		n += pending
+		cut := n
+		if err == nil {
+			cut = completeUTF8(buf[:n])
+		}
+		if allowed := output.allow(cut); allowed == cut && cut > 0 {
+			console.broadcast(RunMessage{Type: kind, Data: string(buf[:cut])})
+		} else if allowed > 0 {
+			console.broadcast(RunMessage{Type: kind, Data: string(buf[:completeUTF8(buf[:allowed])])})
+		}
+		pending = copy(buf, buf[cut:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// completeUTF8 returns the length of the longest prefix of b that does not
+// end in the middle of a UTF-8 sequence.
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+func (c *runConn) readPump(console *runConsole) {
+	defer func() {
+		leaveConsole(console, c)
+		c.close()
+	}()
+	c.ws.SetReadLimit(runMaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		var m RunMessage
+		if err := json.Unmarshal(msg, &m); err != nil {
+			c.queueError("Invalid message")
+			continue
+		}
+		console.handleMessage(c, m)
+	}
+}
+
+// serveRunWs connects to the shared run console of a session for
+// /run-ws?session_id=<id>. Output is streamed as it is written, with stdout
+// and stderr kept apart, and every editor can type input and kill the program
+// while it runs. Viewers, and anyone watching a public session, only watch.
+func serveRunWs(w http.ResponseWriter, r *http.Request) {
+	username, sessionID, role, ok := viewerAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied with an error
+		return
+	}
+	c := &runConn{wsConn: newWsConn(ws, websocket.TextMessage), username: username, readOnly: !atLeast(role, roleEditor)}
+	go c.writePump()
+	c.readPump(joinConsole(sessionID, c))
+}
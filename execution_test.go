@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// setupRunTest gives the test a fresh database with a Python session of
+// alice, shared with bob as a viewer, and runs programs with fake
+func setupRunTest(t *testing.T, fake *fakeRunner) int {
+	t.Helper()
+	t.Setenv("JWT_SECRET", testSecret)
+	var err error
+	db, err = sql.Open("sqlite3", t.TempDir()+"/cocode.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	prev := backend
+	backend = fake
+	t.Cleanup(func() { backend = prev })
+
+	_, err = db.Exec(`INSERT INTO users(username, password_hash) VALUES ('alice', ''), ('bob', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO sessions(owner_id, language, project_name) VALUES (1, 'Python', 'test')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	sid := int(id)
+	fileID, err := createFile(sid, "main.py", "print(input())")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE sessions SET entry_file_id = ? WHERE session_id = ?", fileID, sid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO collabs(session_id, user_id, role) VALUES (?, 2, ?)", sid, roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	return sid
+}
+
+// testSecret signs the login tokens of the tests
+const testSecret = "test_secret"
+
+func loginCookie(t *testing.T, username string) *http.Cookie {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": username,
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: "jwt", Value: token}
+}
+
+func interpret(t *testing.T, username string, sid int, stdin string) (int, InterpretResponse) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"session_id": strconv.Itoa(sid), "stdin": stdin})
+	r := httptest.NewRequest("POST", "/interpret", bytes.NewReader(body))
+	r.AddCookie(loginCookie(t, username))
+	w := httptest.NewRecorder()
+	interpretHandler(w, r)
+	var resp InterpretResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding %q: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestInterpretRunsTheEntrypoint(t *testing.T) {
+	fake := &fakeRunner{}
+	sid := setupRunTest(t, fake)
+
+	code, resp := interpret(t, "alice", sid, "hello")
+	if code != http.StatusOK || !resp.Success || resp.Output != "hello" {
+		t.Fatalf("got %d %+v, want the input echoed", code, resp)
+	}
+	if resp.RunID == 0 {
+		t.Error("the run was not stored")
+	}
+	runs := fake.Runs()
+	if len(runs) != 1 || runs[0].entry.Path != "main.py" || runs[0].language != "Python" {
+		t.Fatalf("started %+v, want one run of main.py", runs)
+	}
+}
+
+func TestInterpretReportsFailures(t *testing.T) {
+	fake := &fakeRunner{Program: func(ctx context.Context, s *runSpec, stdin io.Reader, stdout, stderr io.Writer) int {
+		io.WriteString(stdout, "partial")
+		io.WriteString(stderr, "Traceback (most recent call last):\n  File \"/home/runner/project/main.py\", line 1, in <module>\nNameError: name 'x' is not defined\n")
+		return 1
+	}}
+	sid := setupRunTest(t, fake)
+
+	code, resp := interpret(t, "alice", sid, "")
+	if code != http.StatusOK || resp.Success || resp.Error != "exit status 1" {
+		t.Fatalf("got %d %+v, want a failed run", code, resp)
+	}
+	if !strings.Contains(resp.Output, "partial") {
+		t.Errorf("output %q lacks what the program wrote", resp.Output)
+	}
+	if len(resp.Diagnostics) != 1 || resp.Diagnostics[0].Line != 1 {
+		t.Errorf("diagnostics %+v, want the traceback's line", resp.Diagnostics)
+	}
+}
+
+func TestInterpretChecksAccessAndReadiness(t *testing.T) {
+	fake := &fakeRunner{NotReady: map[string]bool{}}
+	sid := setupRunTest(t, fake)
+
+	if code, _ := interpret(t, "bob", sid, ""); code != http.StatusForbidden {
+		t.Errorf("viewer got %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ := interpret(t, "carol", sid, ""); code != http.StatusForbidden {
+		t.Errorf("outsider got %d, want %d", code, http.StatusForbidden)
+	}
+	fake.NotReady["Python"] = true
+	if code, _ := interpret(t, "alice", sid, ""); code != http.StatusServiceUnavailable {
+		t.Errorf("run without a ready runner got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if len(fake.Runs()) != 0 {
+		t.Errorf("%d runs started, want none", len(fake.Runs()))
+	}
+}
+
+// runClient is a /run-ws connection of a test
+type runClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+func dialRun(t *testing.T, srv *httptest.Server, username string, sid int) *runClient {
+	t.Helper()
+	h := http.Header{}
+	h.Add("Cookie", loginCookie(t, username).String())
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/run-ws?session_id=" + strconv.Itoa(sid)
+	ws, _, err := websocket.DefaultDialer.Dial(url, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return &runClient{t, ws}
+}
+
+func (c *runClient) send(m RunMessage) {
+	c.t.Helper()
+	if err := c.ws.WriteJSON(m); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next reads the next message
+func (c *runClient) next() RunMessage {
+	c.t.Helper()
+	c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m RunMessage
+	if err := c.ws.ReadJSON(&m); err != nil {
+		c.t.Fatalf("reading: %v", err)
+	}
+	return m
+}
+
+// expect reads messages until one of type typ, which it returns
+func (c *runClient) expect(typ string) RunMessage {
+	c.t.Helper()
+	for {
+		if m := c.next(); m.Type == typ {
+			return m
+		}
+	}
+}
+
+func TestRunConsoleIsShared(t *testing.T) {
+	// The program greets every line it reads
+	fake := &fakeRunner{Program: func(ctx context.Context, s *runSpec, stdin io.Reader, stdout, stderr io.Writer) int {
+		lines := bufio.NewScanner(stdin)
+		for lines.Scan() {
+			fmt.Fprintf(stdout, "hello %s\n", lines.Text())
+		}
+		return 0
+	}}
+	sid := setupRunTest(t, fake)
+	srv := httptest.NewServer(http.HandlerFunc(serveRunWs))
+	defer srv.Close()
+
+	alice := dialRun(t, srv, "alice", sid)
+	bob := dialRun(t, srv, "bob", sid)
+	alice.send(RunMessage{Type: "run"})
+	for _, c := range []*runClient{alice, bob} {
+		if m := c.expect("started"); m.Author != "alice" || m.Entrypoint != "main.py" {
+			t.Fatalf("started %+v", m)
+		}
+	}
+
+	// The input is echoed before the output it caused
+	alice.send(RunMessage{Type: "stdin", Data: "bob\n"})
+	for _, c := range []*runClient{alice, bob} {
+		if m := c.next(); m.Type != "stdin" || m.Data != "bob\n" || m.Author != "alice" {
+			t.Errorf("echo %+v", m)
+		}
+		if m := c.next(); m.Type != "stdout" || m.Data != "hello bob\n" {
+			t.Errorf("output %+v", m)
+		}
+	}
+
+	// Viewers watch but cannot type
+	bob.send(RunMessage{Type: "stdin", Data: "mallory\n"})
+	if m := bob.expect("error"); m.Error != roleRequired(roleEditor).Error() {
+		t.Errorf("viewer input got %q", m.Error)
+	}
+
+	alice.send(RunMessage{Type: "eof"})
+	for _, c := range []*runClient{alice, bob} {
+		m := c.expect("exit")
+		if m.ExitCode == nil || *m.ExitCode != 0 || m.Killed || m.RunID == 0 {
+			t.Errorf("exit %+v, want a clean stored exit", m)
+		}
+	}
+}
+
+func TestRunConsoleKill(t *testing.T) {
+	// The program runs until it is killed
+	fake := &fakeRunner{Program: func(ctx context.Context, s *runSpec, stdin io.Reader, stdout, stderr io.Writer) int {
+		io.WriteString(stdout, "working\n")
+		<-ctx.Done()
+		return -1
+	}}
+	sid := setupRunTest(t, fake)
+	srv := httptest.NewServer(http.HandlerFunc(serveRunWs))
+	defer srv.Close()
+
+	alice := dialRun(t, srv, "alice", sid)
+	alice.send(RunMessage{Type: "run"})
+	alice.expect("stdout")
+	alice.send(RunMessage{Type: "run"})
+	if m := alice.expect("error"); !strings.Contains(m.Error, "already running") {
+		t.Errorf("second run got %q", m.Error)
+	}
+
+	// Someone opening the session now catches up on the run
+	late := dialRun(t, srv, "bob", sid)
+	if m := late.expect("stdout"); m.Data != "working\n" {
+		t.Errorf("replay %q", m.Data)
+	}
+
+	alice.send(RunMessage{Type: "kill"})
+	for _, c := range []*runClient{alice, late} {
+		if m := c.expect("exit"); !m.Killed {
+			t.Errorf("exit %+v, want killed", m)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// fakeRunner is a Runner for tests: Program plays the part of the project's
+// program, so nothing is executed. Set backend to a fakeRunner to use it.
+type fakeRunner struct {
+	// Program reads the program's input and writes its output, returning
+	// the exit code. It should return once ctx is done. Without a Program
+	// runs copy their input to stdout.
+	Program func(ctx context.Context, spec *runSpec, stdin io.Reader, stdout, stderr io.Writer) int
+	// Languages whose runner is not ready
+	NotReady map[string]bool
+
+	mu   sync.Mutex
+	runs []*runSpec
+}
+
+func (f *fakeRunner) Ready(language string) error {
+	if f.NotReady[language] {
+		return runnerNotReady("The " + language + " runner is not ready")
+	}
+	return nil
+}
+
+func (f *fakeRunner) Start(ctx context.Context, s *runSpec, stdout, stderr io.Writer) (Process, error) {
+	f.mu.Lock()
+	f.runs = append(f.runs, s)
+	f.mu.Unlock()
+	program := f.Program
+	if program == nil {
+		program = func(ctx context.Context, s *runSpec, stdin io.Reader, stdout, stderr io.Writer) int {
+			io.Copy(stdout, stdin)
+			return 0
+		}
+	}
+
+	stdinR, stdinW := io.Pipe()
+	p := &fakeProcess{ctx: ctx, stdin: stdinW, stdinR: stdinR, done: make(chan struct{})}
+	go func() {
+		p.code = program(ctx, s, stdinR, stdout, stderr)
+		// Input the program no longer reads fails, as with a real one
+		stdinR.CloseWithError(io.ErrClosedPipe)
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// Runs returns the specs of the runs started so far
+func (f *fakeRunner) Runs() []*runSpec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*runSpec(nil), f.runs...)
+}
+
+type fakeProcess struct {
+	ctx    context.Context
+	stdin  *io.PipeWriter
+	stdinR *io.PipeReader
+	done   chan struct{}
+	code   int
+}
+
+func (p *fakeProcess) Stdin() io.WriteCloser { return p.stdin }
+
+// Wait returns once the program did, so it wrote all its output by then.
+// Killing it closes its input, like the end of a real process would.
+func (p *fakeProcess) Wait() (int, error) {
+	select {
+	case <-p.done:
+	case <-p.ctx.Done():
+		p.stdinR.CloseWithError(io.ErrClosedPipe)
+		<-p.done
+		return -1, errors.New("signal: killed")
+	}
+	if p.code != 0 {
+		return p.code, fmt.Errorf("exit status %d", p.code)
+	}
+	return 0, nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxSessionFiles = 500
+	maxPathLength   = 255
+)
+
+type SessionFile struct {
+	FileID     int    `json:"file_id"`
+	Path       string `json:"path"`
+	Entrypoint bool   `json:"entrypoint"`
+}
+
+// defaultFileNames is the first file of a new session per dashboard language
+var defaultFileNames = map[string]string{
+	"Python":     "main.py",
+	"Golang":     "main.go",
+	"JavaScript": "main.js",
+	"C++":        "main.cpp",
+	"Java":       "Main.java",
+	"Rust":       "main.rs",
+	"SQL":        "main.sql",
+	"HTML":       "index.html",
+	"CSS":        "style.css",
+	"Markdown":   "README.md",
+}
+
+func defaultFileName(language string) string {
+	if name, ok := defaultFileNames[language]; ok {
+		return name
+	}
+	return "main.txt"
+}
+
+var (
+	errInvalidPath  = errors.New("invalid path: use a relative path like src/main.py")
+	errFileNotFound = errors.New("file not found")
+)
+
+// cleanFilePath normalizes a project path and rejects anything that could
+// escape the project directory once the tree is written to disk.
+func cleanFilePath(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" || len(p) > maxPathLength || strings.ContainsAny(p, "\\\x00") || strings.HasPrefix(p, "/") {
+		return "", errInvalidPath
+	}
+	p = path.Clean(p)
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", errInvalidPath
+	}
+	return p, nil
+}
+
+// SQL conditions on session_files.path. Plain string comparisons are used
+// because LIKE would treat "_" and "%" in file names as wildcards.
+const (
+	// path is inside the folder given as the two parameters
+	sqlPathInFolder = "substr(path, 1, length(?) + 1) = ? || '/'"
+	// path clashes with the path given as the four parameters: same path, a
+	// file inside it, or a file it would have to be inside of
+	sqlPathClashes = "(path = ? OR substr(path, 1, length(?) + 1) = ? || '/' OR substr(?, 1, length(path) + 1) = path || '/')"
+)
+
+// createFile adds a file to the session. It fails if a file or folder with
+// that path already exists.
+func createFile(sessionID int, p string, content string) (int, error) {
+	var count, clash int
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(`+sqlPathClashes+`), 0)
+		FROM session_files WHERE session_id = ?`, p, p, p, p, sessionID).Scan(&count, &clash)
+	if err != nil {
+		return 0, err
+	}
+	if clash > 0 {
+		return 0, errors.New("a file or folder named " + p + " already exists")
+	}
+	if count >= maxSessionFiles {
+		return 0, errors.New("too many files in this session")
+	}
+	res, err := db.Exec("INSERT INTO session_files(session_id, path, content) VALUES (?, ?, ?)", sessionID, p, content)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// migrateSessionFiles moves sessions created before multi-file projects into
+// a single file, together with their live document state and history.
+func migrateSessionFiles() error {
+	rows, err := db.Query(`SELECT session_id, COALESCE(language, ''), COALESCE(content, ''), ydoc FROM sessions
+		WHERE session_id NOT IN (SELECT session_id FROM session_files)`)
+	if err != nil {
+		return err
+	}
+	type legacySession struct {
+		id       int
+		language string
+		content  string
+		state    []byte
+	}
+	var legacy []legacySession
+	for rows.Next() {
+		var s legacySession
+		if err := rows.Scan(&s.id, &s.language, &s.content, &s.state); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, s)
+	}
+	rows.Close()
+	for _, s := range legacy {
+		res, err := db.Exec("INSERT INTO session_files(session_id, path, content, ydoc) VALUES (?, ?, ?, ?)",
+			s.id, defaultFileName(s.language), s.content, s.state)
+		if err != nil {
+			return err
+		}
+		fileID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err = db.Exec("UPDATE sessions SET entry_file_id = ? WHERE session_id = ?", fileID, s.id); err != nil {
+			return err
+		}
+		if _, err = db.Exec("UPDATE session_versions SET file_id = ? WHERE session_id = ? AND file_id IS NULL", fileID, s.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sessionFiles(sessionID int) ([]SessionFile, error) {
+	rows, err := db.Query(`SELECT f.file_id, f.path, f.file_id = COALESCE(s.entry_file_id, 0)
+		FROM session_files f JOIN sessions s ON f.session_id = s.session_id
+		WHERE f.session_id = ? ORDER BY f.path`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := []SessionFile{}
+	for rows.Next() {
+		var f SessionFile
+		if err := rows.Scan(&f.FileID, &f.Path, &f.Entrypoint); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// getSessionFile returns a file of the session, or its entrypoint if fileID is 0.
+func getSessionFile(sessionID, fileID int) (SessionFile, error) {
+	var f SessionFile
+	err := db.QueryRow(`SELECT f.file_id, f.path, f.file_id = COALESCE(s.entry_file_id, 0)
+		FROM session_files f JOIN sessions s ON f.session_id = s.session_id
+		WHERE f.session_id = ? AND f.file_id = CASE WHEN ? = 0 THEN s.entry_file_id ELSE ? END`,
+		sessionID, fileID, fileID).Scan(&f.FileID, &f.Path, &f.Entrypoint)
+	return f, err
+}
+
+// fileFromRequest resolves the file_id form value (or the entrypoint when it
+// is empty) within the session, writing the error response on failure.
+func fileFromRequest(w http.ResponseWriter, r *http.Request, sid int) (SessionFile, bool) {
+	var fileID int
+	if v := r.FormValue("file_id"); v != "" {
+		var err error
+		if fileID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid file_id", http.StatusBadRequest)
+			return SessionFile{}, false
+		}
+	}
+	f, err := getSessionFile(sid, fileID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return SessionFile{}, false
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return SessionFile{}, false
+	}
+	return f, true
+}
+
+// fileText returns the current text of a file, from its live document if it is open.
+func fileText(fileID int) (string, error) {
+	if live, ok := liveFileContent(fileID); ok {
+		return live, nil
+	}
+	var content string
+	err := db.QueryRow("SELECT COALESCE(content, '') FROM session_files WHERE file_id = ?", fileID).Scan(&content)
+	return content, err
+}
+
+// writeSessionTree writes the current content of every file of the session
+// below dir, so a runner can mount the whole project. It returns a hash of
+// the paths and contents written.
+func writeSessionTree(sessionID int, dir string) (string, error) {
+	files, err := sessionFiles(sessionID)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, f := range files {
+		content, err := fileText(f.FileID)
+		if err != nil {
+			return "", err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(target, []byte(content), 0o644); err != nil {
+			return "", err
+		}
+		hash.Write([]byte(f.Path + "\x00" + content + "\x00"))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sessionFilesHandler lists the files of a session
+func sessionFilesHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	files, err := sessionFiles(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, files)
+}
+
+func createFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	p, err := cleanFilePath(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fileID, err := createFile(sid, p, r.FormValue("content"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, SessionFile{FileID: fileID, Path: p})
+}
+
+// renameFileHandler gives a file a new path, which also moves it between folders
+func renameFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	f, ok := fileFromRequest(w, r, sid)
+	if !ok {
+		return
+	}
+	p, err := cleanFilePath(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var clash int
+	err = db.QueryRow(`SELECT COUNT(*) FROM session_files WHERE session_id = ? AND file_id != ? AND `+sqlPathClashes,
+		sid, f.FileID, p, p, p, p).Scan(&clash)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if clash > 0 {
+		http.Error(w, "A file or folder named "+p+" already exists", http.StatusBadRequest)
+		return
+	}
+	if _, err = db.Exec("UPDATE session_files SET path = ? WHERE file_id = ?", p, f.FileID); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SessionFile{FileID: f.FileID, Path: p, Entrypoint: f.Entrypoint})
+}
+
+// moveFolderHandler moves every file below folder "from" to folder "to"
+func moveFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	from, err := cleanFilePath(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := cleanFilePath(r.FormValue("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to == from || strings.HasPrefix(to, from+"/") {
+		http.Error(w, "Cannot move a folder into itself", http.StatusBadRequest)
+		return
+	}
+	var moving, clash int
+	err = db.QueryRow(`SELECT COALESCE(SUM(`+sqlPathInFolder+`), 0),
+			COALESCE(SUM(NOT `+sqlPathInFolder+` AND `+sqlPathClashes+`), 0)
+		FROM session_files WHERE session_id = ?`, from, from, from, from, to, to, to, to, sid).Scan(&moving, &clash)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if moving == 0 {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	if clash > 0 {
+		http.Error(w, "A file or folder named "+to+" already exists", http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec(`UPDATE session_files SET path = ? || substr(path, length(?) + 1) WHERE session_id = ? AND `+sqlPathInFolder,
+		to, from, sid, from, from)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SaveResponse{Success: true})
+}
+
+func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	f, ok := fileFromRequest(w, r, sid)
+	if !ok {
+		return
+	}
+	if f.Entrypoint {
+		http.Error(w, "Choose another entrypoint before deleting "+f.Path, http.StatusBadRequest)
+		return
+	}
+	closeRoom(f.FileID)
+	// Named snapshots are never pruned, they keep the file as it was
+	if _, err := db.Exec("DELETE FROM session_versions WHERE file_id = ? AND name IS NULL", f.FileID); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM session_files WHERE file_id = ?", f.FileID); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SaveResponse{Success: true})
+}
+
+// setEntrypointHandler chooses the file that is run by /interpret
+func setEntrypointHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	f, ok := fileFromRequest(w, r, sid)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec("UPDATE sessions SET entry_file_id = ? WHERE session_id = ?", f.FileID, sid); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SaveResponse{Success: true})
+}
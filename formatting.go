@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+type FormatResponse struct {
+	Success bool   `json:"success"`
+	Changed bool   `json:"changed"` // false if the file was formatted already
+	Error   string `json:"error,omitempty"`
+}
+
+// formatHandler runs the formatter of the session's language on a file in
+// its runner, like any run, and applies the result to the shared document
+// as a single edit so everyone with the file open gets it. Whoever may save
+// the file may format it, see saveSessionContent.
+func formatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The same check saveSessionContent makes before it applies the result
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	file, ok := fileFromRequest(w, r, sid)
+	if !ok {
+		return
+	}
+	language, err := sessionLanguage(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if runners[language].Format == "" {
+		http.Error(w, "Formatting is not supported for "+language+" sessions", http.StatusBadRequest)
+		return
+	}
+	text, err := fileText(file.FileID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	spec, finish, ok := prepareBatchRun(w, r, username, sid, file.Path)
+	if !ok {
+		return
+	}
+	defer finish()
+	spec.command = spec.runner.Format
+	res, err := spec.runBatch(text, spec.limits.timeout())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Only a complete result replaces the file
+	hit := limitHit(res.outputHit, res.timedOut, oomKilled(res.exitCode, res.outputHit, res.timedOut))
+	formatted := res.stdout
+	switch {
+	case hit != "":
+		http.Error(w, "Formatting failed: "+limitMessages[hit], http.StatusUnprocessableEntity)
+		return
+	case res.err != nil:
+		http.Error(w, "Formatting failed: "+strings.TrimSpace(res.stderr), http.StatusUnprocessableEntity)
+		return
+	case res.truncated || strings.TrimSpace(formatted) == "" && strings.TrimSpace(text) != "":
+		http.Error(w, "Formatting failed: the formatter returned no complete file", http.StatusUnprocessableEntity)
+		return
+	}
+	if formatted == text {
+		writeJSON(w, FormatResponse{Success: true})
+		return
+	}
+
+	// Edits made while the formatter ran win over its result
+	current, err := fileText(file.FileID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if current != text {
+		http.Error(w, "The file changed while it was formatted, try again", http.StatusConflict)
+		return
+	}
+	if err := saveSessionContent(sid, file.FileID, formatted, username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, FormatResponse{Success: true, Changed: true})
+}
@@ -6,7 +6,6 @@
 import * as Y from 'yjs';
 import { CodemirrorBinding } from 'y-codemirror';
 import { WebsocketProvider } from 'y-websocket';
-import { IndexeddbPersistence } from 'y-indexeddb'
 
 // Import CodeMirror and required modes/addons so esbuild bundles them into static/app.js.
 // This avoids loading a separate CDN copy and ensures addons like defineSimpleMode are present.
@@ -23,6 +22,7 @@ import 'codemirror/mode/rust/rust.js';
 import 'codemirror/addon/edit/matchbrackets.js';
 import 'codemirror/addon/edit/closebrackets.js';
 import 'codemirror/addon/mode/simple.js';
+import { connectLanguageServer } from './lsp.js';
 
 // Ensure a single CodeMirror instance is available on window and use it.
 if (typeof window !== 'undefined' && !window.CodeMirror) {
@@ -44,14 +44,44 @@ const MODE_MAP = {
   'Markdown': 'markdown'
 };
 
+// Mode by file extension, so every file of a project is highlighted as what it is
+const EXTENSION_MODE_MAP = {
+  'js': 'javascript',
+  'mjs': 'javascript',
+  'json': 'application/json',
+  'ts': 'text/typescript',
+  'go': 'go',
+  'py': 'python',
+  'java': 'text/x-java',
+  'html': 'htmlmixed',
+  'htm': 'htmlmixed',
+  'css': 'css',
+  'c': 'text/x-csrc',
+  'h': 'text/x-csrc',
+  'cpp': 'text/x-c++src',
+  'cc': 'text/x-c++src',
+  'hpp': 'text/x-c++src',
+  'rs': 'text/x-rustsrc',
+  'sql': 'sql',
+  'md': 'markdown'
+};
+
+function modeFor(filePath, language) {
+  const dot = filePath ? filePath.lastIndexOf('.') : -1;
+  const ext = dot >= 0 ? filePath.slice(dot + 1).toLowerCase() : '';
+  return EXTENSION_MODE_MAP[ext] || MODE_MAP[language] || 'javascript';
+}
+
 /**
  * Initialize Yjs document and WebSocket provider
  * @param {string} sessionId - The session ID
  * @param {string} username - Current username
  * @param {string} language - Programming language for syntax highlighting
  * @param {string} initialContent - Initial code content
+ * @param {string} fileId - The file of the session to edit
+ * @param {string} filePath - Path of that file, used to pick the editor mode
  */
-export function initializeYjsEditor(sessionId, username, language, initialContent) {
+export function initializeYjsEditor(sessionId, username, language, initialContent, fileId, filePath) {
   // Create Yjs document
   const ydoc = new Y.Doc();
   // Debug: log local document updates so we can see when local edits produce Yjs updates
@@ -68,89 +98,22 @@ export function initializeYjsEditor(sessionId, username, language, initialConten
   const ytext = ydoc.getText('shared-text');
   
   // Create WebSocket provider for sync between clients and server
-  // Connect to the server's /ws endpoint and pass session/username as query params
+  // Connect to the server's /ws endpoint and pass the session as a query param
   // WebsocketProvider builds the final URL as serverUrl + "/" + roomname + "?" + params
-  // We use roomname = "ws" so the final URL becomes "/ws?session=...&username=..." which the Go handler expects.
-  // const provider = new WebsocketProvider(
-  //   `${window.location.protocol === 'https:' ? 'wss:' : 'ws:'}//${window.location.hostname + ":" + "1234"}`,
-  //   'ws',
-  //   ydoc,
-  //   {
-  //     connect: true,
-  //     //params: { session: sessionId, username: username },
-  //     // Provide a WebSocket wrapper to capture and log incoming messages that might be malformed
-  //     WebSocketPolyfill: function(url, protocols) {
-  //       const inner = new window.WebSocket(url, protocols);
-  //       inner.binaryType = 'arraybuffer';
-  //       const wrapper = {};
-  //       // proxy readyState
-  //       Object.defineProperty(wrapper, 'readyState', { get: () => inner.readyState });
-  //       // proxy send/close/addEventListener/removeEventListener
-  //       wrapper.send = function(data) {
-  //         try {
-  //           if (data instanceof ArrayBuffer || ArrayBuffer.isView(data)) {
-  //             const len = data.byteLength !== undefined ? data.byteLength : data.length;
-  //             console.debug('[Yjs WS] outgoing binary length:', len);
-  //           } else {
-  //             console.debug('[Yjs WS] outgoing non-binary send, type:', typeof data, data);
-  //           }
-  //         } catch (e) {
-  //           console.warn('[Yjs WS] error inspecting outgoing data', e);
-  //         }
-  //         return inner.send(data);
-  //       };
-  //       wrapper.close = function(code, reason) { return inner.close(code, reason); };
-  //       wrapper.addEventListener = function() { return inner.addEventListener.apply(inner, arguments); };
-  //       wrapper.removeEventListener = function() { return inner.removeEventListener.apply(inner, arguments); };
-  //       // forward onopen/onclose/onerror directly
-  //       Object.defineProperty(wrapper, 'onopen', { set(fn) { inner.onopen = fn; }, get() { return inner.onopen; } });
-  //       Object.defineProperty(wrapper, 'onclose', { set(fn) { inner.onclose = fn; }, get() { return inner.onclose; } });
-  //       Object.defineProperty(wrapper, 'onerror', { set(fn) { inner.onerror = fn; }, get() { return inner.onerror; } });
-  //       // intercept onmessage assignment so we can wrap the handler with try/catch and logging
-  //       Object.defineProperty(wrapper, 'onmessage', {
-  //         set(fn) {
-  //           inner.onmessage = function(event) {
-  //             try {
-  //               // Log message type/length for debugging malformed frames
-  //               try {
-  //                 if (event && event.data) {
-  //                   if (event.data instanceof ArrayBuffer || ArrayBuffer.isView(event.data)) {
-  //                     const len = event.data.byteLength !== undefined ? event.data.byteLength : event.data.length;
-  //                     console.debug('[Yjs WS] incoming binary length:', len);
-  //                   } else {
-  //                     console.debug('[Yjs WS] incoming non-binary message, type:', typeof event.data, event.data);
-  //                   }
-  //                 }
-  //               } catch (e) {
-  //                 console.warn('[Yjs WS] error inspecting event.data', e);
-  //               }
-  //               fn && fn(event);
-  //             } catch (err) {
-  //               console.error('[Yjs WS] handler error (caught):', err, event && event.data);
-  //               // swallow to avoid uncaught errors crashing message handling
-  //             }
-  //           };
-  //         },
-  //         get() { return inner.onmessage; }
-  //       });
-  //       return wrapper;
-  //     },
-  //     //awareness: false,  // Disable awareness to avoid compatibility issues
-  //     resyncInterval: 5000
-  //   }
-  // );
-  const provider = new WebsocketProvider(`${window.location.protocol === 'https:' ? 'wss:' : 'ws:'}//${window.location.hostname + ":" + "1234"}`, sessionId.toString(), ydoc)
-  const dbprovider = new IndexeddbPersistence(sessionId.toString(), ydoc)
-  dbprovider.on('synced', () => {
-    console.log('content from the database is loaded')
-  })
-  // Set initial content if this is first user
-  if (ytext.length === 0 && initialContent) {
-    //ytext.insert(0, initialContent);
-  }
+  // We use roomname = "ws" so the final URL becomes "/ws?session=...&file=..." which the Go handler expects.
+  // The jwt cookie goes along with the handshake, so the server knows who we are.
+  // Every file would share the "ws" broadcast channel between tabs, so it is disabled.
+  const provider = new WebsocketProvider(
+    `${window.location.protocol === 'https:' ? 'wss:' : 'ws:'}//${window.location.host}`,
+    'ws',
+    ydoc,
+    { params: { session: sessionId.toString(), file: fileId.toString() }, disableBc: true }
+  );
+  // The server keeps the authoritative document and sends it on connect,
+  // so there is no local copy and no need to insert initialContent here.
 
   // Initialize CodeMirror
-  const mode = MODE_MAP[language] || 'javascript';
+  const mode = modeFor(filePath, language);
   if (!CodeMirror || typeof CodeMirror.fromTextArea !== 'function') {
     console.error('[Yjs] CodeMirror not available. window.CodeMirror =', typeof window !== 'undefined' ? window.CodeMirror : undefined);
     throw new Error('CodeMirror not available — ensure the CodeMirror script is included before the app bundle');
@@ -194,7 +157,6 @@ export function initializeYjsEditor(sessionId, username, language, initialConten
       if (event.status === 'connected') {
         statusEl.textContent = '✓ Connected';
         statusEl.style.color = '#4CAF50';
-        console.log('[Yjs] Connected for session:', sessionId);
       } else {
         statusEl.textContent = '⟳ Connecting...';
         statusEl.style.color = '#FF9800';
@@ -224,4 +186,5 @@ export function cleanupYjs(provider) {
 if (typeof window !== 'undefined') {
   window.initializeYjsEditor = initializeYjsEditor;
   window.cleanupYjs = cleanupYjs;
+  window.connectLanguageServer = connectLanguageServer;
 }
@@ -0,0 +1,293 @@
+/**
+ * Language server client for the editor: completion, hover, go-to-definition
+ * and diagnostics. The Go server runs the session's language server and
+ * proxies its JSON-RPC messages over the /lsp-ws WebSocket, one message per
+ * WebSocket message. Everyone in the session shares the server, and the
+ * document it checks is the shared buffer.
+ */
+
+import CodeMirrorLib from 'codemirror';
+import 'codemirror/addon/hint/show-hint.js';
+import showHintCSS from 'codemirror/addon/hint/show-hint.css';
+
+const CodeMirror = (typeof window !== 'undefined' && window.CodeMirror) ? window.CodeMirror : CodeMirrorLib;
+
+// LSP language id by file extension
+const LANGUAGE_IDS = {
+  'py': 'python',
+  'go': 'go',
+  'js': 'javascript',
+  'mjs': 'javascript',
+  'jsx': 'javascriptreact',
+  'ts': 'typescript',
+  'tsx': 'typescriptreact'
+};
+
+// Editor classes of the LSP severities: error, warning, information, hint
+const SEVERITY_CLASSES = { 1: 'error', 2: 'warning', 3: 'note', 4: 'note' };
+
+// How long typing pauses before the server gets the new text, and the
+// pointer rests before hover asks about what is under it
+const CHANGE_DELAY_MS = 300;
+const HOVER_DELAY_MS = 500;
+
+let styleAdded = false;
+function addHintStyle() {
+  if (styleAdded) return;
+  const style = document.createElement('style');
+  style.textContent = showHintCSS;
+  document.head.appendChild(style);
+  styleAdded = true;
+}
+
+function toPos(p) {
+  return CodeMirror.Pos(p.line, p.character);
+}
+
+function fromPos(p) {
+  return { line: p.line, character: p.ch };
+}
+
+// The text of hover contents: MarkupContent, a MarkedString or a list of them
+function hoverText(contents) {
+  if (!contents) return '';
+  if (Array.isArray(contents)) return contents.map(hoverText).filter(Boolean).join('\n\n');
+  if (typeof contents === 'string') return contents;
+  return contents.value || '';
+}
+
+/**
+ * Connect the editor to the session's language server
+ * @param {CodeMirror.Editor} editor - The editor of the file
+ * @param {string} sessionId - The session ID
+ * @param {string} filePath - Path of the file in the project
+ * @param {Object<string, string>} fileLinks - Editor URLs of the project's files by path, for go-to-definition
+ */
+export function connectLanguageServer(editor, sessionId, filePath, fileLinks) {
+  addHintStyle();
+  const dot = filePath.lastIndexOf('.');
+  const languageId = LANGUAGE_IDS[dot >= 0 ? filePath.slice(dot + 1).toLowerCase() : ''] || 'plaintext';
+
+  let socket = null;
+  let nextId = 0;
+  let pending = new Map();
+  let root = null;
+  let uri = null;
+  let version = 0;
+  let changeTimer = null;
+  let changed = false;
+  let marks = [];
+
+  const send = (m) => {
+    if (socket && socket.readyState === WebSocket.OPEN) socket.send(JSON.stringify(Object.assign({ jsonrpc: '2.0' }, m)));
+  };
+  const notify = (method, params) => send({ method: method, params: params });
+  const request = (method, params) => new Promise((resolve, reject) => {
+    if (!socket || socket.readyState !== WebSocket.OPEN) return reject(new Error('not connected'));
+    const id = ++nextId;
+    pending.set(id, { resolve: resolve, reject: reject });
+    send({ id: id, method: method, params: params });
+  });
+
+  const clearMarks = () => {
+    marks.forEach((mark) => mark.clear());
+    marks = [];
+  };
+  const markDiagnostics = (diagnostics) => {
+    clearMarks();
+    diagnostics.forEach((d) => {
+      let from = toPos(d.range.start);
+      let to = toPos(d.range.end);
+      if (from.line >= editor.lineCount()) return;
+      if (CodeMirror.cmpPos(from, to) >= 0) {
+        // Empty ranges mark the rest of the line
+        to = CodeMirror.Pos(from.line, editor.getLine(from.line).length);
+        if (to.ch <= from.ch) from = CodeMirror.Pos(from.line, 0);
+      }
+      const severity = SEVERITY_CLASSES[d.severity] || 'error';
+      marks.push(editor.markText(from, to, {
+        className: 'cm-diagnostic-' + severity,
+        title: severity + ': ' + d.message + (d.source ? ' (' + d.source + ')' : ''),
+      }));
+    });
+  };
+
+  // The server gets the whole shared buffer after every pause in typing, by
+  // anyone, so it never sees the edits of two people out of order
+  const flushChanges = () => {
+    clearTimeout(changeTimer);
+    if (!changed || uri === null) return;
+    changed = false;
+    notify('textDocument/didChange', {
+      textDocument: { uri: uri, version: ++version },
+      contentChanges: [{ text: editor.getValue() }],
+    });
+  };
+  editor.on('changes', () => {
+    changed = true;
+    clearTimeout(changeTimer);
+    changeTimer = setTimeout(flushChanges, CHANGE_DELAY_MS);
+  });
+
+  const connect = () => {
+    const proto = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+    socket = new WebSocket(proto + '//' + window.location.host + '/lsp-ws?session_id=' + sessionId);
+    socket.onopen = async () => {
+      try {
+        const result = await request('initialize', { processId: null, rootUri: null, capabilities: {} });
+        root = result.rootUri;
+        uri = root + '/' + filePath.split('/').map(encodeURIComponent).join('/');
+        notify('initialized', {});
+        changed = false;
+        notify('textDocument/didOpen', {
+          textDocument: { uri: uri, languageId: languageId, version: ++version, text: editor.getValue() },
+        });
+      } catch (e) {
+        console.warn('[LSP] initialize failed:', e);
+      }
+    };
+    socket.onmessage = (event) => {
+      const m = JSON.parse(event.data);
+      if (m.method === undefined && m.id !== undefined) {
+        const p = pending.get(m.id);
+        if (!p) return;
+        pending.delete(m.id);
+        if (m.error) p.reject(m.error);
+        else p.resolve(m.result);
+      } else if (m.method === 'textDocument/publishDiagnostics' && m.params.uri === uri) {
+        markDiagnostics(m.params.diagnostics || []);
+      }
+    };
+    socket.onclose = () => {
+      pending.forEach((p) => p.reject(new Error('disconnected')));
+      pending = new Map();
+      uri = null;
+      clearMarks();
+      setTimeout(connect, 5000);
+    };
+  };
+  connect();
+
+  // Completion: Ctrl-Space, or typing a dot
+  const hint = (cm, callback) => {
+    flushChanges();
+    const cur = cm.getCursor();
+    const line = cm.getLine(cur.line);
+    let start = cur.ch;
+    while (start > 0 && /[\w$]/.test(line[start - 1])) start--;
+    const prefix = line.slice(start, cur.ch).toLowerCase();
+    request('textDocument/completion', { textDocument: { uri: uri }, position: fromPos(cur) }).then((result) => {
+      const items = Array.isArray(result) ? result : (result && result.items) || [];
+      const list = items
+        .filter((item) => (item.filterText || item.label).toLowerCase().startsWith(prefix))
+        .sort((a, b) => (a.sortText || a.label).localeCompare(b.sortText || b.label))
+        .slice(0, 100)
+        .map((item) => {
+          const edit = item.textEdit;
+          const range = edit && (edit.range || edit.insert);
+          const completion = {
+            text: edit ? edit.newText : (item.insertText || item.label),
+            displayText: item.label + (item.detail ? '  ' + item.detail : ''),
+          };
+          if (range && range.start.line === cur.line) {
+            completion.from = toPos(range.start);
+            completion.to = cur;
+          }
+          return completion;
+        });
+      callback(list.length ? { list: list, from: CodeMirror.Pos(cur.line, start), to: cur } : null);
+    }, () => callback(null));
+  };
+  hint.async = true;
+  const showHint = (cm) => cm.showHint({ hint: hint, completeSingle: false });
+  editor.addKeyMap({ 'Ctrl-Space': showHint, 'F12': (cm) => goToDefinition(cm.getCursor()) });
+  editor.on('inputRead', (cm, change) => {
+    if (uri !== null && change.text.join('') === '.') showHint(cm);
+  });
+
+  // Go to definition: F12, or Ctrl/Cmd-click. Other files of the project open
+  // in the editor at the definition's line.
+  const goToDefinition = async (pos) => {
+    if (uri === null) return;
+    flushChanges();
+    let result;
+    try {
+      result = await request('textDocument/definition', { textDocument: { uri: uri }, position: fromPos(pos) });
+    } catch (e) {
+      return;
+    }
+    const target = Array.isArray(result) ? result[0] : result;
+    if (!target) return;
+    const targetUri = target.targetUri || target.uri;
+    const range = target.targetSelectionRange || target.range;
+    if (targetUri === uri) {
+      editor.setCursor(toPos(range.start));
+      editor.scrollIntoView(null, 100);
+      editor.focus();
+      return;
+    }
+    if (!targetUri.startsWith(root + '/')) return;
+    const path = targetUri.slice(root.length + 1).split('/').map(decodeURIComponent).join('/');
+    if (fileLinks[path]) {
+      window.location.href = fileLinks[path] + '#L' + (range.start.line + 1) + ':' + (range.start.character + 1);
+    }
+  };
+  editor.getWrapperElement().addEventListener('mousedown', (e) => {
+    if (!(e.ctrlKey || e.metaKey)) return;
+    e.preventDefault();
+    goToDefinition(editor.coordsChar({ left: e.clientX, top: e.clientY }, 'window'));
+  });
+  const jump = /^#L(\d+)(?::(\d+))?$/.exec(window.location.hash);
+  if (jump) {
+    const pos = CodeMirror.Pos(Number(jump[1]) - 1, Number(jump[2] || 1) - 1);
+    // The shared document arrives after the editor is created
+    const go = () => {
+      if (editor.lineCount() <= pos.line) return false;
+      editor.setCursor(pos);
+      editor.scrollIntoView(null, 100);
+      return true;
+    };
+    if (!go()) {
+      const onChange = () => {
+        if (go()) editor.off('changes', onChange);
+      };
+      editor.on('changes', onChange);
+    }
+  }
+
+  // Hover: what the server says about the word under the pointer
+  const tooltip = document.createElement('div');
+  tooltip.className = 'lsp-hover';
+  tooltip.style.display = 'none';
+  document.body.appendChild(tooltip);
+  let hoverTimer = null;
+  let hoverSeq = 0;
+  const hideHover = () => {
+    clearTimeout(hoverTimer);
+    hoverSeq++;
+    tooltip.style.display = 'none';
+  };
+  editor.getWrapperElement().addEventListener('mousemove', (e) => {
+    hideHover();
+    if (uri === null) return;
+    const seq = hoverSeq;
+    hoverTimer = setTimeout(async () => {
+      const pos = editor.coordsChar({ left: e.clientX, top: e.clientY }, 'window');
+      flushChanges();
+      let result;
+      try {
+        result = await request('textDocument/hover', { textDocument: { uri: uri }, position: fromPos(pos) });
+      } catch (err) {
+        return;
+      }
+      const text = result && hoverText(result.contents).trim();
+      if (!text || seq !== hoverSeq) return;
+      tooltip.textContent = text;
+      tooltip.style.left = (e.pageX + 12) + 'px';
+      tooltip.style.top = (e.pageY + 12) + 'px';
+      tooltip.style.display = 'block';
+    }, HOVER_DELAY_MS);
+  });
+  editor.getWrapperElement().addEventListener('mouseleave', hideHover);
+  editor.on('keydown', hideHover);
+}
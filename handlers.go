@@ -1,28 +1,32 @@
 package main
 
 import (
-	"bytes"
-	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type PageData struct {
-	Username string
-	Sessions map[string]Session
-	Template string
-	Warning  string
+	Username    string
+	Sessions    map[string]Session // personal and shared with the user
+	Orgs        []OrgSessions      // organizations of the user with their sessions
+	Invitations []Invitation       // pending, for the dashboard inbox
+	Template    string
+	Warning     string
+	Next        string    // where to go after logging in
+	Join        *JoinPage // the share link to confirm joining with
 }
 
 type Session struct {
@@ -31,6 +35,17 @@ type Session struct {
 	Language    string
 	ProjectName string
 	Content     string
+	Role        string // of the user looking at it
+	Org         string // owning the session instead of Owner, who created it
+	// Whether the user has access as a member of Org
+	OrgMember bool
+}
+
+// OrgSessions groups the sessions of an organization on the dashboard
+type OrgSessions struct {
+	Org      Org
+	Members  []OrgMember
+	Sessions map[string]Session
 }
 
 // Add this new struct for API responses
@@ -52,6 +67,20 @@ type InterpretResponse struct {
 	Success bool   `json:"success"`
 	Output  string `json:"output,omitempty"`
 	Error   string `json:"error,omitempty"`
+	RunID   int    `json:"run_id,omitempty"`
+	// The limit that ended the run, if any: timeout, memory or output
+	LimitHit string `json:"limit_hit,omitempty"`
+	// Where the compiler or runtime errors of a failed run point
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// jwtSecret is the key that signs login tokens and share links
+func jwtSecret() []byte {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		secret = "dev_secret" // fallback for dev
+	}
+	return []byte(secret)
 }
 
 func authFromJwt(r *http.Request) (string, error) {
@@ -59,12 +88,8 @@ func authFromJwt(r *http.Request) (string, error) {
 	if err != nil {
 		return "", errors.New("cookie not found")
 	}
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "dev_secret"
-	}
 	token, err := jwt.Parse(jwtCookie.Value, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
+		return jwtSecret(), nil
 	})
 	if err != nil || !token.Valid {
 		return "", errors.New("invalid token")
@@ -76,44 +101,147 @@ func authFromJwt(r *http.Request) (string, error) {
 	return claims["username"].(string), nil
 }
 
+// isAdmin tells whether username is one of the comma separated ADMIN_USERS
+func isAdmin(username string) bool {
+	for _, admin := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if strings.TrimSpace(admin) == username && username != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errAccessDenied    = errors.New("access denied")
+)
+
+// checkSessionAccess verifies that username is the owner or a collaborator of the session
+func checkSessionAccess(sessionID int, username string) error {
+	_, err := sessionRole(sessionID, username)
+	return err
+}
+
+// sessionAccess authenticates an API request and checks that the user may open
+// the session given by sessionID. On failure it writes the error response and
+// returns ok == false.
+func sessionAccess(w http.ResponseWriter, r *http.Request, sessionID string) (username string, sid int, ok bool) {
+	return sessionRoleAccess(w, r, sessionID, roleViewer)
+}
+
+// sessionRoleAccess is sessionAccess for actions that need at least the role
+// min in the session
+func sessionRoleAccess(w http.ResponseWriter, r *http.Request, sessionID string, min string) (username string, sid int, ok bool) {
+	username, err := authFromJwt(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", 0, false
+	}
+	if sessionID == "" {
+		http.Error(w, "Session ID required", http.StatusBadRequest)
+		return "", 0, false
+	}
+	sid, err = strconv.Atoi(sessionID)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return "", 0, false
+	}
+	if err := checkSessionRole(sid, username, min); err != nil {
+		writeAccessError(w, err)
+		return "", 0, false
+	}
+	return username, sid, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
 func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 	username, err := authFromJwt(r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
-	// Get sessions from db (join users for username)
-	rows, err := db.Query(`SELECT 
+	// Get the sessions the user owns, collaborates on or whose organization
+	// they belong to (join users for username)
+	rows, err := db.Query(`SELECT
 								s.session_id,
 								u.username AS owner_username,
 								s.language,
-								s.project_name
+								s.project_name,
+								COALESCE(o.name, ''),
+								COALESCE(s.org_id, 0)
 							FROM sessions s
 							JOIN users u ON s.owner_id = u.user_id
-							WHERE u.username = ?
-							OR s.session_id IN (
-									SELECT c.session_id
-									FROM collabs c
-									JOIN users cu ON c.user_id = cu.user_id
-									WHERE cu.username = ?);`, username, username)
+							LEFT JOIN orgs o ON s.org_id = o.org_id
+							WHERE (s.org_id IS NULL AND u.username = ?)
+							OR s.session_id IN (SELECT c.session_id FROM collabs c
+								JOIN users cu ON c.user_id = cu.user_id WHERE cu.username = ?)
+							OR s.org_id IN (SELECT m.org_id FROM org_members m
+								JOIN users mu ON m.user_id = mu.user_id WHERE mu.username = ?);`, username, username, username)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	var sessions []Session
+	var sessionOrgs []int
+	for rows.Next() {
+		var sess Session
+		var orgID int
+		if err := rows.Scan(&sess.SessionID, &sess.Owner, &sess.Language, &sess.ProjectName, &sess.Org, &orgID); err == nil {
+			sessions = append(sessions, sess)
+			sessionOrgs = append(sessionOrgs, orgID)
+		}
+	}
+	rows.Close()
 
-	defer rows.Close()
+	orgs, err := userOrgs(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	groups := make([]OrgSessions, len(orgs))
+	groupOf := make(map[int]*OrgSessions)
+	for i, o := range orgs {
+		groups[i] = OrgSessions{Org: o, Sessions: make(map[string]Session)}
+		if groups[i].Members, err = orgMembers(o.OrgID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		groupOf[o.OrgID] = &groups[i]
+	}
+	// Sessions of the user's organizations are listed under them, the rest,
+	// including sessions of other organizations they collaborate on, together
 	sessionObjs := make(map[string]Session)
-	for rows.Next() {
-		var sid int
-		var uname, lang, proj string
-		if err := rows.Scan(&sid, &uname, &lang, &proj); err == nil {
-			sessionObjs[strconv.Itoa(sid)] = Session{SessionID: sid, Owner: uname, Language: lang, ProjectName: proj}
+	for i, sess := range sessions {
+		// Members of an organization that gives no default role only see
+		// the sessions they collaborate on
+		if sess.Role, err = sessionRole(sess.SessionID, username); errors.Is(err, errAccessDenied) {
+			continue
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if group := groupOf[sessionOrgs[i]]; group != nil {
+			sess.OrgMember = true
+			group.Sessions[strconv.Itoa(sess.SessionID)] = sess
+		} else {
+			sessionObjs[strconv.Itoa(sess.SessionID)] = sess
 		}
 	}
+	invites, err := receivedInvitations(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	data := PageData{
-		Username: username,
-		Sessions: sessionObjs,
-		Template: "dashboard",
+		Username:    username,
+		Sessions:    sessionObjs,
+		Orgs:        groups,
+		Invitations: invites,
+		Template:    "dashboard",
 	}
 
 	err = templates.ExecuteTemplate(w, "base.html", data)
@@ -197,11 +325,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 					"username": username,
 					"exp":      time.Now().Add(24 * time.Hour).Unix(),
 				})
-				secret := os.Getenv("JWT_SECRET")
-				if secret == "" {
-					secret = "dev_secret" // fallback for dev
-				}
-				tokenString, err := token.SignedString([]byte(secret))
+				tokenString, err := token.SignedString(jwtSecret())
 				if err != nil {
 					http.Error(w, "Error generating token", http.StatusInternalServerError)
 					return
@@ -213,13 +337,15 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 					Path:     "/",
 					HttpOnly: true,
 					MaxAge:   86400,
+					// Not sent with forms posted from other sites
+					SameSite: http.SameSiteLaxMode,
 				})
-				http.Redirect(w, r, "/", http.StatusSeeOther)
+				http.Redirect(w, r, localRedirect(r.FormValue("next")), http.StatusSeeOther)
 			}
 		}
 	}
 
-	data := PageData{Template: "login", Warning: warning}
+	data := PageData{Template: "login", Warning: warning, Next: localRedirect(r.FormValue("next"))}
 	err := templates.ExecuteTemplate(w, "base.html", data)
 
 	if err != nil {
@@ -228,6 +354,21 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// localRedirect returns next if it is a page someone opened before logging
+// in, a share link or a session in the editor, and the dashboard otherwise.
+// Browsers skip tabs and read backslashes as slashes, so next may hold neither.
+func localRedirect(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.ContainsRune(next, '\\') ||
+		strings.IndexFunc(next, unicode.IsControl) >= 0 {
+		return "/"
+	}
+	if !strings.HasPrefix(next, "/join?token=") && !strings.HasPrefix(next, "/editor?") {
+		return "/"
+	}
+	return next
+}
+
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	// Delete JWT cookie
 	http.SetCookie(w, &http.Cookie{
@@ -266,8 +407,44 @@ func createSessionHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "User not found", http.StatusInternalServerError)
 		return
 	}
+	// Members may create sessions owned by their organization
+	var orgID any
+	if v := r.FormValue("org_id"); v != "" {
+		_, oid, _, ok := orgAccess(w, r, v, orgRoleMember)
+		if !ok {
+			return
+		}
+		orgID = oid
+	}
 	// Insert session into DB
-	_, err = db.Exec("INSERT INTO sessions(owner_id, language, project_name, content) VALUES (?, ?, ?, ?)", userID, language, projectName, "// Start coding here...")
+	res, err := db.Exec("INSERT INTO sessions(owner_id, language, project_name, org_id) VALUES (?, ?, ?, ?)", userID, language, projectName, orgID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessionID, err := res.LastInsertId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Whoever creates a session of an organization maintains it, unless
+	// they own it as an admin anyway
+	if orgID != nil {
+		if err := checkSessionRole(int(sessionID), username, roleMaintainer); err != nil {
+			_, err = db.Exec("INSERT OR REPLACE INTO collabs(session_id, user_id, role) VALUES (?, ?, ?)", sessionID, userID, roleMaintainer)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	// Every session starts with one file, which is also what gets run
+	fileID, err := createFile(int(sessionID), defaultFileName(language), "// Start coding here...")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("UPDATE sessions SET entry_file_id = ? WHERE session_id = ?", fileID, sessionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -275,37 +452,32 @@ func createSessionHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func saveSessionContent(sessionIDInt int, content string, username string) error {
-	// Verify user has access to this session (owner OR collaborator)
-	var owner string
-	var ownerID int
-	err := db.QueryRow(`SELECT u.username, s.owner_id FROM sessions s 
-		JOIN users u ON s.owner_id = u.user_id 
-		WHERE s.session_id = ?`, sessionIDInt).Scan(&owner, &ownerID)
+// saveSessionContent stores content as the text of a file of the session, or
+// of its entrypoint if fileID is 0.
+func saveSessionContent(sessionIDInt int, fileID int, content string, username string) error {
+	// Verify user may edit this session (owner or an editor)
+	if err := checkSessionRole(sessionIDInt, username, roleEditor); err != nil {
+		return err
+	}
+
+	file, err := getSessionFile(sessionIDInt, fileID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return errors.New("session not found")
+		return errFileNotFound
 	} else if err != nil {
 		return err
 	}
 
-	// Check if user is owner
-	if owner != username {
-		// If not owner, check if user is collaborator
-		var collaboratorCount int
-		err = db.QueryRow(`SELECT COUNT(*) FROM collabs c 
-			JOIN users u ON c.user_id = u.user_id 
-			WHERE c.session_id = ? AND u.username = ?`, sessionIDInt, username).Scan(&collaboratorCount)
-		if err != nil {
-			return err
-		}
-		if collaboratorCount == 0 {
-			return errors.New("access denied")
-		}
+	// Apply the content to the shared document as a regular edit, so editors
+	// that have the file open receive it and the stored state stays in sync
+	if err = setFileText(file.FileID, content, username); err != nil {
+		return err
 	}
-
-	// Update session content in database
-	_, err = db.Exec("UPDATE sessions SET content = ? WHERE session_id = ?", content, sessionIDInt)
-	return err
+	// Every explicit save is kept in the version history
+	if err := recordVersion(sessionIDInt, file.FileID, username, content, "", 0); err != nil {
+		return err
+	}
+	lintOnSave(sessionIDInt, username)
+	return nil
 }
 
 // Add this new handler for saving session content
@@ -336,10 +508,22 @@ func saveSessionHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid session ID", http.StatusBadRequest)
 		return
 	}
+	// The entrypoint is saved when no file is given
+	var fileID int
+	if v := r.FormValue("file_id"); v != "" {
+		if fileID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid file_id", http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Сохраняем контент
-	err = saveSessionContent(sessionIDInt, content, username)
-	if err != nil {
+	err = saveSessionContent(sessionIDInt, fileID, content, username)
+	var required roleRequired
+	if errors.Is(err, errSessionNotFound) || errors.Is(err, errAccessDenied) || errors.As(err, &required) {
+		writeAccessError(w, err)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -349,7 +533,10 @@ func saveSessionHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(SaveResponse{Success: true})
 }
 
-// interpretHandler runs Python code inside a docker container and returns output
+// interpretHandler runs a project inside the docker container of its language
+// runner and returns output. The whole file tree of the session is mounted
+// read-only and the entrypoint of the session (or the file given as
+// "entrypoint") is built and run.
 func interpretHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -363,9 +550,9 @@ func interpretHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var payload struct {
-		SessionID string `json:"session_id"`
-		Content   string `json:"content"`
-		Stdin     string `json:"stdin,omitempty"`
+		SessionID  string `json:"session_id"`
+		Entrypoint string `json:"entrypoint,omitempty"`
+		Stdin      string `json:"stdin,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "Invalid payload", http.StatusBadRequest)
@@ -381,87 +568,83 @@ func interpretHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify session exists and user has access
-	var ownerUsername, language string
-	var ownerID int
-	err = db.QueryRow(`SELECT u.username, s.language, s.owner_id FROM sessions s JOIN users u ON s.owner_id = u.user_id WHERE s.session_id = ?`, sid).Scan(&ownerUsername, &language, &ownerID)
-	if errors.Is(err, sql.ErrNoRows) {
-		http.Error(w, "Session not found", http.StatusNotFound)
+	// Verify session exists and user may run it
+	if err := checkSessionRole(sid, username, roleEditor); err != nil {
+		writeAccessError(w, err)
+		return
+	}
+
+	spec, err := prepareRun(sid, payload.Entrypoint)
+	var setupErr runSetupError
+	var notReady runnerNotReady
+	if errors.As(err, &setupErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.As(err, &notReady) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	} else if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(InterpretResponse{Success: false, Error: err.Error()})
 		return
 	}
+	defer spec.cleanup()
 
-	// access check
-	if ownerUsername != username {
-		var collabCount int
-		err = db.QueryRow(`SELECT COUNT(*) FROM collabs c JOIN users u ON c.user_id = u.user_id WHERE c.session_id = ? AND u.username = ?`, sid, username).Scan(&collabCount)
-		if err != nil {
-			http.Error(w, "DB error", http.StatusInternalServerError)
-			return
-		}
-		if collabCount == 0 {
-			http.Error(w, "Access denied", http.StatusForbidden)
-			return
-		}
+	// Wait for a worker, showing the place in the queue in the session's console
+	release, err := queue.acquire(r.Context(), username, sid, func(pos int) {
+		publishRun(sid, RunMessage{Type: "queued", Entrypoint: spec.entry.Path, Author: username, Position: pos})
+	})
+	if errors.Is(err, errQueueFull) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, errTooManyQueued) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		// The client went away while the run was queued
+		return
 	}
+	defer release()
 
-	if strings.ToLower(language) != "python" {
-		http.Error(w, "Interpretation is only supported for python sessions", http.StatusBadRequest)
+	// Run the code within the session's limits, with the user-supplied program input (if any)
+	res, err := spec.runBatch(payload.Stdin, spec.limits.timeout())
+	if err != nil {
+		writeJSON(w, InterpretResponse{Success: false, Error: err.Error()})
 		return
 	}
-
-	// Ensure docker image exists, otherwise try to build it
-	img := "cocode-python-runner:latest"
-	if err := exec.Command("docker", "inspect", "--type=image", img).Run(); err != nil {
-		// try to build
-		buildCmd := exec.Command("docker", "build", "-t", img, "docker/python-runner")
-		var b bytes.Buffer
-		buildCmd.Stdout = &b
-		buildCmd.Stderr = &b
-		if err := buildCmd.Run(); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(InterpretResponse{Success: false, Error: "Failed to build python runner image: " + b.String()})
-			return
-		}
+	out := res.combined
+	rec := res.record(spec, username)
+	if err := recordRun(sid, &rec); err != nil {
+		log.Printf("interpret: storing run of session %d: %v", sid, err)
 	}
 
-	// Run the code inside docker with timeout and limited resources
-	// Use a shell heredoc to create the script inside the container so stdin can be reserved for the program input
-	// Build a shell command that writes the script from a quoted heredoc and then runs it
-	safeCmd := "cat > /home/runner/script.py <<'PY'\n" + payload.Content + "\nPY\npython -u /home/runner/script.py"
+	// Collaborators with the session open see the run in their console
+	publishRun(sid,
+		RunMessage{Type: "started", Entrypoint: rec.Entrypoint, Author: username, StartedAt: rec.StartedAt},
+		RunMessage{Type: "stdout", Data: out},
+		RunMessage{Type: "exit", Author: username, StartedAt: rec.StartedAt, ExitCode: rec.ExitCode,
+			TimedOut: rec.TimedOut, OOMKilled: rec.OOMKilled, LimitHit: rec.LimitHit, RunID: rec.RunID})
 
-	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, "docker", "run", "--rm", "-i", "--network", "none", "--memory", "256m", "--cpus", "0.5", img, "sh", "-lc", safeCmd)
-	// Provide user-supplied program input on stdin (if any)
-	if payload.Stdin != "" {
-		cmd.Stdin = strings.NewReader(payload.Stdin)
-	}
-	out, err := cmd.CombinedOutput()
-	if ctx.Err() == context.DeadlineExceeded {
-		json.NewEncoder(w).Encode(InterpretResponse{Success: false, Error: "Execution timed out"})
+	if rec.LimitHit != "" {
+		json.NewEncoder(w).Encode(InterpretResponse{Success: false, Error: limitMessages[rec.LimitHit], Output: out,
+			RunID: rec.RunID, LimitHit: rec.LimitHit})
 		return
 	}
-	if err != nil {
+	if res.err != nil {
 		// include output
-		json.NewEncoder(w).Encode(InterpretResponse{Success: false, Error: err.Error(), Output: string(out)})
+		json.NewEncoder(w).Encode(InterpretResponse{Success: false, Error: res.err.Error(), Output: out, RunID: rec.RunID,
+			Diagnostics: spec.diagnostics(res.stderr)})
 		return
 	}
 
 	// Success
-	json.NewEncoder(w).Encode(InterpretResponse{Success: true, Output: string(out)})
+	json.NewEncoder(w).Encode(InterpretResponse{Success: true, Output: out, RunID: rec.RunID})
 }
 
 // Update the editorHandler to properly handle content
 func editorHandler(w http.ResponseWriter, r *http.Request) {
-	// Auth via JWT
-	username, err := authFromJwt(r)
-	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
+	// Auth via JWT. Visitors without an account may watch public sessions.
+	username, _ := authFromJwt(r)
 
 	sessionID := r.URL.Query().Get("session_id")
 	if sessionID == "" {
@@ -477,8 +660,10 @@ func editorHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get session from DB (join users for username)
-	var owner, lang, proj, content string
-	err = db.QueryRow(`SELECT u.username, s.language, s.project_name, s.content FROM sessions s JOIN users u ON s.owner_id = u.user_id WHERE s.session_id = ?`, sessionIDInt).Scan(&owner, &lang, &proj, &content)
+	var owner, lang, proj, org, content string
+	err = db.QueryRow(`SELECT u.username, s.language, s.project_name, COALESCE(o.name, '') FROM sessions s
+		JOIN users u ON s.owner_id = u.user_id LEFT JOIN orgs o ON s.org_id = o.org_id
+		WHERE s.session_id = ?`, sessionIDInt).Scan(&owner, &lang, &proj, &org)
 	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
@@ -487,33 +672,89 @@ func editorHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user has access (owner or collaborator)
-	if owner != username {
-		var collaboratorCount int
-		err = db.QueryRow(`SELECT COUNT(*) FROM collabs c 
-			JOIN users u ON c.user_id = u.user_id 
-			WHERE c.session_id = ? AND u.username = ?`, sessionIDInt, username).Scan(&collaboratorCount)
-		if err != nil {
-			http.Error(w, "DB error", http.StatusInternalServerError)
-			return
-		}
-		if collaboratorCount == 0 {
-			http.Error(w, "Access denied", http.StatusForbidden)
-			return
-		}
+	// Check if user has access (owner or collaborator), and in which role.
+	// Everyone else may only watch, and only public sessions.
+	role, err := sessionRole(sessionIDInt, username)
+	member := err == nil
+	if errors.Is(err, errAccessDenied) {
+		role, err = sessionViewerRole(sessionIDInt, username)
+	}
+	if errors.Is(err, errAccessDenied) && username == "" {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	public, err := sessionPublic(sessionIDInt)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// Open the requested file, or the entrypoint
+	file, ok := fileFromRequest(w, r, sessionIDInt)
+	if !ok {
+		return
+	}
+	files, err := sessionFiles(sessionIDInt)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	// Prefer the live document if someone is editing right now
+	content, err = fileText(file.FileID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
 	}
 
-	session := Session{Owner: owner, Language: lang, ProjectName: proj, Content: content}
+	orgMember, err := orgMemberOfSession(sessionIDInt, username)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	session := Session{Owner: owner, Language: lang, ProjectName: proj, Content: content, Role: role, Org: org, OrgMember: orgMember}
 	data := struct {
 		Username  string
 		SessionID string
 		Session   Session
-		Template  string
+		File      SessionFile
+		Files     []SessionFile
+		// Whether the user is part of the session rather than watching it
+		// because it is public
+		Member bool
+		Public bool
+		// Viewers get the editor read-only, maintainers may manage collaborators
+		CanEdit   bool
+		CanInvite bool
+		// Roles the user may give collaborators
+		GrantableRoles []string
+		Runnable       bool
+		UnitTests      bool
+		Format         bool
+		Lint           bool
+		// Completion, hover and diagnostics from the language server
+		LanguageServer bool
+		Template       string
 	}{
-		Username:  username,
-		SessionID: sessionID,
-		Session:   session,
-		Template:  "editor",
+		Username:       username,
+		SessionID:      sessionID,
+		Session:        session,
+		File:           file,
+		Files:          files,
+		Member:         member,
+		Public:         public,
+		CanEdit:        atLeast(role, roleEditor),
+		CanInvite:      atLeast(role, roleMaintainer),
+		GrantableRoles: grantableRoles(role),
+		Runnable:       runners[lang].Image != "",
+		UnitTests:      runners[lang].Test != "",
+		Format:         runners[lang].Format != "",
+		Lint:           len(runners[lang].Linters) > 0,
+		LanguageServer: runners[lang].LanguageServer != "" && member,
+		Template:       "editor",
 	}
 	err = templates.ExecuteTemplate(w, "base.html", data)
 	if err != nil {
@@ -534,23 +775,66 @@ func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	sessionID := r.URL.Query().Get("session_id")
-	var dbUserID int
-	err = db.QueryRow(`SELECT s.owner_id FROM sessions s WHERE s.session_id = ?`, sessionID).Scan(&dbUserID)
-	if errors.Is(err, sql.ErrNoRows) {
+	sid, _ := strconv.Atoi(sessionID)
+	// Only the owner, or an admin of the organization owning it, deletes a session
+	role, err := sessionRole(sid, username)
+	if errors.Is(err, errSessionNotFound) || errors.Is(err, errAccessDenied) || (err == nil && role != roleOwner) {
 		http.Error(w, "Session not found or access denied", http.StatusForbidden)
 		return
 	} else if err != nil {
 		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
-	// Get user_id for username
-	var userID int
-	err = db.QueryRow("SELECT user_id FROM users WHERE username = ?", username).Scan(&userID)
-	if err != nil || dbUserID != userID {
-		http.Error(w, "Session not found or access denied", http.StatusForbidden)
+	// Disconnect everyone editing its files
+	files, err := sessionFiles(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	for _, f := range files {
+		closeRoom(f.FileID)
+	}
+	// Delete session, its files, test cases, runs and their history from DB
+	_, err = db.Exec("DELETE FROM test_results WHERE run_id IN (SELECT run_id FROM runs WHERE session_id = ?)", sessionID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("DELETE FROM unit_test_results WHERE run_id IN (SELECT run_id FROM runs WHERE session_id = ?)", sessionID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("DELETE FROM test_cases WHERE session_id = ?", sessionID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("DELETE FROM runs WHERE session_id = ?", sessionID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("DELETE FROM session_versions WHERE session_id = ?", sessionID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("DELETE FROM invitations WHERE session_id = ?", sessionID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("DELETE FROM share_links WHERE session_id = ?", sessionID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("DELETE FROM session_files WHERE session_id = ?", sessionID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
-	// Delete session from DB
 	_, err = db.Exec("DELETE FROM sessions WHERE session_id = ?", sessionID)
 	if err != nil {
 		http.Error(w, "DB error", http.StatusInternalServerError)
@@ -559,13 +843,15 @@ func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// addCollabHandler invites a user to collaborate on the session. They get
+// access once they accept the invitation.
 func addCollabHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	// Auth via JWT
-	ownerUsername, err := authFromJwt(r)
+	username, err := authFromJwt(r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
@@ -583,25 +869,25 @@ func addCollabHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid session_id", http.StatusBadRequest)
 		return
 	}
-	// Verify owner: get user_id of session
-	var ownerUserID int
-	err = db.QueryRow("SELECT owner_id FROM sessions WHERE session_id = ?", sessionID).Scan(&ownerUserID)
-	if err == sql.ErrNoRows {
-		http.Error(w, "Session not found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
+	// The owner and maintainers may add collaborators, in the roles they may grant
+	actor, err := sessionRole(int(sessionID), username)
+	if err == nil && !atLeast(actor, roleMaintainer) {
+		err = roleRequired(roleMaintainer)
 	}
-	// get owner username to compare
-	var dbOwnerUsername string
-	err = db.QueryRow("SELECT username FROM users WHERE user_id = ?", ownerUserID).Scan(&dbOwnerUsername)
 	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
+		writeAccessError(w, err)
 		return
 	}
-	if dbOwnerUsername != ownerUsername {
-		http.Error(w, "Access denied", http.StatusForbidden)
+	role := r.FormValue("role")
+	if role == "" {
+		role = roleEditor
+	}
+	if _, known := roleRanks[role]; !known || role == roleOwner {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	if !canGrant(actor, role) {
+		http.Error(w, "Access denied: your role cannot grant "+role, http.StatusForbidden)
 		return
 	}
 	// find collaborator user_id
@@ -614,9 +900,13 @@ func addCollabHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
-	// insert into collabs (ignore duplicates)
-	_, err = db.Exec("INSERT OR IGNORE INTO collabs(session_id, user_id) VALUES (?, ?)", sessionID, collabUserID)
-	if err != nil {
+	// invite them, they join once they accept on their dashboard
+	err = createInvitation(int(sessionID), username, collabUsername, role)
+	var invalid invitationError
+	if errors.As(err, &invalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
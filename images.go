@@ -0,0 +1,204 @@
+package main
+
+import (
+	"cmp"
+	"log"
+	"net/http"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+)
+
+// States of a runner image
+const (
+	imageUnknown  = "unknown"
+	imageChecking = "checking"
+	imageBuilding = "building"
+	imageReady    = "ready"
+	imageFailed   = "failed"
+)
+
+// Build output kept for a failed or finished build
+const imageLogLimit = 64 << 10
+
+// ImageStatus is what the image manager knows about the image of a runner
+type ImageStatus struct {
+	Language  string `json:"language"`
+	Image     string `json:"image"`
+	State     string `json:"state"`
+	Error     string `json:"error,omitempty"` // of the last build, also if an older image is still ready
+	Log       string `json:"log,omitempty"`   // output of the last build
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+// imageManager checks and builds the runner images in the background, so
+// runs never wait for a build: until its image is ready a runner is not.
+type imageManager struct {
+	mu       sync.Mutex
+	status   map[string]*ImageStatus
+	updating bool
+	again    bool // another update was asked for while one was in progress
+	rebuild  bool // ... and it should rebuild images that exist
+}
+
+var images = &imageManager{status: map[string]*ImageStatus{}}
+
+// runnerNotReady is why a run could not start: the image of its runner is
+// still being checked or built, or failed to build.
+type runnerNotReady string
+
+func (e runnerNotReady) Error() string { return string(e) }
+
+// ready returns a runnerNotReady error unless the image of the language's runner is ready
+func (m *imageManager) ready(language string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.status[language]
+	switch {
+	case ok && st.State == imageReady:
+		return nil
+	case ok && st.State == imageFailed:
+		return runnerNotReady("The " + language + " runner is not ready: its image failed to build")
+	case ok && st.State == imageBuilding:
+		return runnerNotReady("The " + language + " runner is not ready yet: its image is being built")
+	}
+	return runnerNotReady("The " + language + " runner is not ready yet")
+}
+
+// list returns the status of every runner image ordered by language
+func (m *imageManager) list() []ImageStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []ImageStatus{}
+	for language, r := range runners {
+		if st, ok := m.status[language]; ok {
+			list = append(list, *st)
+		} else {
+			list = append(list, ImageStatus{Language: language, Image: r.Image, State: imageUnknown})
+		}
+	}
+	slices.SortFunc(list, func(a, b ImageStatus) int { return cmp.Compare(a.Language, b.Language) })
+	return list
+}
+
+func (m *imageManager) state(language string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st, ok := m.status[language]; ok {
+		return st.State
+	}
+	return imageUnknown
+}
+
+func (m *imageManager) set(language string, st ImageStatus) {
+	st.Language = language
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	m.mu.Lock()
+	m.status[language] = &st
+	m.mu.Unlock()
+}
+
+// update checks every runner image in the background and builds the missing
+// ones, or all of them if rebuild is set. An update asked for while one is in
+// progress runs after it.
+func (m *imageManager) update(rebuild bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.updating {
+		m.again = true
+		m.rebuild = m.rebuild || rebuild
+		return
+	}
+	m.updating = true
+	go m.run(rebuild)
+}
+
+func (m *imageManager) run(rebuild bool) {
+	for {
+		m.updateAll(rebuild)
+		m.mu.Lock()
+		if !m.again {
+			m.updating = false
+			m.mu.Unlock()
+			return
+		}
+		rebuild = m.rebuild
+		m.again, m.rebuild = false, false
+		m.mu.Unlock()
+	}
+}
+
+// updateAll checks all images first, which is quick, so runners whose image
+// exists are ready before the others are built one at a time. Images that are
+// ready stay usable while they are checked or rebuilt.
+func (m *imageManager) updateAll(rebuild bool) {
+	var missing []string
+	for language, r := range runners {
+		if rebuild {
+			missing = append(missing, language)
+			continue
+		}
+		if m.state(language) != imageReady {
+			m.set(language, ImageStatus{Image: r.Image, State: imageChecking})
+		}
+		if err := exec.Command("docker", "inspect", "--type=image", r.Image).Run(); err == nil {
+			m.set(language, ImageStatus{Image: r.Image, State: imageReady})
+			pool.fill(language)
+		} else {
+			missing = append(missing, language)
+		}
+	}
+	slices.Sort(missing)
+	for _, language := range missing {
+		r := runners[language]
+		if m.state(language) != imageReady {
+			m.set(language, ImageStatus{Image: r.Image, State: imageBuilding})
+		}
+		out, err := exec.Command("docker", "build", "-t", r.Image, r.Dir).CombinedOutput()
+		if len(out) > imageLogLimit {
+			out = out[len(out)-imageLogLimit:]
+		}
+		if err != nil {
+			log.Printf("images: building %s: %v", r.Image, err)
+			// A failed rebuild leaves the old image, which still works
+			state := imageFailed
+			if m.state(language) == imageReady {
+				state = imageReady
+			}
+			m.set(language, ImageStatus{Image: r.Image, State: state, Error: err.Error(), Log: string(out)})
+		} else {
+			m.set(language, ImageStatus{Image: r.Image, State: imageReady, Log: string(out)})
+			pool.refresh(language)
+		}
+	}
+}
+
+// runnerImagesHandler reports the state of every runner image
+func runnerImagesHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := authFromJwt(r); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, images.list())
+}
+
+// updateRunnerImagesHandler lets admins check the runner images again, or
+// rebuild all of them with rebuild=true, in the background
+func updateRunnerImagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := authFromJwt(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !isAdmin(username) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	images.update(r.FormValue("rebuild") == "true")
+	writeJSON(w, images.list())
+}
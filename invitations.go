@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// States of an invitation. Revoked invitations are deleted.
+const (
+	invitePending  = "pending"
+	inviteAccepted = "accepted"
+	inviteDeclined = "declined"
+	inviteExpired  = "expired"
+)
+
+// How long an invitation waits for an answer
+const invitationTTL = 7 * 24 * time.Hour
+
+// Invitation asks a user to join a session in a role
+type Invitation struct {
+	InviteID    int    `json:"invite_id"`
+	SessionID   int    `json:"session_id"`
+	ProjectName string `json:"project_name"`
+	Inviter     string `json:"inviter"`
+	Invitee     string `json:"invitee"`
+	Role        string `json:"role"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"created_at"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+// expireInvitations marks the pending invitations that were not answered in
+// time as expired
+func expireInvitations() error {
+	_, err := db.Exec("UPDATE invitations SET status = ? WHERE status = ? AND expires_at <= ?",
+		inviteExpired, invitePending, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// createInvitation invites username to the session in role. Users who have
+// access already or are invited already get a clear error.
+func createInvitation(sessionID int, inviter, username, role string) error {
+	if err := expireInvitations(); err != nil {
+		return err
+	}
+	if _, err := sessionRole(sessionID, username); err == nil {
+		return invitationError(username + " already has access to this session")
+	} else if !errors.Is(err, errAccessDenied) {
+		return err
+	}
+	var pending int
+	err := db.QueryRow(`SELECT COUNT(*) FROM invitations i JOIN users u ON i.user_id = u.user_id
+		WHERE i.session_id = ? AND u.username = ? AND i.status = ?`, sessionID, username, invitePending).Scan(&pending)
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return invitationError(username + " is invited already")
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec(`INSERT INTO invitations(session_id, user_id, inviter_id, role, status, created_at, expires_at)
+		VALUES (?, (SELECT user_id FROM users WHERE username = ?), (SELECT user_id FROM users WHERE username = ?), ?, ?, ?, ?)`,
+		sessionID, username, inviter, role, invitePending, now.Format(time.RFC3339), now.Add(invitationTTL).Format(time.RFC3339))
+	return err
+}
+
+// invitationError is a problem with an invitation to show to the user
+type invitationError string
+
+func (e invitationError) Error() string { return string(e) }
+
+const invitationColumns = `i.invite_id, i.session_id, s.project_name, COALESCE(iu.username, ''), u.username, i.role,
+	i.status, i.created_at, i.expires_at
+	FROM invitations i
+	JOIN sessions s ON i.session_id = s.session_id
+	JOIN users u ON i.user_id = u.user_id
+	LEFT JOIN users iu ON i.inviter_id = iu.user_id`
+
+func scanInvitations(rows *sql.Rows, err error) ([]Invitation, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invites := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		if err := rows.Scan(&inv.InviteID, &inv.SessionID, &inv.ProjectName, &inv.Inviter, &inv.Invitee, &inv.Role,
+			&inv.Status, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// receivedInvitations returns the pending invitations of username, newest first
+func receivedInvitations(username string) ([]Invitation, error) {
+	if err := expireInvitations(); err != nil {
+		return nil, err
+	}
+	return scanInvitations(db.Query(`SELECT `+invitationColumns+`
+		WHERE u.username = ? AND i.status = ? ORDER BY i.invite_id DESC`, username, invitePending))
+}
+
+// sessionInvitations returns the invitations sent for a session, newest first
+func sessionInvitations(sessionID int) ([]Invitation, error) {
+	if err := expireInvitations(); err != nil {
+		return nil, err
+	}
+	return scanInvitations(db.Query(`SELECT `+invitationColumns+`
+		WHERE i.session_id = ? ORDER BY i.invite_id DESC`, sessionID))
+}
+
+// invitationsHandler lists the pending invitations of the user
+func invitationsHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := authFromJwt(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	invites, err := receivedInvitations(username)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, invites)
+}
+
+// sessionInvitationsHandler lists the invitations of a session for those who
+// may invite
+func sessionInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionRoleAccess(w, r, r.URL.Query().Get("session_id"), roleMaintainer)
+	if !ok {
+		return
+	}
+	invites, err := sessionInvitations(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, invites)
+}
+
+// pendingInvitation resolves the invite_id form value to a pending invitation
+// of the user, reporting errors itself
+func pendingInvitation(w http.ResponseWriter, r *http.Request) (Invitation, bool) {
+	var inv Invitation
+	username, err := authFromJwt(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return inv, false
+	}
+	id, err := strconv.Atoi(r.FormValue("invite_id"))
+	if err != nil {
+		http.Error(w, "Invalid invite_id", http.StatusBadRequest)
+		return inv, false
+	}
+	if err := expireInvitations(); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return inv, false
+	}
+	invites, err := scanInvitations(db.Query(`SELECT `+invitationColumns+`
+		WHERE i.invite_id = ? AND u.username = ?`, id, username))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return inv, false
+	}
+	if len(invites) == 0 {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return inv, false
+	}
+	inv = invites[0]
+	if inv.Status != invitePending {
+		http.Error(w, "The invitation is "+inv.Status, http.StatusBadRequest)
+		return inv, false
+	}
+	return inv, true
+}
+
+// answerInvitation records the answer to an invitation, reporting false if
+// it is no longer pending
+func answerInvitation(inviteID int, status string) (bool, error) {
+	res, err := db.Exec("UPDATE invitations SET status = ?, responded_at = ? WHERE invite_id = ? AND status = ?",
+		status, time.Now().UTC().Format(time.RFC3339), inviteID, invitePending)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// writeAnswerError reports a failed answerInvitation
+func writeAnswerError(w http.ResponseWriter, answered bool, err error) bool {
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return true
+	}
+	if !answered {
+		http.Error(w, "The invitation is no longer pending", http.StatusBadRequest)
+		return true
+	}
+	return false
+}
+
+// acceptInvitationHandler makes the user a collaborator of the session in the
+// role they were invited with, as long as the inviter may still grant it
+func acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inv, ok := pendingInvitation(w, r)
+	if !ok {
+		return
+	}
+	// The inviter may have been removed or demoted since, which withdraws
+	// what they can no longer grant
+	if inviter, err := sessionRole(inv.SessionID, inv.Inviter); err != nil && !errors.Is(err, errAccessDenied) {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	} else if err != nil || !canGrant(inviter, inv.Role) {
+		if _, err := db.Exec("DELETE FROM invitations WHERE invite_id = ? AND status = ?", inv.InviteID, invitePending); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "The invitation was withdrawn, its sender can no longer grant this role", http.StatusForbidden)
+		return
+	}
+	if answered, err := answerInvitation(inv.InviteID, inviteAccepted); writeAnswerError(w, answered, err) {
+		return
+	}
+	_, err := db.Exec(`INSERT OR IGNORE INTO collabs(session_id, user_id, role)
+		VALUES (?, (SELECT user_id FROM users WHERE username = ?), ?)`, inv.SessionID, inv.Invitee, inv.Role)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	inv.Status = inviteAccepted
+	writeJSON(w, inv)
+}
+
+// declineInvitationHandler turns an invitation down
+func declineInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inv, ok := pendingInvitation(w, r)
+	if !ok {
+		return
+	}
+	if answered, err := answerInvitation(inv.InviteID, inviteDeclined); writeAnswerError(w, answered, err) {
+		return
+	}
+	inv.Status = inviteDeclined
+	writeJSON(w, inv)
+}
+
+// revokeInvitationHandler withdraws a pending invitation of the session. The
+// owner may revoke any, maintainers those for roles they may grant.
+func revokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleMaintainer)
+	if !ok {
+		return
+	}
+	actor, err := sessionRole(sid, username)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("invite_id"))
+	if err != nil {
+		http.Error(w, "Invalid invite_id", http.StatusBadRequest)
+		return
+	}
+	if err := expireInvitations(); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var role, status string
+	err = db.QueryRow("SELECT role, status FROM invitations WHERE invite_id = ? AND session_id = ?", id, sid).Scan(&role, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if status != invitePending {
+		http.Error(w, "Only pending invitations can be revoked", http.StatusBadRequest)
+		return
+	}
+	if !canGrant(actor, role) {
+		http.Error(w, "Access denied: your role cannot revoke an invitation as "+role, http.StatusForbidden)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM invitations WHERE invite_id = ? AND status = ?", id, invitePending); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Invitation revoked"))
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Limits are the resources a run may use. Zero fields are unset when Limits
+// override others, see overlay.
+type Limits struct {
+	TimeoutMs   int     `json:"timeout_ms,omitempty"`
+	MemoryMB    int     `json:"memory_mb,omitempty"`
+	CPUs        float64 `json:"cpus,omitempty"`
+	Pids        int     `json:"pids,omitempty"`
+	TmpfsMB     int     `json:"tmpfs_mb,omitempty"` // writable scratch space at /tmp, the rest of the filesystem is read-only
+	OutputBytes int     `json:"output_bytes,omitempty"`
+	Network     bool    `json:"network,omitempty"`
+}
+
+// Limits a run hits, as reported in RunMessage.LimitHit and the runs table
+const (
+	limitTimeout = "timeout"
+	limitMemory  = "memory"
+	limitOutput  = "output"
+)
+
+var limitMessages = map[string]string{
+	limitTimeout: "Execution timed out",
+	limitMemory:  "Out of memory",
+	limitOutput:  "Output limit exceeded",
+}
+
+// RunnerConfig is the admin configuration read from the JSON file named by
+// RUNNER_CONFIG. Languages override the built-in limits of each runner and
+// nothing, not even those overrides, may exceed Max. Queue bounds how many
+// runs execute at once, Pool is the number of warm containers per language
+// and Backend selects the Runner.
+type RunnerConfig struct {
+	Max       Limits            `json:"max"`
+	Languages map[string]Limits `json:"languages"`
+	Queue     QueueConfig       `json:"queue"`
+	Pool      map[string]int    `json:"pool"`
+	Backend   string            `json:"backend"` // "docker", the default, or "sandbox"
+}
+
+var runnerConfig = RunnerConfig{
+	Max: Limits{
+		TimeoutMs:   120000,
+		MemoryMB:    1024,
+		CPUs:        1,
+		Pids:        256,
+		TmpfsMB:     512,
+		OutputBytes: 4 << 20,
+	},
+}
+
+// loadRunnerConfig applies the admin configuration in path, if any, to the
+// runners. Maximums left out of the file keep their defaults.
+func loadRunnerConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg RunnerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	runnerConfig.Max = runnerConfig.Max.overlay(cfg.Max)
+	runnerConfig.Max.Network = cfg.Max.Network
+	for language, l := range cfg.Languages {
+		r, ok := runners[language]
+		if !ok {
+			return fmt.Errorf("%s: no runner for language %q", path, language)
+		}
+		r.Limits = r.Limits.overlay(l)
+		runners[language] = r
+	}
+	for language := range cfg.Pool {
+		if _, ok := runners[language]; !ok {
+			return fmt.Errorf("%s: no runner for language %q", path, language)
+		}
+	}
+	if err := selectBackend(cfg.Backend); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	queue.configure(cfg.Queue)
+	pool.configure(cfg.Pool)
+	return nil
+}
+
+// overlay returns l with every field that is set in o replaced
+func (l Limits) overlay(o Limits) Limits {
+	if o.TimeoutMs > 0 {
+		l.TimeoutMs = o.TimeoutMs
+	}
+	if o.MemoryMB > 0 {
+		l.MemoryMB = o.MemoryMB
+	}
+	if o.CPUs > 0 {
+		l.CPUs = o.CPUs
+	}
+	if o.Pids > 0 {
+		l.Pids = o.Pids
+	}
+	if o.TmpfsMB > 0 {
+		l.TmpfsMB = o.TmpfsMB
+	}
+	if o.OutputBytes > 0 {
+		l.OutputBytes = o.OutputBytes
+	}
+	l.Network = l.Network || o.Network
+	return l
+}
+
+// clamp returns l with every field at most the one in max
+func (l Limits) clamp(max Limits) Limits {
+	l.TimeoutMs = min(l.TimeoutMs, max.TimeoutMs)
+	l.MemoryMB = min(l.MemoryMB, max.MemoryMB)
+	l.CPUs = min(l.CPUs, max.CPUs)
+	l.Pids = min(l.Pids, max.Pids)
+	l.TmpfsMB = min(l.TmpfsMB, max.TmpfsMB)
+	l.OutputBytes = min(l.OutputBytes, max.OutputBytes)
+	l.Network = l.Network && max.Network
+	return l
+}
+
+// exceeds names the first field of l that is above max, if any
+func (l Limits) exceeds(max Limits) string {
+	switch {
+	case l.TimeoutMs > max.TimeoutMs:
+		return fmt.Sprintf("timeout_ms may be at most %d", max.TimeoutMs)
+	case l.MemoryMB > max.MemoryMB:
+		return fmt.Sprintf("memory_mb may be at most %d", max.MemoryMB)
+	case l.CPUs > max.CPUs:
+		return fmt.Sprintf("cpus may be at most %g", max.CPUs)
+	case l.Pids > max.Pids:
+		return fmt.Sprintf("pids may be at most %d", max.Pids)
+	case l.TmpfsMB > max.TmpfsMB:
+		return fmt.Sprintf("tmpfs_mb may be at most %d", max.TmpfsMB)
+	case l.OutputBytes > max.OutputBytes:
+		return fmt.Sprintf("output_bytes may be at most %d", max.OutputBytes)
+	case l.Network && !max.Network:
+		return "network access is not allowed"
+	}
+	return ""
+}
+
+func (l Limits) timeout() time.Duration {
+	return time.Duration(l.TimeoutMs) * time.Millisecond
+}
+
+// dockerArgs are the docker run flags enforcing l
+func (l Limits) dockerArgs() []string {
+	network := "none"
+	if l.Network {
+		network = "bridge"
+	}
+	return []string{
+		"--network", network,
+		"--memory", fmt.Sprintf("%dm", l.MemoryMB),
+		"--memory-swap", fmt.Sprintf("%dm", l.MemoryMB),
+		"--cpus", strconv.FormatFloat(l.CPUs, 'f', -1, 64),
+		"--pids-limit", strconv.Itoa(l.Pids),
+		"--read-only",
+		"--tmpfs", fmt.Sprintf("/tmp:rw,exec,nosuid,size=%dm", l.TmpfsMB),
+		"--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges",
+	}
+}
+
+// sessionLimits returns the limits set for the session only
+func sessionLimits(sessionID int) (Limits, error) {
+	var l Limits
+	var raw sql.NullString
+	err := db.QueryRow("SELECT run_limits FROM sessions WHERE session_id = ?", sessionID).Scan(&raw)
+	if err != nil || !raw.Valid || raw.String == "" {
+		return l, err
+	}
+	err = json.Unmarshal([]byte(raw.String), &l)
+	return l, err
+}
+
+// effectiveLimits are the limits a run of the session gets: those of the
+// language runner, overridden by the session, within the admin maximums.
+func effectiveLimits(sessionID int, runner LanguageRunner) (Limits, error) {
+	l, err := sessionLimits(sessionID)
+	if err != nil {
+		return Limits{}, err
+	}
+	return runner.Limits.overlay(l).clamp(runnerConfig.Max), nil
+}
+
+// outputLimiter enforces Limits.OutputBytes across the streams of a run and
+// calls exceeded once, the first time output goes over it.
+type outputLimiter struct {
+	limit    int64
+	n        atomic.Int64
+	hit      atomic.Bool
+	exceeded func()
+}
+
+// allow returns how many of the next n bytes of output may still be shown
+func (o *outputLimiter) allow(n int) int {
+	total := o.n.Add(int64(n))
+	if total <= o.limit {
+		return n
+	}
+	if o.hit.CompareAndSwap(false, true) && o.exceeded != nil {
+		o.exceeded()
+	}
+	return int(max(0, o.limit-(total-int64(n))))
+}
+
+// limitedWriter passes output on to w until the limiter runs out
+type limitedWriter struct {
+	limiter *outputLimiter
+	w       io.Writer
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	if n := lw.limiter.allow(len(p)); n > 0 {
+		lw.w.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// limitHit names the limit that ended a run, or "" if none did
+func limitHit(outputExceeded, timedOut, oom bool) string {
+	switch {
+	case outputExceeded:
+		return limitOutput
+	case timedOut:
+		return limitTimeout
+	case oom:
+		return limitMemory
+	}
+	return ""
+}
+
+type SessionLimitsResponse struct {
+	Language  Limits `json:"language"`  // defaults of the session's language
+	Session   Limits `json:"session"`   // set for this session
+	Effective Limits `json:"effective"` // what runs get
+	Max       Limits `json:"max"`
+}
+
+// sessionLimitsHandler shows the run limits of a session and, on POST, lets
+// the owner change them. Fields left empty fall back to the language defaults.
+func sessionLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	username, sid, ok := sessionAccess(w, r, r.FormValue("session_id"))
+	if !ok {
+		return
+	}
+	var language string
+	err := db.QueryRow(`SELECT COALESCE(s.language, '') FROM sessions s WHERE s.session_id = ?`, sid).Scan(&language)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	runner, ok := runners[language]
+	if !ok {
+		http.Error(w, "Interpretation is not supported for "+language+" sessions", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		if checkSessionRole(sid, username, roleOwner) != nil {
+			http.Error(w, "Only the owner can change run limits", http.StatusForbidden)
+			return
+		}
+		var l Limits
+		ints := []struct {
+			name string
+			dest *int
+		}{
+			{"timeout_ms", &l.TimeoutMs},
+			{"memory_mb", &l.MemoryMB},
+			{"pids", &l.Pids},
+			{"tmpfs_mb", &l.TmpfsMB},
+			{"output_bytes", &l.OutputBytes},
+		}
+		for _, f := range ints {
+			if v := r.FormValue(f.name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					http.Error(w, "Invalid "+f.name, http.StatusBadRequest)
+					return
+				}
+				*f.dest = n
+			}
+		}
+		if v := r.FormValue("cpus"); v != "" {
+			if l.CPUs, err = strconv.ParseFloat(v, 64); err != nil || l.CPUs < 0 {
+				http.Error(w, "Invalid cpus", http.StatusBadRequest)
+				return
+			}
+		}
+		l.Network = r.FormValue("network") == "true"
+		if msg := runner.Limits.overlay(l).exceeds(runnerConfig.Max); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		raw, _ := json.Marshal(l)
+		if _, err := db.Exec("UPDATE sessions SET run_limits = ? WHERE session_id = ?", string(raw), sid); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l, err := sessionLimits(sid)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SessionLimitsResponse{
+		Language:  runner.Limits,
+		Session:   l,
+		Effective: runner.Limits.overlay(l).clamp(runnerConfig.Max),
+		Max:       runnerConfig.Max,
+	})
+}
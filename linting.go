@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// LintSettings are the per-session choices about linting
+type LintSettings struct {
+	Linters []string `json:"linters"` // names of the enabled linters
+	OnSave  bool     `json:"on_save"` // lint after every save
+}
+
+type SessionLintersResponse struct {
+	Available []string `json:"available"` // linters of the session's language
+	LintSettings
+}
+
+// LintReport is what the enabled linters found in a session's project
+type LintReport struct {
+	Diagnostics []Diagnostic `json:"diagnostics"`
+	// Linters that could not check the project, with what they printed
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+func linterNames(r LanguageRunner) []string {
+	names := []string{}
+	for _, l := range r.Linters {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// sessionLintSettings returns the lint settings of the session. Until the
+// owner chooses, every linter of its language is enabled and saves are not
+// linted.
+func sessionLintSettings(sessionID int) (LintSettings, error) {
+	var language string
+	var raw sql.NullString
+	err := db.QueryRow("SELECT COALESCE(language, ''), lint_settings FROM sessions WHERE session_id = ?", sessionID).
+		Scan(&language, &raw)
+	if err != nil {
+		return LintSettings{}, err
+	}
+	if !raw.Valid || raw.String == "" {
+		return LintSettings{Linters: linterNames(runners[language])}, nil
+	}
+	var s LintSettings
+	err = json.Unmarshal([]byte(raw.String), &s)
+	return s, err
+}
+
+// lint runs the enabled linters one after another on the prepared project
+func lint(spec *runSpec, enabled []string) (LintReport, error) {
+	report := LintReport{Diagnostics: []Diagnostic{}}
+	for _, l := range spec.runner.Linters {
+		if !slices.Contains(enabled, l.Name) {
+			continue
+		}
+		spec.command = l.Command
+		res, err := spec.runBatch("", spec.limits.timeout())
+		if err != nil {
+			return report, err
+		}
+		diags := diagnosticParsers[l.Errors](res.combined, spec.projectFile)
+		// Linters exit with an error when they find something, it is only a
+		// failure when they say nothing about the project
+		hit := limitHit(res.outputHit, res.timedOut, oomKilled(res.exitCode, res.outputHit, res.timedOut))
+		if hit != "" || res.err != nil && len(diags) == 0 {
+			if report.Failed == nil {
+				report.Failed = map[string]string{}
+			}
+			report.Failed[l.Name] = strings.TrimSpace(res.combined)
+			if hit != "" {
+				report.Failed[l.Name] = limitMessages[hit]
+			}
+			continue
+		}
+		for _, d := range diags {
+			d.Source = l.Name
+			if l.Severity != "" {
+				d.Severity = l.Severity
+			}
+			report.Diagnostics = append(report.Diagnostics, d)
+		}
+	}
+	return report, nil
+}
+
+// lintHandler runs the enabled linters of the session on its current code
+func lintHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	language, err := sessionLanguage(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if len(runners[language].Linters) == 0 {
+		http.Error(w, "Linting is not supported for "+language+" sessions", http.StatusBadRequest)
+		return
+	}
+	settings, err := sessionLintSettings(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	spec, finish, ok := prepareBatchRun(w, r, username, sid, r.FormValue("entrypoint"))
+	if !ok {
+		return
+	}
+	defer finish()
+	report, err := lint(spec, settings.Linters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// sessionLintersHandler shows the lint settings of a session, and lets its
+// owner change them with a POST of the enabled linters (repeated "linter"
+// values) and "on_save"
+func sessionLintersHandler(w http.ResponseWriter, r *http.Request) {
+	username, sid, ok := sessionAccess(w, r, r.FormValue("session_id"))
+	if !ok {
+		return
+	}
+	var language string
+	err := db.QueryRow(`SELECT COALESCE(s.language, '') FROM sessions s WHERE s.session_id = ?`, sid).Scan(&language)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	available := linterNames(runners[language])
+	if len(available) == 0 {
+		http.Error(w, "Linting is not supported for "+language+" sessions", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		if checkSessionRole(sid, username, roleOwner) != nil {
+			http.Error(w, "Only the owner can change lint settings", http.StatusForbidden)
+			return
+		}
+		s := LintSettings{Linters: []string{}, OnSave: r.FormValue("on_save") == "true"}
+		for _, name := range r.Form["linter"] {
+			if !slices.Contains(available, name) {
+				http.Error(w, "Unknown linter "+name, http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(s.Linters, name) {
+				s.Linters = append(s.Linters, name)
+			}
+		}
+		raw, _ := json.Marshal(s)
+		if _, err := db.Exec("UPDATE sessions SET lint_settings = ? WHERE session_id = ?", string(raw), sid); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, err := sessionLintSettings(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SessionLintersResponse{Available: available, LintSettings: s})
+}
+
+// Sessions linted after a save, and those saved again meanwhile
+var (
+	lintMu      sync.Mutex
+	lintRunning = map[int]bool{}
+	lintAgain   = map[int]bool{}
+)
+
+// lintOnSave lints the session in the background after username saved it,
+// if its settings ask for that, and shows the diagnostics to everyone who
+// has it open. Saves while it is linted lead to one more lint afterwards.
+func lintOnSave(sessionID int, username string) {
+	settings, err := sessionLintSettings(sessionID)
+	if err != nil || !settings.OnSave || len(settings.Linters) == 0 {
+		return
+	}
+	lintMu.Lock()
+	defer lintMu.Unlock()
+	if lintRunning[sessionID] {
+		lintAgain[sessionID] = true
+		return
+	}
+	lintRunning[sessionID] = true
+	go func() {
+		for {
+			if err := lintAndPublish(sessionID, username); err != nil {
+				log.Printf("lint: session %d: %v", sessionID, err)
+			}
+			lintMu.Lock()
+			again := lintAgain[sessionID]
+			delete(lintAgain, sessionID)
+			if !again {
+				delete(lintRunning, sessionID)
+				lintMu.Unlock()
+				return
+			}
+			lintMu.Unlock()
+		}
+	}()
+}
+
+// lintAndPublish lints the current code of the session with its enabled
+// linters and sends the report to its console as a "lint" message
+func lintAndPublish(sessionID int, username string) error {
+	settings, err := sessionLintSettings(sessionID)
+	if err != nil {
+		return err
+	}
+	spec, err := prepareRun(sessionID, "")
+	if err != nil {
+		return err
+	}
+	defer spec.cleanup()
+	release, err := queue.acquire(context.Background(), username, sessionID, nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+	report, err := lint(spec, settings.Linters)
+	if err != nil {
+		return err
+	}
+	m := RunMessage{Type: "lint", Author: username, Diagnostics: report.Diagnostics}
+	var failed []string
+	for name, output := range report.Failed {
+		failed = append(failed, name+": "+output)
+	}
+	if len(failed) > 0 {
+		slices.Sort(failed)
+		m.Error = strings.Join(failed, "\n")
+	}
+	publishRun(sessionID, m)
+	return nil
+}
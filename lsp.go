@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// A language server runs at most this long, its clients then reconnect
+	// to a fresh one that sees the project as it is by then
+	languageServerLifetime = time.Hour
+	// and is stopped this long after its last client left, so reloading
+	// the editor, as opening another file does, finds it still running
+	languageServerLinger = time.Minute
+	// Language servers of all sessions running at once
+	maxLanguageServers = 16
+	// How long the server may take to answer initialize
+	languageServerInitTimeout = time.Minute
+	// Largest JSON-RPC message either side may send
+	lspMaxMessageSize = 8 << 20
+)
+
+// Language servers index the whole project and need more room than a run
+var languageServerLimits = Limits{MemoryMB: 1024, CPUs: 1, Pids: 256, TmpfsMB: 512}
+
+var errTooManyLanguageServers = errors.New("Too many language servers are running, try again later")
+
+// Requests viewers may make. The others, like rename, code actions or
+// workspace/executeCommand, could have the server change the project.
+var lspReadRequests = map[string]bool{
+	"textDocument/completion":           true,
+	"completionItem/resolve":            true,
+	"textDocument/hover":                true,
+	"textDocument/signatureHelp":        true,
+	"textDocument/definition":           true,
+	"textDocument/declaration":          true,
+	"textDocument/typeDefinition":       true,
+	"textDocument/implementation":       true,
+	"textDocument/references":           true,
+	"textDocument/documentHighlight":    true,
+	"textDocument/documentSymbol":       true,
+	"textDocument/documentLink":         true,
+	"textDocument/foldingRange":         true,
+	"textDocument/selectionRange":       true,
+	"textDocument/semanticTokens/full":  true,
+	"textDocument/semanticTokens/range": true,
+	"textDocument/inlayHint":            true,
+	"textDocument/diagnostic":           true,
+	"workspace/symbol":                  true,
+}
+
+// lspMessage is a JSON-RPC message of the language server protocol
+type lspMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+type lspDocumentItem struct {
+	URI        string `json:"uri"`
+	LanguageID string `json:"languageId"`
+	Version    int    `json:"version"`
+	Text       string `json:"text"`
+}
+
+type lspDocumentChange struct {
+	TextDocument struct {
+		URI     string `json:"uri"`
+		Version int    `json:"version"`
+	} `json:"textDocument"`
+	ContentChanges []json.RawMessage `json:"contentChanges"`
+}
+
+// languageServer is the language server of a session, run like a program in
+// the runner of its language and shared by everyone who has the session
+// open. The proxy initializes it once and answers the initialize of every
+// client with the server's reply and the root of the project as the server
+// sees it ("rootUri"). Requests of the clients get ids of the proxy, so their
+// replies find their way back, and notifications of the server go to all
+// clients. Clients edit the same shared document, so they send its full text
+// on every change and the proxy numbers the versions of each document.
+// Viewers only make requests that read, and the documents they open have the
+// text of the project.
+type languageServer struct {
+	sessionID int
+	root      string // URI of the project in the runner
+	cancel    context.CancelFunc
+	stdin     io.WriteCloser
+	writeMu   sync.Mutex
+	ready     chan struct{} // closed once the server is initialized
+	done      chan struct{} // closed when the server stops
+	stopOnce  sync.Once
+
+	mu         sync.Mutex
+	initResult json.RawMessage
+	clients    map[*lspClient]bool
+	nextID     int
+	pending    map[int]lspPending // requests the server has yet to answer, by id
+	linger     *time.Timer
+
+	// Documents the clients have open, by URI. Held while writing their
+	// notifications, so the server gets the versions in order.
+	docsMu sync.Mutex
+	docs   map[string]*lspDocument
+}
+
+type lspPending struct {
+	client *lspClient
+	id     json.RawMessage // the client's id of the request
+	reply  chan lspMessage // for the proxy's own requests
+}
+
+type lspDocument struct {
+	version int
+	clients map[*lspClient]bool
+}
+
+type lspClient struct {
+	wsConn
+	username string
+	readOnly bool // a viewer, who may only read: see lspReadRequests
+}
+
+var (
+	languageServersMu sync.Mutex
+	languageServers   = make(map[int]*languageServer) // by session id
+	// Sessions whose server is being started, closed once it is registered
+	// or failed to start
+	languageServersStarting = make(map[int]chan struct{})
+)
+
+// languageServerFor returns the running language server of the session, or
+// starts one. The server is started outside the lock, its slot is reserved
+// so the session gets only one.
+func languageServerFor(sessionID int) (*languageServer, error) {
+	for {
+		languageServersMu.Lock()
+		if s := languageServers[sessionID]; s != nil {
+			languageServersMu.Unlock()
+			return s, nil
+		}
+		if started := languageServersStarting[sessionID]; started != nil {
+			languageServersMu.Unlock()
+			<-started
+			continue
+		}
+		if len(languageServers)+len(languageServersStarting) >= maxLanguageServers {
+			languageServersMu.Unlock()
+			return nil, errTooManyLanguageServers
+		}
+		started := make(chan struct{})
+		languageServersStarting[sessionID] = started
+		languageServersMu.Unlock()
+
+		s, err := startLanguageServer(sessionID)
+		languageServersMu.Lock()
+		delete(languageServersStarting, sessionID)
+		close(started)
+		if err == nil {
+			select {
+			case <-s.done:
+				err = errors.New("The language server stopped")
+			default:
+				languageServers[sessionID] = s
+			}
+		}
+		languageServersMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+}
+
+// startLanguageServer starts the language server of the session's language
+// on a copy of its project, with the limits of a run raised for it
+func startLanguageServer(sessionID int) (*languageServer, error) {
+	spec, err := prepareRun(sessionID, "")
+	if err != nil {
+		return nil, err
+	}
+	if spec.runner.LanguageServer == "" {
+		spec.cleanup()
+		return nil, runSetupError("There is no language server for " + spec.language + " sessions")
+	}
+	spec.command = spec.runner.LanguageServer
+	spec.limits = spec.limits.overlay(languageServerLimits).clamp(runnerConfig.Max)
+	// The server is stopped once it is no longer used, not by the timeout of a run
+	spec.limits.TimeoutMs = int(languageServerLifetime.Milliseconds())
+
+	ctx, cancel := context.WithTimeout(context.Background(), languageServerLifetime)
+	stdout, stdoutW := io.Pipe()
+	proc, err := backend.Start(ctx, spec, stdoutW, io.Discard)
+	if err != nil {
+		cancel()
+		spec.cleanup()
+		return nil, err
+	}
+	s := &languageServer{
+		sessionID: sessionID,
+		root:      "file://" + sandboxProjectDir,
+		cancel:    cancel,
+		stdin:     proc.Stdin(),
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+		clients:   make(map[*lspClient]bool),
+		pending:   make(map[int]lspPending),
+		docs:      make(map[string]*lspDocument),
+	}
+	go func() {
+		if code, err := proc.Wait(); err != nil && ctx.Err() == nil {
+			log.Printf("lsp: session %d: language server exited with %d: %v", sessionID, code, err)
+		}
+		stdoutW.Close()
+		spec.cleanup()
+	}()
+	go s.readServer(stdout)
+	go s.initialize()
+	// Stopped unless someone connects
+	s.linger = time.AfterFunc(languageServerLinger, s.stop)
+	return s, nil
+}
+
+// stop kills the server and disconnects its clients
+func (s *languageServer) stop() {
+	s.stopOnce.Do(func() {
+		// Closed under the lock, so a server stopping while it is started is
+		// not registered, see languageServerFor
+		languageServersMu.Lock()
+		if languageServers[s.sessionID] == s {
+			delete(languageServers, s.sessionID)
+		}
+		close(s.done)
+		languageServersMu.Unlock()
+		s.cancel()
+		s.mu.Lock()
+		s.linger.Stop()
+		for c := range s.clients {
+			c.close()
+		}
+		s.mu.Unlock()
+	})
+}
+
+// initialize sets the server up for the project with what the editor supports
+func (s *languageServer) initialize() {
+	params := map[string]any{
+		"processId": nil,
+		"rootUri":   s.root,
+		"workspaceFolders": []map[string]string{
+			{"uri": s.root, "name": "project"},
+		},
+		"clientInfo": map[string]string{"name": "cocode"},
+		"capabilities": map[string]any{
+			"textDocument": map[string]any{
+				"synchronization": map[string]any{"didSave": false},
+				"completion": map[string]any{
+					"completionItem": map[string]any{"snippetSupport": false, "documentationFormat": []string{"plaintext"}},
+				},
+				"hover":              map[string]any{"contentFormat": []string{"plaintext", "markdown"}},
+				"definition":         map[string]any{"linkSupport": false},
+				"publishDiagnostics": map[string]any{},
+			},
+			"workspace": map[string]any{"workspaceFolders": true},
+		},
+	}
+	reply := make(chan lspMessage, 1)
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = lspPending{reply: reply}
+	s.mu.Unlock()
+	raw, _ := json.Marshal(params)
+	if err := s.write(lspMessage{ID: json.RawMessage(strconv.Itoa(id)), Method: "initialize", Params: raw}); err != nil {
+		s.stop()
+		return
+	}
+	select {
+	case m := <-reply:
+		if m.Error != nil {
+			log.Printf("lsp: session %d: initialize failed: %s", s.sessionID, m.Error)
+			s.stop()
+			return
+		}
+		s.mu.Lock()
+		s.initResult = m.Result
+		s.mu.Unlock()
+		s.write(lspMessage{Method: "initialized", Params: json.RawMessage("{}")})
+		close(s.ready)
+	case <-time.After(languageServerInitTimeout):
+		log.Printf("lsp: session %d: initialize timed out", s.sessionID)
+		s.stop()
+	case <-s.done:
+	}
+}
+
+// write sends a message to the server
+func (s *languageServer) write(m lspMessage) error {
+	m.JSONRPC = "2.0"
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := fmt.Fprintf(s.stdin, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = s.stdin.Write(body)
+	return err
+}
+
+// readLSPMessage reads the body of the next message of a base protocol stream
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 || n > lspMaxMessageSize {
+		return nil, fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return body, err
+}
+
+// readServer passes what the server writes on to the clients until it stops
+func (s *languageServer) readServer(stdout io.Reader) {
+	defer s.stop()
+	r := bufio.NewReader(stdout)
+	for {
+		body, err := readLSPMessage(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+				log.Printf("lsp: session %d: %v", s.sessionID, err)
+			}
+			return
+		}
+		var m lspMessage
+		if err := json.Unmarshal(body, &m); err != nil {
+			continue
+		}
+		switch {
+		case m.Method == "" && m.ID != nil:
+			s.reply(m)
+		case m.ID != nil:
+			s.answerServer(m)
+		default:
+			s.broadcast(body)
+		}
+	}
+}
+
+// reply hands the server's answer to whoever asked
+func (s *languageServer) reply(m lspMessage) {
+	id, err := strconv.Atoi(string(m.ID))
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	p, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	switch {
+	case !ok:
+	case p.reply != nil:
+		p.reply <- m
+	default:
+		m.ID = p.id
+		if msg, err := json.Marshal(m); err == nil {
+			p.client.sendMessage(msg)
+		}
+	}
+}
+
+// answerServer answers the requests a server makes of its client. The
+// proxy has no settings to give, applies no edits, since the project changes
+// only through the shared documents, and accepts whatever else is asked.
+func (s *languageServer) answerServer(m lspMessage) {
+	result := json.RawMessage("null")
+	switch m.Method {
+	case "workspace/configuration":
+		var params struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		json.Unmarshal(m.Params, &params)
+		result = json.RawMessage("[" + strings.TrimSuffix(strings.Repeat("null,", len(params.Items)), ",") + "]")
+	case "workspace/applyEdit":
+		result = json.RawMessage(`{"applied":false}`)
+	}
+	s.write(lspMessage{ID: m.ID, Result: result})
+}
+
+func (s *languageServer) broadcast(msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.sendMessage(msg)
+	}
+}
+
+// join adds a client, false if the server stopped meanwhile
+func (s *languageServer) join(c *lspClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.clients[c] = true
+	s.linger.Stop()
+	return true
+}
+
+// leave removes a client, closing the documents only it had open and
+// forgetting its requests
+func (s *languageServer) leave(c *lspClient) {
+	s.mu.Lock()
+	delete(s.clients, c)
+	for id, p := range s.pending {
+		if p.client == c {
+			delete(s.pending, id)
+		}
+	}
+	if len(s.clients) == 0 {
+		s.linger.Reset(languageServerLinger)
+	}
+	s.mu.Unlock()
+
+	s.docsMu.Lock()
+	defer s.docsMu.Unlock()
+	for uri, doc := range s.docs {
+		delete(doc.clients, c)
+		if len(doc.clients) == 0 {
+			delete(s.docs, uri)
+			s.closeDocument(uri)
+		}
+	}
+}
+
+func (s *languageServer) closeDocument(uri string) {
+	params, _ := json.Marshal(map[string]any{"textDocument": map[string]string{"uri": uri}})
+	s.write(lspMessage{Method: "textDocument/didClose", Params: params})
+}
+
+// fromClient handles a message of a client
+func (s *languageServer) fromClient(c *lspClient, msg []byte) {
+	var m lspMessage
+	if err := json.Unmarshal(msg, &m); err != nil || m.Method == "" {
+		// The proxy makes no requests of clients, so there is nothing to answer
+		return
+	}
+	if m.ID != nil {
+		s.request(c, m)
+	} else {
+		s.notification(c, m)
+	}
+}
+
+func (s *languageServer) request(c *lspClient, m lspMessage) {
+	switch m.Method {
+	case "initialize":
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+		var result map[string]json.RawMessage
+		json.Unmarshal(s.initResult, &result)
+		s.mu.Unlock()
+		if result == nil {
+			result = map[string]json.RawMessage{}
+		}
+		result["rootUri"], _ = json.Marshal(s.root)
+		raw, _ := json.Marshal(result)
+		c.sendJSON(lspMessage{ID: m.ID, Result: raw})
+	case "shutdown":
+		// Others still use the server
+		c.sendJSON(lspMessage{ID: m.ID, Result: json.RawMessage("null")})
+	default:
+		if c.readOnly && !lspReadRequests[m.Method] {
+			c.sendJSON(lspMessage{ID: m.ID, Error: json.RawMessage(`{"code":-32803,"message":"Viewers cannot change the session"}`)})
+			return
+		}
+		s.mu.Lock()
+		s.nextID++
+		id := s.nextID
+		s.pending[id] = lspPending{client: c, id: m.ID}
+		s.mu.Unlock()
+		m.ID = json.RawMessage(strconv.Itoa(id))
+		s.write(m)
+	}
+}
+
+func (s *languageServer) notification(c *lspClient, m lspMessage) {
+	switch m.Method {
+	case "initialized", "exit":
+		// The proxy initialized the server, and it stops when no one uses it
+	case "$/cancelRequest":
+		var params struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.Unmarshal(m.Params, &params)
+		s.mu.Lock()
+		for id, p := range s.pending {
+			if p.client == c && string(p.id) == string(params.ID) {
+				m.Params, _ = json.Marshal(map[string]int{"id": id})
+				s.mu.Unlock()
+				s.write(m)
+				return
+			}
+		}
+		s.mu.Unlock()
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument lspDocumentItem `json:"textDocument"`
+		}
+		if json.Unmarshal(m.Params, &params) != nil {
+			return
+		}
+		item := params.TextDocument
+		if c.readOnly {
+			// The server gets the file as it is, not what a viewer says it is
+			text, ok := s.projectText(item.URI)
+			if !ok {
+				return
+			}
+			item.Text = text
+		}
+		s.docsMu.Lock()
+		defer s.docsMu.Unlock()
+		doc := s.docs[item.URI]
+		if doc == nil {
+			doc = &lspDocument{version: 1, clients: make(map[*lspClient]bool)}
+			s.docs[item.URI] = doc
+			doc.clients[c] = true
+			item.Version = doc.version
+			m.Params, _ = json.Marshal(map[string]any{"textDocument": item})
+			s.write(m)
+			return
+		}
+		// Open already, the client's text is the latest unless it may not edit
+		doc.clients[c] = true
+		if c.readOnly {
+			return
+		}
+		text, _ := json.Marshal(map[string]string{"text": item.Text})
+		s.changeDocument(item.URI, doc, []json.RawMessage{text})
+	case "textDocument/didChange":
+		var params lspDocumentChange
+		if json.Unmarshal(m.Params, &params) != nil {
+			return
+		}
+		s.docsMu.Lock()
+		defer s.docsMu.Unlock()
+		doc := s.docs[params.TextDocument.URI]
+		if doc == nil || !doc.clients[c] || c.readOnly {
+			return
+		}
+		s.changeDocument(params.TextDocument.URI, doc, params.ContentChanges)
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if json.Unmarshal(m.Params, &params) != nil {
+			return
+		}
+		uri := params.TextDocument.URI
+		s.docsMu.Lock()
+		defer s.docsMu.Unlock()
+		if doc := s.docs[uri]; doc != nil && doc.clients[c] {
+			delete(doc.clients, c)
+			if len(doc.clients) == 0 {
+				delete(s.docs, uri)
+				s.closeDocument(uri)
+			}
+		}
+	default:
+		if !c.readOnly {
+			s.write(m)
+		}
+	}
+}
+
+// projectText returns the current text of the project file a document URI
+// names, false if it names none
+func (s *languageServer) projectText(uri string) (string, bool) {
+	p, ok := strings.CutPrefix(uri, s.root+"/")
+	if !ok {
+		return "", false
+	}
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+	var fileID int
+	if db.QueryRow("SELECT file_id FROM session_files WHERE session_id = ? AND path = ?", s.sessionID, p).Scan(&fileID) != nil {
+		return "", false
+	}
+	text, err := fileText(fileID)
+	return text, err == nil
+}
+
+// changeDocument sends the next version of an open document, docsMu held
+func (s *languageServer) changeDocument(uri string, doc *lspDocument, changes []json.RawMessage) {
+	doc.version++
+	var params lspDocumentChange
+	params.TextDocument.URI = uri
+	params.TextDocument.Version = doc.version
+	params.ContentChanges = changes
+	raw, _ := json.Marshal(params)
+	s.write(lspMessage{Method: "textDocument/didChange", Params: raw})
+}
+
+func (c *lspClient) sendJSON(m lspMessage) {
+	m.JSONRPC = "2.0"
+	if msg, err := json.Marshal(m); err == nil {
+		c.sendMessage(msg)
+	}
+}
+
+func (c *lspClient) readPump(s *languageServer) {
+	defer func() {
+		s.leave(c)
+		c.close()
+	}()
+	c.ws.SetReadLimit(lspMaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		s.fromClient(c, msg)
+	}
+}
+
+// serveLanguageServerWs connects a collaborator of the session to its
+// language server, starting it if need be. Every WebSocket message is one
+// JSON-RPC message of the language server protocol.
+func serveLanguageServerWs(w http.ResponseWriter, r *http.Request) {
+	username, sessionID, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	role, err := sessionRole(sessionID, username)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	s, err := languageServerFor(sessionID)
+	var setupErr runSetupError
+	var notReady runnerNotReady
+	if errors.As(err, &setupErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.As(err, &notReady) || errors.Is(err, errTooManyLanguageServers) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied with an error
+		return
+	}
+	c := &lspClient{wsConn: newWsConn(ws, websocket.TextMessage), username: username, readOnly: !atLeast(role, roleEditor)}
+	if !s.join(c) {
+		c.close()
+		return
+	}
+	go c.writePump()
+	c.readPump(s)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
@@ -13,6 +14,167 @@ import (
 var templates *template.Template
 var db *sql.DB
 
+// schema creates the tables that do not exist yet
+const schema = `
+	CREATE TABLE IF NOT EXISTS users (
+		user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+		session_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner_id INTEGER NOT NULL,
+		language TEXT,
+		project_name TEXT,
+		content TEXT DEFAULT '',
+		ydoc BLOB,
+		entry_file_id INTEGER,
+		run_limits TEXT,
+		lint_settings TEXT,
+		public BOOLEAN NOT NULL DEFAULT 0,
+		org_id INTEGER,
+		FOREIGN KEY(owner_id) REFERENCES users(user_id),
+		FOREIGN KEY(org_id) REFERENCES orgs(org_id)
+	);
+	CREATE TABLE IF NOT EXISTS session_files (
+		file_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		content TEXT DEFAULT '',
+		ydoc BLOB,
+		UNIQUE(session_id, path),
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id)
+	);
+	CREATE TABLE IF NOT EXISTS collabs (
+		session_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL DEFAULT 'editor',
+		PRIMARY KEY (session_id, user_id),
+		FOREIGN KEY(user_id) REFERENCES users(user_id),
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id)
+	);
+	CREATE TABLE IF NOT EXISTS session_versions (
+		version_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		file_id INTEGER,
+		user_id INTEGER,
+		created_at TEXT NOT NULL,
+		content TEXT NOT NULL,
+		content_hash TEXT NOT NULL,
+		name TEXT,
+		restored_from INTEGER,
+		FOREIGN KEY(user_id) REFERENCES users(user_id),
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id),
+		FOREIGN KEY(file_id) REFERENCES session_files(file_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_session_versions_session ON session_versions(session_id, version_id);
+	CREATE TABLE IF NOT EXISTS runs (
+		run_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		user_id INTEGER,
+		language TEXT NOT NULL,
+		entrypoint TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		started_at TEXT NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		exit_code INTEGER,
+		timed_out BOOLEAN NOT NULL DEFAULT 0,
+		killed BOOLEAN NOT NULL DEFAULT 0,
+		oom_killed BOOLEAN NOT NULL DEFAULT 0,
+		limit_hit TEXT NOT NULL DEFAULT '',
+		tests_total INTEGER NOT NULL DEFAULT 0,
+		tests_passed INTEGER NOT NULL DEFAULT 0,
+		test_tool TEXT NOT NULL DEFAULT '',
+		stdin TEXT NOT NULL DEFAULT '',
+		stdout TEXT NOT NULL DEFAULT '',
+		stderr TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(user_id) REFERENCES users(user_id),
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_runs_session ON runs(session_id, run_id);
+	CREATE TABLE IF NOT EXISTS test_cases (
+		case_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		stdin TEXT NOT NULL DEFAULT '',
+		expected_stdout TEXT NOT NULL DEFAULT '',
+		timeout_ms INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id)
+	);
+	CREATE TABLE IF NOT EXISTS test_results (
+		result_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER NOT NULL,
+		case_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		passed BOOLEAN NOT NULL,
+		expected TEXT NOT NULL,
+		stdout TEXT NOT NULL,
+		stderr TEXT NOT NULL,
+		exit_code INTEGER NOT NULL,
+		limit_hit TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL,
+		FOREIGN KEY(run_id) REFERENCES runs(run_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_test_results_run ON test_results(run_id, result_id);
+	CREATE TABLE IF NOT EXISTS unit_test_results (
+		result_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER NOT NULL,
+		suite TEXT NOT NULL,
+		name TEXT NOT NULL,
+		status TEXT NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		message TEXT NOT NULL,
+		output TEXT NOT NULL,
+		FOREIGN KEY(run_id) REFERENCES runs(run_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_unit_test_results_run ON unit_test_results(run_id, result_id);
+	CREATE TABLE IF NOT EXISTS invitations (
+		invite_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		inviter_id INTEGER,
+		role TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		responded_at TEXT,
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id),
+		FOREIGN KEY(user_id) REFERENCES users(user_id),
+		FOREIGN KEY(inviter_id) REFERENCES users(user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_invitations_user ON invitations(user_id, status);
+	CREATE INDEX IF NOT EXISTS idx_invitations_session ON invitations(session_id, status);
+	CREATE TABLE IF NOT EXISTS share_links (
+		link_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		created_by INTEGER,
+		created_at TEXT NOT NULL,
+		expires_at TEXT,
+		max_uses INTEGER NOT NULL DEFAULT 0,
+		uses INTEGER NOT NULL DEFAULT 0,
+		nonce TEXT NOT NULL,
+		revoked BOOLEAN NOT NULL DEFAULT 0,
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id),
+		FOREIGN KEY(created_by) REFERENCES users(user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_share_links_session ON share_links(session_id, link_id);
+	CREATE TABLE IF NOT EXISTS orgs (
+		org_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		default_role TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS org_members (
+		org_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL DEFAULT 'member',
+		PRIMARY KEY (org_id, user_id),
+		FOREIGN KEY(org_id) REFERENCES orgs(org_id),
+		FOREIGN KEY(user_id) REFERENCES users(user_id)
+	);
+`
+
 func main() {
 	var err error
 	dbPath := os.Getenv("DB_PATH")
@@ -25,31 +187,48 @@ func main() {
 	}
 
 	// Create tables if not exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			user_id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL
-		);
-		CREATE TABLE IF NOT EXISTS sessions (
-			session_id INTEGER PRIMARY KEY AUTOINCREMENT,
-			owner_id INTEGER NOT NULL,
-			language TEXT,
-			project_name TEXT,
-			content TEXT DEFAULT '',
-			FOREIGN KEY(owner_id) REFERENCES users(user_id)
-		);
-		CREATE TABLE IF NOT EXISTS collabs (
-			session_id INTEGER NOT NULL,
-			user_id INTEGER NOT NULL,
-			PRIMARY KEY (session_id, user_id),
-			FOREIGN KEY(user_id) REFERENCES users(user_id),
-			FOREIGN KEY(session_id) REFERENCES sessions(session_id)
-		);
-	`)
+	_, err = db.Exec(schema)
 	if err != nil {
 		log.Fatal("Error creating tables:", err)
 	}
+	// Columns added after the first release
+	for _, c := range [][3]string{
+		{"sessions", "ydoc", "BLOB"},
+		{"sessions", "entry_file_id", "INTEGER"},
+		{"session_versions", "file_id", "INTEGER"},
+		{"sessions", "run_limits", "TEXT"},
+		{"sessions", "lint_settings", "TEXT"},
+		{"collabs", "role", "TEXT NOT NULL DEFAULT 'editor'"},
+		{"sessions", "public", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"sessions", "org_id", "INTEGER"},
+		{"runs", "limit_hit", "TEXT NOT NULL DEFAULT ''"},
+		{"runs", "tests_total", "INTEGER NOT NULL DEFAULT 0"},
+		{"runs", "tests_passed", "INTEGER NOT NULL DEFAULT 0"},
+		{"runs", "test_tool", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err = addColumn(c[0], c[1], c[2]); err != nil {
+			log.Fatal("Error migrating tables:", err)
+		}
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_session_versions_file ON session_versions(file_id, version_id)")
+	if err != nil {
+		log.Fatal("Error migrating tables:", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_sessions_org ON sessions(org_id)")
+	if err != nil {
+		log.Fatal("Error migrating tables:", err)
+	}
+	if err = migrateSessionFiles(); err != nil {
+		log.Fatal("Error migrating sessions to files:", err)
+	}
+
+	if err = loadRunnerConfig(os.Getenv("RUNNER_CONFIG")); err != nil {
+		log.Fatal("Error loading runner config:", err)
+	}
+	if _, ok := backend.(dockerRunner); ok {
+		pool.removeStale()
+		images.update(false)
+	}
 
 	// Load templates
 	templates, err = template.ParseGlob("templates/*.html")
@@ -63,13 +242,78 @@ func main() {
 	http.HandleFunc("/logout", logoutHandler)
 	http.HandleFunc("/create-session", createSessionHandler)
 	http.HandleFunc("/add-collab", addCollabHandler)
+	http.HandleFunc("/session-collabs", sessionCollabsHandler)
+	http.HandleFunc("/set-collab-role", setCollabRoleHandler)
+	http.HandleFunc("/remove-collab", removeCollabHandler)
+	http.HandleFunc("/leave-session", leaveSessionHandler)
+	http.HandleFunc("/transfer-ownership", transferOwnershipHandler)
+	http.HandleFunc("/invitations", invitationsHandler)
+	http.HandleFunc("/session-invitations", sessionInvitationsHandler)
+	http.HandleFunc("/accept-invitation", acceptInvitationHandler)
+	http.HandleFunc("/decline-invitation", declineInvitationHandler)
+	http.HandleFunc("/revoke-invitation", revokeInvitationHandler)
+	http.HandleFunc("/share-links", shareLinksHandler)
+	http.HandleFunc("/create-share-link", createShareLinkHandler)
+	http.HandleFunc("/revoke-share-link", revokeShareLinkHandler)
+	http.HandleFunc("/join", joinHandler)
+	http.HandleFunc("/session-viewers", sessionViewersHandler)
+	http.HandleFunc("/set-session-public", setSessionPublicHandler)
+	http.HandleFunc("/orgs", orgsHandler)
+	http.HandleFunc("/create-org", createOrgHandler)
+	http.HandleFunc("/org-members", orgMembersHandler)
+	http.HandleFunc("/add-org-member", addOrgMemberHandler)
+	http.HandleFunc("/set-org-member-role", setOrgMemberRoleHandler)
+	http.HandleFunc("/remove-org-member", removeOrgMemberHandler)
+	http.HandleFunc("/leave-org", leaveOrgHandler)
+	http.HandleFunc("/set-org-default-role", setOrgDefaultRoleHandler)
 	http.HandleFunc("/editor", editorHandler)
 	http.HandleFunc("/interpret", interpretHandler)
 	http.HandleFunc("/delete-session", deleteSessionHandler)
 	http.HandleFunc("/save-session", saveSessionHandler)
-	//http.HandleFunc("/ws", serveYjsWs)
+	http.HandleFunc("/session-versions", sessionVersionsHandler)
+	http.HandleFunc("/session-version", sessionVersionHandler)
+	http.HandleFunc("/diff-versions", diffVersionsHandler)
+	http.HandleFunc("/restore-version", restoreVersionHandler)
+	http.HandleFunc("/create-snapshot", createSnapshotHandler)
+	http.HandleFunc("/files", sessionFilesHandler)
+	http.HandleFunc("/create-file", createFileHandler)
+	http.HandleFunc("/rename-file", renameFileHandler)
+	http.HandleFunc("/move-folder", moveFolderHandler)
+	http.HandleFunc("/delete-file", deleteFileHandler)
+	http.HandleFunc("/set-entrypoint", setEntrypointHandler)
+	http.HandleFunc("/ws", serveYjsWs)
+	http.HandleFunc("/run-ws", serveRunWs)
+	http.HandleFunc("/lsp-ws", serveLanguageServerWs)
+	http.HandleFunc("/session-runs", sessionRunsHandler)
+	http.HandleFunc("/session-run", sessionRunHandler)
+	http.HandleFunc("/session-limits", sessionLimitsHandler)
+	http.HandleFunc("/test-cases", testCasesHandler)
+	http.HandleFunc("/create-test-case", createTestCaseHandler)
+	http.HandleFunc("/update-test-case", updateTestCaseHandler)
+	http.HandleFunc("/delete-test-case", deleteTestCaseHandler)
+	http.HandleFunc("/run-tests", runTestsHandler)
+	http.HandleFunc("/run-unit-tests", runUnitTestsHandler)
+	http.HandleFunc("/format", formatHandler)
+	http.HandleFunc("/lint", lintHandler)
+	http.HandleFunc("/session-linters", sessionLintersHandler)
+	http.HandleFunc("/runner-images", runnerImagesHandler)
+	http.HandleFunc("/update-runner-images", updateRunnerImagesHandler)
+	http.HandleFunc("/runner-pool", runnerPoolHandler)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
+	go persistRooms(docPersistInterval)
+
 	log.Println("Server started on http://localhost:8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
+
+// addColumn adds a column to a table created by an older version of the schema
+func addColumn(table, column, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
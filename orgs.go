@@ -0,0 +1,478 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Roles of the members of an organization. Admins and the owner own all
+// sessions of the organization, members get its default role in them.
+const (
+	orgRoleMember = "member"
+	orgRoleAdmin  = "admin" // also adds and removes members and sets the default role
+	orgRoleOwner  = "owner" // also makes members admins and back
+)
+
+var orgRoleRanks = map[string]int{orgRoleMember: 1, orgRoleAdmin: 2, orgRoleOwner: 3}
+
+// orgDefaultRoles are the roles members may get in the sessions of an
+// organization by default, "" for no access
+var orgDefaultRoles = []string{"", roleViewer, roleEditor, roleMaintainer}
+
+var errOrgNotFound = errors.New("organization not found")
+
+// Org is an organization as seen by one of its members
+type Org struct {
+	OrgID       int    `json:"org_id"`
+	Name        string `json:"name"`
+	DefaultRole string `json:"default_role"` // of members in its sessions, "" for none
+	Role        string `json:"role"`         // of the user in the organization
+}
+
+type OrgMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// orgRole returns the role of username in the organization, "" if they are
+// not a member
+func orgRole(orgID int, username string) (string, error) {
+	var role string
+	err := db.QueryRow(`SELECT COALESCE((SELECT m.role FROM org_members m JOIN users u ON m.user_id = u.user_id
+		WHERE m.org_id = o.org_id AND u.username = ?), '') FROM orgs o WHERE o.org_id = ?`, username, orgID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errOrgNotFound
+	}
+	return role, err
+}
+
+// orgSessionRole returns the role that membership in the organization gives
+// username in its sessions, "" for none
+func orgSessionRole(orgID int, username string) (string, error) {
+	var role, defaultRole string
+	err := db.QueryRow(`SELECT m.role, o.default_role FROM org_members m
+		JOIN orgs o ON m.org_id = o.org_id JOIN users u ON m.user_id = u.user_id
+		WHERE m.org_id = ? AND u.username = ?`, orgID, username).Scan(&role, &defaultRole)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if orgRoleRanks[role] >= orgRoleRanks[orgRoleAdmin] {
+		return roleOwner, nil
+	}
+	return defaultRole, nil
+}
+
+// sessionOrg returns the organization that owns the session, 0 for personal sessions
+func sessionOrg(sessionID int) (int, error) {
+	var orgID sql.NullInt64
+	err := db.QueryRow("SELECT org_id FROM sessions WHERE session_id = ?", sessionID).Scan(&orgID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errSessionNotFound
+	}
+	return int(orgID.Int64), err
+}
+
+// orgMemberOfSession tells whether username belongs to the organization that
+// owns the session, and so has access through it rather than as a collaborator
+func orgMemberOfSession(sessionID int, username string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sessions s JOIN org_members m ON m.org_id = s.org_id
+		JOIN users u ON m.user_id = u.user_id WHERE s.session_id = ? AND u.username = ?`, sessionID, username).Scan(&n)
+	return n > 0, err
+}
+
+// userOrgs returns the organizations username belongs to, by name
+func userOrgs(username string) ([]Org, error) {
+	rows, err := db.Query(`SELECT o.org_id, o.name, o.default_role, m.role FROM orgs o
+		JOIN org_members m ON m.org_id = o.org_id JOIN users u ON m.user_id = u.user_id
+		WHERE u.username = ? ORDER BY o.name`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orgs := []Org{}
+	for rows.Next() {
+		var o Org
+		if err := rows.Scan(&o.OrgID, &o.Name, &o.DefaultRole, &o.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// orgMembers returns the members of an organization, by username
+func orgMembers(orgID int) ([]OrgMember, error) {
+	rows, err := db.Query(`SELECT u.username, m.role FROM org_members m JOIN users u ON m.user_id = u.user_id
+		WHERE m.org_id = ? ORDER BY u.username`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := []OrgMember{}
+	for rows.Next() {
+		var m OrgMember
+		if err := rows.Scan(&m.Username, &m.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// disconnectFromOrg closes the live connections of the users to the sessions
+// of an organization, after their access to them changed
+func disconnectFromOrg(orgID int, usernames ...string) error {
+	rows, err := db.Query("SELECT session_id FROM sessions WHERE org_id = ?", orgID)
+	if err != nil {
+		return err
+	}
+	var sids []int
+	for rows.Next() {
+		var sid int
+		if err := rows.Scan(&sid); err != nil {
+			rows.Close()
+			return err
+		}
+		sids = append(sids, sid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, sid := range sids {
+		for _, username := range usernames {
+			disconnectUser(sid, username)
+		}
+	}
+	return nil
+}
+
+// orgAccess authenticates a request about the organization given by orgID
+// and checks that the user has at least the role min in it. On failure it
+// writes the error response and returns ok == false.
+func orgAccess(w http.ResponseWriter, r *http.Request, orgID string, min string) (username string, oid int, role string, ok bool) {
+	username, err := authFromJwt(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", 0, "", false
+	}
+	oid, err = strconv.Atoi(orgID)
+	if err != nil {
+		http.Error(w, "Invalid org_id", http.StatusBadRequest)
+		return "", 0, "", false
+	}
+	role, err = orgRole(oid, username)
+	switch {
+	case errors.Is(err, errOrgNotFound):
+		http.Error(w, "Organization not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "DB error", http.StatusInternalServerError)
+	case role == "":
+		http.Error(w, "Access denied", http.StatusForbidden)
+	case orgRoleRanks[role] < orgRoleRanks[min]:
+		http.Error(w, "Access denied: this needs the "+min+" role in the organization", http.StatusForbidden)
+	default:
+		return username, oid, role, true
+	}
+	return "", 0, "", false
+}
+
+// orgMemberTarget reads the username form value of a request about a member
+// of the organization and returns their role, reporting errors itself
+func orgMemberTarget(w http.ResponseWriter, r *http.Request, orgID int) (string, string, bool) {
+	member := strings.TrimSpace(r.FormValue("username"))
+	role, err := orgRole(orgID, member)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return "", "", false
+	}
+	if role == "" {
+		http.Error(w, "Not a member of this organization", http.StatusNotFound)
+		return "", "", false
+	}
+	return member, role, true
+}
+
+// orgsHandler lists the organizations of the user
+func orgsHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := authFromJwt(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	orgs, err := userOrgs(username)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, orgs)
+}
+
+// createOrgHandler creates an organization owned by the user, whose members
+// get the posted default_role in its sessions
+func createOrgHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := authFromJwt(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	o := Org{Name: strings.TrimSpace(r.FormValue("name")), DefaultRole: r.FormValue("default_role"), Role: orgRoleOwner}
+	if o.Name == "" {
+		http.Error(w, "Organization name required", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(orgDefaultRoles, o.DefaultRole) {
+		http.Error(w, "Invalid default_role", http.StatusBadRequest)
+		return
+	}
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM orgs WHERE name = ?", o.Name).Scan(&exists); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if exists > 0 {
+		http.Error(w, "Organization already exists. Please choose another name.", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO orgs(name, default_role, created_at) VALUES (?, ?, ?)",
+		o.Name, o.DefaultRole, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	o.OrgID = int(id)
+	_, err = tx.Exec(`INSERT INTO org_members(org_id, user_id, role)
+		VALUES (?, (SELECT user_id FROM users WHERE username = ?), ?)`, o.OrgID, username, orgRoleOwner)
+	if err != nil || tx.Commit() != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, o)
+}
+
+// orgMembersHandler lists the members of an organization for its members
+func orgMembersHandler(w http.ResponseWriter, r *http.Request) {
+	_, oid, _, ok := orgAccess(w, r, r.URL.Query().Get("org_id"), orgRoleMember)
+	if !ok {
+		return
+	}
+	members, err := orgMembers(oid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, members)
+}
+
+// addOrgMemberHandler adds a user to an organization. Admins add members,
+// the owner also admins.
+func addOrgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, oid, actor, ok := orgAccess(w, r, r.FormValue("org_id"), orgRoleAdmin)
+	if !ok {
+		return
+	}
+	m := OrgMember{Username: strings.TrimSpace(r.FormValue("username")), Role: r.FormValue("role")}
+	if m.Role == "" {
+		m.Role = orgRoleMember
+	}
+	if m.Role != orgRoleMember && m.Role != orgRoleAdmin {
+		http.Error(w, "Invalid role: members are "+orgRoleMember+" or "+orgRoleAdmin, http.StatusBadRequest)
+		return
+	}
+	if m.Role == orgRoleAdmin && actor != orgRoleOwner {
+		http.Error(w, "Access denied: only the owner of the organization adds admins", http.StatusForbidden)
+		return
+	}
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM users WHERE username = ?", m.Username).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	res, err := db.Exec("INSERT OR IGNORE INTO org_members(org_id, user_id, role) VALUES (?, ?, ?)", oid, userID, m.Role)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, m.Username+" is a member already", http.StatusBadRequest)
+		return
+	}
+	// Collaborators who join the organization now get at least its default
+	// role in its sessions
+	if err := disconnectFromOrg(oid, m.Username); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, m)
+}
+
+// setOrgMemberRoleHandler lets the owner make a member an admin or back
+func setOrgMemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, oid, _, ok := orgAccess(w, r, r.FormValue("org_id"), orgRoleOwner)
+	if !ok {
+		return
+	}
+	role := r.FormValue("role")
+	if role != orgRoleMember && role != orgRoleAdmin {
+		http.Error(w, "Invalid role: members are "+orgRoleMember+" or "+orgRoleAdmin, http.StatusBadRequest)
+		return
+	}
+	member, current, ok := orgMemberTarget(w, r, oid)
+	if !ok {
+		return
+	}
+	if current == orgRoleOwner {
+		http.Error(w, "The owner of the organization keeps their role", http.StatusBadRequest)
+		return
+	}
+	_, err := db.Exec(`UPDATE org_members SET role = ? WHERE org_id = ?
+		AND user_id = (SELECT user_id FROM users WHERE username = ?)`, role, oid, member)
+	if err == nil {
+		err = disconnectFromOrg(oid, member)
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, OrgMember{Username: member, Role: role})
+}
+
+// removeOrgMember takes username out of an organization and closes their
+// live connections to its sessions. Their collaborator roles in them go too,
+// like the maintainer role of the sessions they created.
+func removeOrgMember(orgID int, username string) error {
+	_, err := db.Exec(`DELETE FROM org_members WHERE org_id = ?
+		AND user_id = (SELECT user_id FROM users WHERE username = ?)`, orgID, username)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM collabs WHERE session_id IN (SELECT session_id FROM sessions WHERE org_id = ?)
+		AND user_id = (SELECT user_id FROM users WHERE username = ?)`, orgID, username)
+	if err != nil {
+		return err
+	}
+	return disconnectFromOrg(orgID, username)
+}
+
+// removeOrgMemberHandler takes a member out of an organization. Admins may
+// remove members, the owner also admins.
+func removeOrgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, oid, actor, ok := orgAccess(w, r, r.FormValue("org_id"), orgRoleAdmin)
+	if !ok {
+		return
+	}
+	member, current, ok := orgMemberTarget(w, r, oid)
+	if !ok {
+		return
+	}
+	if orgRoleRanks[current] >= orgRoleRanks[actor] {
+		http.Error(w, "Access denied: your role cannot remove a "+current, http.StatusForbidden)
+		return
+	}
+	if err := removeOrgMember(oid, member); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Member removed"))
+}
+
+// leaveOrgHandler takes the user out of an organization. Its owner stays.
+func leaveOrgHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, oid, role, ok := orgAccess(w, r, r.FormValue("org_id"), orgRoleMember)
+	if !ok {
+		return
+	}
+	if role == orgRoleOwner {
+		http.Error(w, "The owner cannot leave the organization", http.StatusBadRequest)
+		return
+	}
+	if err := removeOrgMember(oid, username); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Left the organization"))
+}
+
+// setOrgDefaultRoleHandler changes the role members get in the sessions of an
+// organization by default. Members reconnect with their new role.
+func setOrgDefaultRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, oid, role, ok := orgAccess(w, r, r.FormValue("org_id"), orgRoleAdmin)
+	if !ok {
+		return
+	}
+	defaultRole := r.FormValue("default_role")
+	if !slices.Contains(orgDefaultRoles, defaultRole) {
+		http.Error(w, "Invalid default_role", http.StatusBadRequest)
+		return
+	}
+	if _, err := db.Exec("UPDATE orgs SET default_role = ? WHERE org_id = ?", defaultRole, oid); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	members, err := orgMembers(oid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var usernames []string
+	for _, m := range members {
+		if m.Role == orgRoleMember {
+			usernames = append(usernames, m.Username)
+		}
+	}
+	if err := disconnectFromOrg(oid, usernames...); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var o Org
+	err = db.QueryRow("SELECT org_id, name, default_role FROM orgs WHERE org_id = ?", oid).Scan(&o.OrgID, &o.Name, &o.DefaultRole)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	o.Role = role
+	writeJSON(w, o)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Warm containers run idle until a run takes them, so the run skips
+// container startup. Each serves a single run and is then removed and replaced.
+const warmLabel = "cocode-warm"
+
+// warmContainer is a started runner container waiting for a run. It mounts
+// dir read-only where cold runs mount the project, and the run's project is
+// copied there, so a run sees the same files either way.
+type warmContainer struct {
+	name     string
+	language string
+	limits   Limits
+	dir      string
+}
+
+// warmPool keeps up to RunnerConfig.Pool containers ready per language. Only
+// runs with the default limits of their language can use them, others start
+// a container of their own.
+type warmPool struct {
+	mu       sync.Mutex
+	size     map[string]int
+	idle     map[string][]*warmContainer
+	starting map[string]int
+	hits     map[string]int
+	misses   map[string]int
+}
+
+var pool = &warmPool{
+	size:     map[string]int{},
+	idle:     map[string][]*warmContainer{},
+	starting: map[string]int{},
+	hits:     map[string]int{},
+	misses:   map[string]int{},
+}
+
+// poolLimits are the limits warm containers of the language are started with
+func poolLimits(language string) Limits {
+	return runners[language].Limits.clamp(runnerConfig.Max)
+}
+
+// configure sets how many warm containers to keep for each language
+func (p *warmPool) configure(size map[string]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for language, n := range size {
+		p.size[language] = max(n, 0)
+	}
+}
+
+// removeStale removes warm containers and their directories left behind by
+// an earlier process
+func (p *warmPool) removeStale() {
+	out, err := exec.Command("docker", "ps", "-aq", "--filter", "label="+warmLabel).Output()
+	if err != nil {
+		return
+	}
+	if ids := strings.Fields(string(out)); len(ids) > 0 {
+		exec.Command("docker", append([]string{"rm", "-f"}, ids...)...).Run()
+	}
+	dirs, _ := filepath.Glob(filepath.Join(os.TempDir(), warmLabel+"-*"))
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// fill starts containers in the background until the pool of the language
+// is full. The runner image must be ready.
+func (p *warmPool) fill(language string) {
+	p.mu.Lock()
+	missing := p.size[language] - len(p.idle[language]) - p.starting[language]
+	p.starting[language] += max(missing, 0)
+	p.mu.Unlock()
+	for range missing {
+		go p.start(language)
+	}
+}
+
+func (p *warmPool) start(language string) {
+	c := &warmContainer{
+		name:     "cocode-warm-" + strings.ToLower(rand.Text()),
+		language: language,
+		limits:   poolLimits(language),
+	}
+	dir, err := os.MkdirTemp("", warmLabel+"-*")
+	if err == nil {
+		c.dir = dir
+		// The runner user of the image reads it
+		err = os.Chmod(dir, 0o755)
+	}
+	if err == nil {
+		args := append([]string{"run", "-d", "--rm", "--name", c.name, "--label", warmLabel}, c.limits.dockerArgs()...)
+		args = append(args, "-v", dir+":"+sandboxProjectDir+":ro", runners[language].Image, "tail", "-f", "/dev/null")
+		err = exec.Command("docker", args...).Run()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starting[language]--
+	if err != nil {
+		log.Printf("pool: starting %s container: %v", language, err)
+		if c.dir != "" {
+			os.RemoveAll(c.dir)
+		}
+		return
+	}
+	p.idle[language] = append(p.idle[language], c)
+}
+
+// take hands out a warm container for a run of the language with limits, or
+// nil if there is none, and starts its replacement. A miss starts the
+// containers missing as well, so a pool whose containers failed to start
+// refills. The caller records whether the container could be used.
+func (p *warmPool) take(language string, limits Limits) *warmContainer {
+	p.mu.Lock()
+	if p.size[language] == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	idle := p.idle[language]
+	if len(idle) == 0 || limits != poolLimits(language) {
+		p.misses[language]++
+		p.mu.Unlock()
+		p.fill(language)
+		return nil
+	}
+	c := idle[0]
+	p.idle[language] = idle[1:]
+	p.mu.Unlock()
+	p.fill(language)
+	return c
+}
+
+// record counts a run that took a warm container as a hit, or as a miss if
+// the project could not be loaded into it
+func (p *warmPool) record(language string, hit bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if hit {
+		p.hits[language]++
+	} else {
+		p.misses[language]++
+	}
+}
+
+// refresh replaces the idle containers of the language, after its image was rebuilt
+func (p *warmPool) refresh(language string) {
+	p.mu.Lock()
+	idle := p.idle[language]
+	p.idle[language] = nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.remove()
+	}
+	p.fill(language)
+}
+
+func (c *warmContainer) remove() {
+	exec.Command("docker", "rm", "-f", c.name).Run()
+	os.RemoveAll(c.dir)
+}
+
+// load copies the project in dir into the directory the container mounts
+func (c *warmContainer) load(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		target := filepath.Join(c.dir, rel)
+		if d.IsDir() {
+			return os.Mkdir(target, 0o755)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, 0o644)
+	})
+}
+
+// command runs the spec in the container. Cancelling ctx removes the
+// container, which kills the program with it.
+func (c *warmContainer) command(ctx context.Context, s *runSpec) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "docker", "exec", "-i", "-w", sandboxProjectDir, c.name,
+		"sh", "-c", s.script(), "sh", "./"+s.entry.Path)
+	cmd.Cancel = func() error {
+		c.remove()
+		return cmd.Process.Kill()
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+type PoolStatus struct {
+	Language string `json:"language"`
+	Size     int    `json:"size"`
+	Idle     int    `json:"idle"`
+	Starting int    `json:"starting"`
+	Hits     int    `json:"hits"`
+	Misses   int    `json:"misses"`
+}
+
+// runnerPoolHandler reports the warm pool of every language that has one
+func runnerPoolHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := authFromJwt(r); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	list := []PoolStatus{}
+	for language, size := range pool.size {
+		list = append(list, PoolStatus{
+			Language: language,
+			Size:     size,
+			Idle:     len(pool.idle[language]),
+			Starting: pool.starting[language],
+			Hits:     pool.hits[language],
+			Misses:   pool.misses[language],
+		})
+	}
+	slices.SortFunc(list, func(a, b PoolStatus) int { return cmp.Compare(a.Language, b.Language) })
+	writeJSON(w, list)
+}
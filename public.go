@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// sessionPublic tells whether anyone with the URL may watch the session
+func sessionPublic(sessionID int) (bool, error) {
+	var public bool
+	err := db.QueryRow("SELECT public FROM sessions WHERE session_id = ?", sessionID).Scan(&public)
+	return public, err
+}
+
+// sessionViewerRole is sessionRole for watching a session: everyone, even
+// visitors without an account whose username is empty, views public sessions
+func sessionViewerRole(sessionID int, username string) (string, error) {
+	role, err := sessionRole(sessionID, username)
+	if !errors.Is(err, errAccessDenied) {
+		return role, err
+	}
+	public, err := sessionPublic(sessionID)
+	if err != nil {
+		return "", err
+	}
+	if !public {
+		return "", errAccessDenied
+	}
+	return roleViewer, nil
+}
+
+// viewerAccess is sessionAccess for the live document and run console,
+// which public sessions show to everyone. It also returns the role.
+func viewerAccess(w http.ResponseWriter, r *http.Request, sessionID string) (username string, sid int, role string, ok bool) {
+	username, _ = authFromJwt(r)
+	sid, err := strconv.Atoi(sessionID)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return "", 0, "", false
+	}
+	role, err = sessionViewerRole(sid, username)
+	if errors.Is(err, errAccessDenied) && username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", 0, "", false
+	} else if err != nil {
+		writeAccessError(w, err)
+		return "", 0, "", false
+	}
+	return username, sid, role, true
+}
+
+// SessionViewers is who watches a session without being part of it
+type SessionViewers struct {
+	Public    bool `json:"public"`
+	Anonymous int  `json:"anonymous_viewers"` // open documents of visitors without an account
+}
+
+// anonymousViewers counts the documents of the session that visitors
+// without an account have open
+func anonymousViewers(sessionID int) int {
+	n := 0
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	for _, room := range rooms {
+		if room.sessionID != sessionID {
+			continue
+		}
+		room.mu.Lock()
+		for c := range room.conns {
+			if c.username == "" {
+				n++
+			}
+		}
+		room.mu.Unlock()
+	}
+	return n
+}
+
+// sessionViewersHandler tells whether a session is public and how many
+// anonymous viewers it has
+func sessionViewersHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	public, err := sessionPublic(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SessionViewers{Public: public, Anonymous: anonymousViewers(sid)})
+}
+
+// setSessionPublicHandler lets the owner make a session public or private.
+// Viewers who are not part of the session are disconnected when it turns
+// private.
+func setSessionPublicHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleOwner)
+	if !ok {
+		return
+	}
+	public := r.FormValue("public") == "true"
+	if _, err := db.Exec("UPDATE sessions SET public = ? WHERE session_id = ?", public, sid); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if !public {
+		disconnectOutsiders(sid)
+	}
+	writeJSON(w, SessionViewers{Public: public, Anonymous: anonymousViewers(sid)})
+}
+
+// disconnectOutsiders closes the live connections of everyone watching the
+// session who is not its owner or a collaborator
+func disconnectOutsiders(sessionID int) {
+	usernames := make(map[string]bool)
+	roomsMu.Lock()
+	for _, room := range rooms {
+		if room.sessionID != sessionID {
+			continue
+		}
+		room.mu.Lock()
+		for c := range room.conns {
+			usernames[c.username] = true
+		}
+		room.mu.Unlock()
+	}
+	roomsMu.Unlock()
+	consolesMu.Lock()
+	console := consoles[sessionID]
+	consolesMu.Unlock()
+	if console != nil {
+		console.mu.Lock()
+		for c := range console.conns {
+			usernames[c.username] = true
+		}
+		console.mu.Unlock()
+	}
+	for username := range usernames {
+		if _, err := sessionRole(sessionID, username); errors.Is(err, errAccessDenied) {
+			disconnectUser(sessionID, username)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// QueueConfig bounds how many runs the host executes at once. It is part of
+// the admin RunnerConfig.
+type QueueConfig struct {
+	Workers       int `json:"workers"`         // runs at the same time
+	MaxQueued     int `json:"max_queued"`      // runs waiting for a worker
+	PerUser       int `json:"per_user"`        // runs of one user at the same time
+	PerSession    int `json:"per_session"`     // runs of one session at the same time
+	QueuedPerUser int `json:"queued_per_user"` // runs of one user waiting
+}
+
+var (
+	errQueueFull     = errors.New("Too many runs are waiting, try again later")
+	errTooManyQueued = errors.New("You already have runs waiting, wait for them or cancel one")
+)
+
+// queuedRun is a run waiting in the queue for a worker
+type queuedRun struct {
+	user      string
+	sessionID int
+	start     chan struct{} // closed when the run may start
+	position  func(int)     // called when its place in the queue changes
+	lastPos   int
+}
+
+// runQueue hands out workers to runs. Waiting runs are served round robin by
+// user, so one user starting many runs delays only their own.
+type runQueue struct {
+	mu        sync.Mutex
+	cfg       QueueConfig
+	running   int
+	byUser    map[string]int
+	bySession map[int]int
+	waiting   map[string][]*queuedRun // per user, oldest first
+	users     []string                // users with waiting runs, next to be served first
+	queued    int
+}
+
+var queue = &runQueue{
+	cfg: QueueConfig{
+		Workers:       runtime.NumCPU(),
+		MaxQueued:     100,
+		PerUser:       2,
+		PerSession:    2,
+		QueuedPerUser: 3,
+	},
+	byUser:    map[string]int{},
+	bySession: map[int]int{},
+	waiting:   map[string][]*queuedRun{},
+}
+
+// configure replaces the limits of the queue with those set in cfg
+func (q *runQueue) configure(cfg QueueConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, f := range []struct{ dest, v *int }{
+		{&q.cfg.Workers, &cfg.Workers},
+		{&q.cfg.MaxQueued, &cfg.MaxQueued},
+		{&q.cfg.PerUser, &cfg.PerUser},
+		{&q.cfg.PerSession, &cfg.PerSession},
+		{&q.cfg.QueuedPerUser, &cfg.QueuedPerUser},
+	} {
+		if *f.v > 0 {
+			*f.dest = *f.v
+		}
+	}
+}
+
+// acquire waits for a worker for a run of user in the session and returns the
+// function that gives it back. While the run waits, position is told its
+// place in the queue, starting at 1. Cancelling ctx takes the run out of the queue.
+func (q *runQueue) acquire(ctx context.Context, user string, sessionID int, position func(int)) (release func(), err error) {
+	q.mu.Lock()
+	if q.queued >= q.cfg.MaxQueued {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+	if len(q.waiting[user]) >= q.cfg.QueuedPerUser {
+		q.mu.Unlock()
+		return nil, errTooManyQueued
+	}
+	job := &queuedRun{user: user, sessionID: sessionID, start: make(chan struct{}), position: position}
+	if len(q.waiting[user]) == 0 {
+		q.users = append(q.users, user)
+	}
+	q.waiting[user] = append(q.waiting[user], job)
+	q.queued++
+	notify := q.dispatch()
+	q.mu.Unlock()
+	notify()
+
+	release = func() { q.release(job) }
+	select {
+	case <-job.start:
+		return release, nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	select {
+	case <-job.start:
+		// Started just as it was cancelled
+		q.mu.Unlock()
+		release()
+		return nil, ctx.Err()
+	default:
+	}
+	q.remove(job)
+	notify = q.dispatch()
+	q.mu.Unlock()
+	notify()
+	return nil, ctx.Err()
+}
+
+func (q *runQueue) release(job *queuedRun) {
+	q.mu.Lock()
+	q.running--
+	q.byUser[job.user]--
+	if q.byUser[job.user] == 0 {
+		delete(q.byUser, job.user)
+	}
+	q.bySession[job.sessionID]--
+	if q.bySession[job.sessionID] == 0 {
+		delete(q.bySession, job.sessionID)
+	}
+	notify := q.dispatch()
+	q.mu.Unlock()
+	notify()
+}
+
+// remove takes a waiting job out of the queue. q.mu must be held.
+func (q *runQueue) remove(job *queuedRun) {
+	jobs := slices.DeleteFunc(q.waiting[job.user], func(j *queuedRun) bool { return j == job })
+	q.queued--
+	if len(jobs) > 0 {
+		q.waiting[job.user] = jobs
+		return
+	}
+	delete(q.waiting, job.user)
+	q.users = slices.DeleteFunc(q.users, func(u string) bool { return u == job.user })
+}
+
+// dispatch starts waiting runs while workers are free, taking the oldest run
+// of each user in turn and skipping users and sessions at their cap. It
+// returns the function telling runs that are still waiting their new
+// position, to be called once q.mu is released. q.mu must be held.
+func (q *runQueue) dispatch() (notify func()) {
+	for i := 0; i < len(q.users) && q.running < q.cfg.Workers; {
+		user := q.users[i]
+		job := q.waiting[user][0]
+		if q.byUser[user] >= q.cfg.PerUser || q.bySession[job.sessionID] >= q.cfg.PerSession {
+			i++
+			continue
+		}
+		q.remove(job)
+		q.running++
+		q.byUser[user]++
+		q.bySession[job.sessionID]++
+		close(job.start)
+		// The user was served, so everyone else comes first next time
+		if len(q.waiting[user]) > 0 {
+			q.users = append(slices.Delete(q.users, i, i+1), user)
+		}
+		i = 0
+	}
+
+	// Positions follow the same round robin, ignoring the caps
+	var changed []*queuedRun
+	pos := 0
+	for round := 0; pos < q.queued; round++ {
+		for _, user := range q.users {
+			if jobs := q.waiting[user]; round < len(jobs) {
+				pos++
+				if job := jobs[round]; job.lastPos != pos {
+					job.lastPos = pos
+					changed = append(changed, job)
+				}
+			}
+		}
+	}
+	positions := make([]int, len(changed))
+	for i, job := range changed {
+		positions[i] = job.lastPos
+	}
+	return func() {
+		for i, job := range changed {
+			select {
+			case <-job.start:
+				// Started in the meantime, the position is stale
+			default:
+				if job.position != nil {
+					job.position(positions[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Roles of the collaborators of a session, from the one that may do the
+// least to the most. The owner is no collaborator and may do everything.
+const (
+	roleViewer     = "viewer"     // reads the session and follows edits and runs live
+	roleEditor     = "editor"     // also edits, saves, runs and tests it
+	roleMaintainer = "maintainer" // also adds collaborators and changes their roles
+	roleOwner      = "owner"
+)
+
+var roleRanks = map[string]int{roleViewer: 1, roleEditor: 2, roleMaintainer: 3, roleOwner: 4}
+
+// roleRequired is the error of a collaborator whose role does not allow
+// what they tried
+type roleRequired string
+
+func (r roleRequired) Error() string {
+	return "Access denied: this needs the " + string(r) + " role"
+}
+
+// atLeast tells whether role may do what min may
+func atLeast(role, min string) bool {
+	return roleRanks[role] >= roleRanks[min]
+}
+
+// sessionRole returns the role of username in the session, roleOwner for
+// its owner, and errAccessDenied for anyone else. Sessions of an organization
+// are owned by its admins, its members get at least its default role.
+func sessionRole(sessionID int, username string) (string, error) {
+	var owner string
+	var orgID sql.NullInt64
+	err := db.QueryRow(`SELECT u.username, s.org_id FROM sessions s JOIN users u ON s.owner_id = u.user_id WHERE s.session_id = ?`, sessionID).Scan(&owner, &orgID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errSessionNotFound
+	} else if err != nil {
+		return "", err
+	}
+	var role string
+	if orgID.Valid {
+		if role, err = orgSessionRole(int(orgID.Int64), username); err != nil {
+			return "", err
+		}
+	} else if owner == username {
+		return roleOwner, nil
+	}
+	// A collaborator role raises members of the organization above its default
+	var collab string
+	err = db.QueryRow(`SELECT c.role FROM collabs c JOIN users u ON c.user_id = u.user_id
+		WHERE c.session_id = ? AND u.username = ?`, sessionID, username).Scan(&collab)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if roleRanks[collab] > roleRanks[role] {
+		role = collab
+	}
+	if role == "" {
+		return "", errAccessDenied
+	}
+	return role, nil
+}
+
+// checkSessionRole verifies that username has at least the role min in the session
+func checkSessionRole(sessionID int, username, min string) error {
+	role, err := sessionRole(sessionID, username)
+	if err != nil {
+		return err
+	}
+	if !atLeast(role, min) {
+		return roleRequired(min)
+	}
+	return nil
+}
+
+// writeAccessError reports an error of sessionRole or checkSessionRole
+func writeAccessError(w http.ResponseWriter, err error) {
+	var required roleRequired
+	switch {
+	case errors.Is(err, errSessionNotFound):
+		http.Error(w, "Session not found", http.StatusNotFound)
+	case errors.Is(err, errAccessDenied):
+		http.Error(w, "Access denied", http.StatusForbidden)
+	case errors.As(err, &required):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, "DB error", http.StatusInternalServerError)
+	}
+}
+
+// grantableRoles are the roles someone with role may give collaborators,
+// and take away from them
+func grantableRoles(role string) []string {
+	switch role {
+	case roleOwner:
+		return []string{roleViewer, roleEditor, roleMaintainer}
+	case roleMaintainer:
+		return []string{roleViewer, roleEditor}
+	}
+	return nil
+}
+
+// canGrant tells whether someone with role may give a collaborator the role to
+func canGrant(role, to string) bool {
+	for _, r := range grantableRoles(role) {
+		if r == to {
+			return true
+		}
+	}
+	return false
+}
+
+type Collaborator struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	// Whether they have access as a member of the organization owning the
+	// session, which only the organization takes away
+	OrgMember bool `json:"org_member,omitempty"`
+}
+
+// sessionCollaborators returns everyone with access to a session: its owner
+// or the members of its organization, and the collaborators, highest role first
+func sessionCollaborators(sessionID int) ([]Collaborator, error) {
+	rows, err := db.Query(`SELECT u.username, 0 FROM sessions s JOIN users u ON s.owner_id = u.user_id
+		WHERE s.session_id = ? AND s.org_id IS NULL
+		UNION ALL
+		SELECT u.username, 1 FROM sessions s JOIN org_members m ON m.org_id = s.org_id JOIN users u ON m.user_id = u.user_id
+		WHERE s.session_id = ?
+		UNION ALL
+		SELECT u.username, 0 FROM collabs c JOIN users u ON c.user_id = u.user_id
+		WHERE c.session_id = ?`, sessionID, sessionID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Collaborator
+	for rows.Next() {
+		var c Collaborator
+		if err := rows.Scan(&c.Username, &c.OrgMember); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Members of the organization may be collaborators too, or have no
+	// access if it gives none by default
+	collabs := []Collaborator{}
+	seen := make(map[string]int)
+	for _, c := range candidates {
+		if i, ok := seen[c.Username]; ok {
+			collabs[i].OrgMember = collabs[i].OrgMember || c.OrgMember
+			continue
+		}
+		c.Role, err = sessionRole(sessionID, c.Username)
+		if errors.Is(err, errAccessDenied) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		seen[c.Username] = len(collabs)
+		collabs = append(collabs, c)
+	}
+	slices.SortStableFunc(collabs, func(a, b Collaborator) int { return roleRanks[b.Role] - roleRanks[a.Role] })
+	return collabs, nil
+}
+
+// sessionCollabsHandler lists who has access to a session and in which role
+func sessionCollabsHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	collabs, err := sessionCollaborators(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, collabs)
+}
+
+// setCollabRoleHandler changes the role of a collaborator. The owner may give
+// any role, maintainers may switch viewers and editors. Live connections of
+// the collaborator are dropped, the editor reconnects with the new role.
+func setCollabRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleMaintainer)
+	if !ok {
+		return
+	}
+	actor, err := sessionRole(sid, username)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	role := r.FormValue("role")
+	if _, known := roleRanks[role]; !known || role == roleOwner {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	collab, current, ok := collabTarget(w, r, sid)
+	if !ok {
+		return
+	}
+	if !canGrant(actor, current) || !canGrant(actor, role) {
+		http.Error(w, "Access denied: your role cannot change this", http.StatusForbidden)
+		return
+	}
+	// Members of the organization owning the session may have no
+	// collaborator role yet
+	_, err = db.Exec(`INSERT INTO collabs(session_id, user_id, role)
+		VALUES (?, (SELECT user_id FROM users WHERE username = ?), ?)
+		ON CONFLICT(session_id, user_id) DO UPDATE SET role = excluded.role`, sid, collab, role)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	disconnectUser(sid, collab)
+	// which never lowers them below the default role of the organization
+	if role, err = sessionRole(sid, collab); err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	writeJSON(w, Collaborator{Username: collab, Role: role})
+}
+
+// disconnectUser closes the live connections of username to the documents,
+// the run console and the language server of a session
+func disconnectUser(sessionID int, username string) {
+	roomsMu.Lock()
+	for _, room := range rooms {
+		if room.sessionID != sessionID {
+			continue
+		}
+		room.mu.Lock()
+		for c := range room.conns {
+			if c.username == username {
+				c.close()
+			}
+		}
+		room.mu.Unlock()
+	}
+	roomsMu.Unlock()
+
+	consolesMu.Lock()
+	console := consoles[sessionID]
+	consolesMu.Unlock()
+	if console != nil {
+		console.mu.Lock()
+		for c := range console.conns {
+			if c.username == username {
+				c.close()
+			}
+		}
+		console.mu.Unlock()
+	}
+
+	languageServersMu.Lock()
+	s := languageServers[sessionID]
+	languageServersMu.Unlock()
+	if s != nil {
+		s.mu.Lock()
+		for c := range s.clients {
+			if c.username == username {
+				c.close()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// collabTarget reads the username form value of a request about a
+// collaborator of the session and returns their role, reporting errors itself
+func collabTarget(w http.ResponseWriter, r *http.Request, sid int) (string, string, bool) {
+	collab := strings.TrimSpace(r.FormValue("username"))
+	role, err := sessionRole(sid, collab)
+	if errors.Is(err, errAccessDenied) {
+		http.Error(w, "Not a collaborator of this session", http.StatusNotFound)
+		return "", "", false
+	} else if err != nil {
+		writeAccessError(w, err)
+		return "", "", false
+	}
+	return collab, role, true
+}
+
+// removeCollab takes away the access of a collaborator and closes their live
+// connections to the session
+func removeCollab(sessionID int, username string) error {
+	_, err := db.Exec(`DELETE FROM collabs WHERE session_id = ?
+		AND user_id = (SELECT user_id FROM users WHERE username = ?)`, sessionID, username)
+	if err != nil {
+		return err
+	}
+	disconnectUser(sessionID, username)
+	return nil
+}
+
+// removeCollabHandler takes a collaborator off a session. The owner may
+// remove anyone, maintainers the viewers and editors.
+func removeCollabHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleMaintainer)
+	if !ok {
+		return
+	}
+	actor, err := sessionRole(sid, username)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	collab, current, ok := collabTarget(w, r, sid)
+	if !ok {
+		return
+	}
+	if !canGrant(actor, current) {
+		http.Error(w, "Access denied: your role cannot remove a "+current, http.StatusForbidden)
+		return
+	}
+	if viaOrg, err := orgMemberOfSession(sid, collab); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	} else if viaOrg {
+		http.Error(w, collab+" has access as a member of the organization owning this session", http.StatusBadRequest)
+		return
+	}
+	if err := removeCollab(sid, collab); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Collaborator removed"))
+}
+
+// leaveSessionHandler takes the user off a session they collaborate on. The
+// owner has to transfer the session first.
+func leaveSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionAccess(w, r, r.FormValue("session_id"))
+	if !ok {
+		return
+	}
+	role, err := sessionRole(sid, username)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	if viaOrg, err := orgMemberOfSession(sid, username); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	} else if viaOrg {
+		http.Error(w, "You have access as a member of the organization owning this session, leave the organization instead", http.StatusBadRequest)
+		return
+	}
+	if role == roleOwner {
+		http.Error(w, "The owner cannot leave the session, transfer it to a collaborator first", http.StatusBadRequest)
+		return
+	}
+	if err := removeCollab(sid, username); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Left the session"))
+}
+
+// transferOwnershipHandler makes a collaborator the owner of the session.
+// The previous owner stays on as a maintainer and can leave afterwards.
+// Sessions of an organization stay with it.
+func transferOwnershipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleOwner)
+	if !ok {
+		return
+	}
+	if orgID, err := sessionOrg(sid); err != nil {
+		writeAccessError(w, err)
+		return
+	} else if orgID != 0 {
+		http.Error(w, "This session belongs to an organization, its admins own it", http.StatusBadRequest)
+		return
+	}
+	collab, current, ok := collabTarget(w, r, sid)
+	if !ok {
+		return
+	}
+	if current == roleOwner {
+		http.Error(w, "You already own this session", http.StatusBadRequest)
+		return
+	}
+	if err := transferOwnership(sid, username, collab); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, Collaborator{Username: collab, Role: roleOwner})
+}
+
+// transferOwnership swaps the owner of a session with one of its collaborators
+func transferOwnership(sessionID int, owner, collab string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var ownerID, collabID int
+	if err := tx.QueryRow("SELECT user_id FROM users WHERE username = ?", owner).Scan(&ownerID); err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT user_id FROM users WHERE username = ?", collab).Scan(&collabID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE sessions SET owner_id = ? WHERE session_id = ?", collabID, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM collabs WHERE session_id = ? AND user_id = ?", sessionID, collabID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO collabs(session_id, user_id, role) VALUES (?, ?, ?)", sessionID, ownerID, roleMaintainer)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,157 @@
+package main
+
+// LanguageRunner describes how projects of one session language are
+// executed. Build and Run are shell snippets run inside the image, or the
+// local sandbox, from the project directory, with the entrypoint path as
+// "$1". Build is optional and its output is reported like the program's.
+// Test runs the language's own test tool instead, which writes its report to
+// stdout for the parser of TestTool and everything else to stderr. Format
+// reads the file "$1" from stdin and writes it formatted to stdout.
+type LanguageRunner struct {
+	Image    string   // docker image tag
+	Dir      string   // build context of the image
+	Build    string   // compile step, if any
+	Run      string   // command that starts the program
+	Test     string   // command that runs the project's unit tests, if supported
+	TestTool string   // name of the test tool, see unitTestParsers
+	Format   string   // command that formats a file, if supported
+	Errors   string   // format of compiler and runtime errors, see diagnosticParsers
+	Linters  []Linter // static analysis tools, in the order they run
+	// Language server speaking LSP on stdin and stdout, for the editor
+	LanguageServer string
+	Limits         Limits   // defaults for build and run together, see effectiveLimits
+	Tools          []string // programs the snippets need outside of docker
+	Env            []string // environment the image sets, for the local sandbox
+}
+
+// Linter is a static analysis tool of a language. Command runs in the project
+// like Build and Run, and its output is read in the Errors format.
+type Linter struct {
+	Name     string
+	Command  string
+	Errors   string // see diagnosticParsers
+	Severity string // of every finding, for tools that do not tell
+}
+
+// Limits of runners that only interpret code, and of those that compile it
+var (
+	interpretedLimits = Limits{TimeoutMs: 6000, MemoryMB: 256, CPUs: 0.5, Pids: 64, TmpfsMB: 64, OutputBytes: 1 << 20}
+	compiledLimits    = Limits{TimeoutMs: 15000, MemoryMB: 512, CPUs: 0.5, Pids: 128, TmpfsMB: 256, OutputBytes: 1 << 20}
+)
+
+// runners is keyed by the session Language value offered on the dashboard
+var runners = map[string]LanguageRunner{
+	"Python": {
+		Image: "cocode-python-runner:latest",
+		Dir:   "docker/python-runner",
+		Run:   `exec python -u "$1"`,
+		Test: `python -m pytest -q -p no:cacheprovider --junitxml=/tmp/report.xml >&2; status=$?; ` +
+			`cat /tmp/report.xml 2>/dev/null; exit $status`,
+		TestTool: "pytest",
+		// The root filesystem is read-only, black keeps its cache in /tmp
+		Format: `BLACK_CACHE_DIR=/tmp/black exec black -q --stdin-filename "$1" -`,
+		Errors: "python",
+		Linters: []Linter{
+			{Name: "ruff", Command: `exec ruff check --output-format concise --no-cache .`, Errors: "lint", Severity: severityWarning},
+			{Name: "pyflakes", Command: `exec python -m pyflakes .`, Errors: "lint", Severity: severityWarning},
+		},
+		LanguageServer: `exec pyright-langserver --stdio`,
+		Limits:         interpretedLimits,
+		Tools:          []string{"python"},
+		Env:            []string{"PYTHONUNBUFFERED=1"},
+	},
+	"Golang": {
+		Image: "cocode-go-runner:latest",
+		Dir:   "docker/go-runner",
+		// Projects with a go.mod are built as a module, loose files as the
+		// package in the entrypoint's directory
+		Build: `if [ -f go.mod ]; then go build -o /tmp/main "./$(dirname "$1")"; ` +
+			`else (cd "$(dirname "$1")" && go build -o /tmp/main $(ls *.go | grep -v '_test\.go$')); fi`,
+		Run: `exec /tmp/main`,
+		Test: `if [ -f go.mod ]; then go test -json ./...; ` +
+			`else cd "$(dirname "$1")" && go test -json $(ls *.go); fi`,
+		TestTool: "go test",
+		Format:   `exec gofmt`,
+		Errors:   "go",
+		Linters: []Linter{
+			{Name: "go vet", Command: `if [ -f go.mod ]; then go vet ./...; ` +
+				`else cd "$(dirname "$1")" && go vet $(ls *.go); fi`, Errors: "go", Severity: severityWarning},
+			{Name: "staticcheck", Command: `if [ -f go.mod ]; then staticcheck ./...; ` +
+				`else cd "$(dirname "$1")" && staticcheck $(ls *.go); fi`, Errors: "go", Severity: severityWarning},
+		},
+		LanguageServer: `exec gopls`,
+		Limits:         compiledLimits.overlay(Limits{TimeoutMs: 20000, Pids: 256}),
+		Tools:          []string{"go"},
+		Env:            []string{"GOCACHE=/tmp/go-cache", "GOPATH=/tmp/go", "GOTOOLCHAIN=local", "CGO_ENABLED=0"},
+	},
+	"JavaScript": {
+		Image: "cocode-node-runner:latest",
+		Dir:   "docker/node-runner",
+		Run:   `exec node "$1"`,
+		Test: `exec jest --ci --json --passWithNoTests --rootDir . --cacheDirectory /tmp/jest-cache ` +
+			`--watchman=false`,
+		TestTool: "jest",
+		Format:   `exec prettier --stdin-filepath "$1"`,
+		// Projects without an eslint config of their own get the recommended rules
+		Linters: []Linter{{Name: "eslint", Command: `if ls eslint.config.* >/dev/null 2>&1; then exec eslint -f json .; ` +
+			`else exec eslint -f json -c /opt/eslint/eslint.config.js .; fi`, Errors: "eslint"}},
+		LanguageServer: `exec typescript-language-server --stdio`,
+		Limits:         interpretedLimits,
+		Tools:          []string{"node"},
+	},
+	"C++": {
+		Image:  "cocode-cpp-runner:latest",
+		Dir:    "docker/cpp-runner",
+		Build:  `find . \( -name '*.cpp' -o -name '*.cc' \) -exec g++ -std=c++17 -O2 -o /tmp/main {} +`,
+		Run:    `exec /tmp/main`,
+		Format: `exec clang-format --assume-filename="$1"`,
+		Errors: "gcc",
+		Linters: []Linter{{Name: "g++ -Wall", Errors: "gcc",
+			Command: `find . \( -name '*.cpp' -o -name '*.cc' \) -exec g++ -std=c++17 -fsyntax-only -Wall -Wextra {} +`}},
+		Limits: compiledLimits,
+		Tools:  []string{"g++"},
+	},
+	"Java": {
+		Image: "cocode-java-runner:latest",
+		Dir:   "docker/java-runner",
+		Build: `find . -name '*.java' -exec javac -d /tmp/classes {} +`,
+		// The main class is the entrypoint file in its declared package
+		Run: `pkg=$(sed -n 's/^[[:space:]]*package[[:space:]]*\([A-Za-z0-9_.]*\)[[:space:]]*;.*/\1/p' "$1" | head -n 1); ` +
+			`cls=$(basename "$1" .java); exec java -cp /tmp/classes "${pkg:+$pkg.}$cls"`,
+		// Test classes are found on the class path by the JUnit console launcher
+		Test: `find . -name '*.java' -exec javac -cp /opt/junit/junit.jar -d /tmp/classes {} + && ` +
+			`java -jar /opt/junit/junit.jar execute --class-path /tmp/classes --scan-class-path ` +
+			`--disable-banner --reports-dir /tmp/reports >&2; status=$?; ` +
+			`cat /tmp/reports/TEST-*.xml 2>/dev/null; exit $status`,
+		TestTool: "JUnit",
+		Errors:   "javac",
+		Linters: []Linter{{Name: "javac -Xlint", Errors: "javac",
+			Command: `find . -name '*.java' -exec javac -Xlint:all -cp /opt/junit/junit.jar -d /tmp/lint {} +`}},
+		Limits: compiledLimits,
+		Tools:  []string{"javac", "java"},
+	},
+	"Rust": {
+		Image:  "cocode-rust-runner:latest",
+		Dir:    "docker/rust-runner",
+		Build:  `rustc -O --edition 2021 -o /tmp/main "$1"`,
+		Run:    `exec /tmp/main`,
+		Format: `exec rustfmt --edition 2021`,
+		Limits: compiledLimits.overlay(Limits{TimeoutMs: 20000}),
+		Tools:  []string{"rustc"},
+	},
+	"SQL": {
+		Image:  "cocode-sqlite-runner:latest",
+		Dir:    "docker/sqlite-runner",
+		Run:    `exec sqlite3 -bail :memory: < "$1"`,
+		Limits: interpretedLimits,
+		Tools:  []string{"sqlite3"},
+	},
+}
+
+// script returns the shell script that builds and runs the entrypoint
+func (r LanguageRunner) script() string {
+	if r.Build == "" {
+		return r.Run
+	}
+	return r.Build + " && " + r.Run
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Each stream of a run is stored up to this many bytes
+	runOutputLimit = 1 << 20
+	// Older runs of a session beyond this count are pruned
+	maxRunsPerSession = 200
+)
+
+// RunRecord is a finished run of a session as stored in the runs table
+type RunRecord struct {
+	RunID      int    `json:"run_id"`
+	Author     string `json:"author,omitempty"`
+	Language   string `json:"language"`
+	Entrypoint string `json:"entrypoint"`
+	CodeHash   string `json:"code_hash"`
+	StartedAt  string `json:"started_at"`
+	DurationMs int64  `json:"duration_ms"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	Killed     bool   `json:"killed,omitempty"`
+	OOMKilled  bool   `json:"oom_killed,omitempty"`
+	LimitHit   string `json:"limit_hit,omitempty"` // see limitHit
+	// Test runs check the code against the session's test cases instead,
+	// or run its unit tests with TestTool
+	TestsTotal  int          `json:"tests_total,omitempty"`
+	TestsPassed int          `json:"tests_passed,omitempty"`
+	TestTool    string       `json:"test_tool,omitempty"`
+	Tests       []TestResult `json:"tests,omitempty"`
+	UnitTests   []UnitTest   `json:"unit_tests,omitempty"`
+	Stdin       string       `json:"stdin,omitempty"`
+	Stdout      string       `json:"stdout,omitempty"`
+	Stderr      string       `json:"stderr,omitempty"`
+}
+
+// runOutput collects one stream of a run, keeping the first runOutputLimit bytes.
+// It may be written from several goroutines.
+type runOutput struct {
+	mu        sync.Mutex
+	b         strings.Builder
+	truncated bool
+}
+
+func (o *runOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if room := runOutputLimit - o.b.Len(); len(p) > room {
+		o.b.Write(p[:max(room, 0)])
+		o.truncated = true
+	} else {
+		o.b.Write(p)
+	}
+	return len(p), nil
+}
+
+func (o *runOutput) isTruncated() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.truncated
+}
+
+func (o *runOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.truncated {
+		return o.b.String() + "\n[output truncated]"
+	}
+	return o.b.String()
+}
+
+// oomKilled tells whether a run that exited with code was killed by the
+// kernel for running out of memory: docker reports that as SIGKILL (128+9)
+// and nobody else killed it.
+func oomKilled(code int, killed, timedOut bool) bool {
+	return code == 137 && !killed && !timedOut
+}
+
+// recordRun stores a finished run of the session and sets its RunID. Only
+// the latest maxRunsPerSession runs of a session are kept.
+func recordRun(sessionID int, r *RunRecord) error {
+	var exitCode sql.NullInt64
+	if r.ExitCode != nil {
+		exitCode = sql.NullInt64{Int64: int64(*r.ExitCode), Valid: true}
+	}
+	res, err := db.Exec(`INSERT INTO runs(session_id, user_id, language, entrypoint, code_hash, started_at, duration_ms,
+			exit_code, timed_out, killed, oom_killed, limit_hit, tests_total, tests_passed, test_tool, stdin, stdout, stderr)
+		VALUES (?, (SELECT user_id FROM users WHERE username = ?), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sessionID, r.Author, r.Language, r.Entrypoint, r.CodeHash, r.StartedAt, r.DurationMs,
+		exitCode, r.TimedOut, r.Killed, r.OOMKilled, r.LimitHit, r.TestsTotal, r.TestsPassed, r.TestTool, r.Stdin, r.Stdout, r.Stderr)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	r.RunID = int(id)
+	// The session keeps its latest runs, the results of those it drops go first
+	pruned := `SELECT run_id FROM runs WHERE session_id = ? AND run_id NOT IN (
+		SELECT run_id FROM runs WHERE session_id = ? ORDER BY run_id DESC LIMIT ?)`
+	for _, table := range []string{"test_results", "unit_test_results", "runs"} {
+		_, err = db.Exec("DELETE FROM "+table+" WHERE run_id IN ("+pruned+")", sessionID, sessionID, maxRunsPerSession)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Columns of RunRecord without the streams, in scanRun order
+const runColumns = `r.run_id, u.username, r.language, r.entrypoint, r.code_hash, r.started_at, r.duration_ms,
+	r.exit_code, r.timed_out, r.killed, r.oom_killed, r.limit_hit, r.tests_total, r.tests_passed, r.test_tool`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRun(row rowScanner, extra ...any) (RunRecord, error) {
+	var r RunRecord
+	var author sql.NullString
+	var exitCode sql.NullInt64
+	dest := append([]any{&r.RunID, &author, &r.Language, &r.Entrypoint, &r.CodeHash, &r.StartedAt, &r.DurationMs,
+		&exitCode, &r.TimedOut, &r.Killed, &r.OOMKilled, &r.LimitHit, &r.TestsTotal, &r.TestsPassed, &r.TestTool}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return r, err
+	}
+	r.Author = author.String
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		r.ExitCode = &code
+	}
+	return r, nil
+}
+
+// sessionRunsHandler lists the runs of a session, newest first, without their input and output
+func sessionRunsHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	rows, err := db.Query(`SELECT `+runColumns+`
+		FROM runs r LEFT JOIN users u ON r.user_id = u.user_id
+		WHERE r.session_id = ? ORDER BY r.run_id DESC`, sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	runs := []RunRecord{}
+	for rows.Next() {
+		if run, err := scanRun(rows); err == nil {
+			runs = append(runs, run)
+		}
+	}
+	writeJSON(w, runs)
+}
+
+// sessionRunHandler re-opens one run including what it read and wrote, or
+// the results of its tests
+func sessionRunHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	runID, err := strconv.Atoi(r.URL.Query().Get("run_id"))
+	if err != nil {
+		http.Error(w, "Invalid run_id", http.StatusBadRequest)
+		return
+	}
+	var stdin, stdout, stderr string
+	row := db.QueryRow(`SELECT `+runColumns+`, r.stdin, r.stdout, r.stderr
+		FROM runs r LEFT JOIN users u ON r.user_id = u.user_id
+		WHERE r.session_id = ? AND r.run_id = ?`, sid, runID)
+	run, err := scanRun(row, &stdin, &stdout, &stderr)
+	run.Stdin, run.Stdout, run.Stderr = stdin, stdout, stderr
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if run.TestTool != "" {
+		run.UnitTests, err = unitTestResults(run.RunID)
+	} else if run.TestsTotal > 0 {
+		run.Tests, err = testResults(run.RunID)
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, run)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where the project is mounted inside the local sandbox
+const sandboxProjectDir = "/home/runner/project"
+
+// Host directories the local sandbox sees, read-only, if they exist. The
+// language tools must be installed below one of them.
+var sandboxBinds = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/opt",
+	"/etc/alternatives", "/etc/ld.so.cache", "/etc/ssl"}
+
+// sandboxRunner runs programs on the host with the language tools installed
+// there. bubblewrap puts each run in its own user, pid, ipc, uts and network
+// namespaces with the system directories and the project read-only and a
+// private /tmp, and prlimit applies the run's limits as rlimits. Without
+// cgroups memory is capped per process and CPU time rather than share.
+type sandboxRunner struct{}
+
+func (sandboxRunner) Ready(language string) error {
+	for _, tool := range []string{"bwrap", "prlimit"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return runnerNotReady("The " + language + " runner is not ready: " + tool + " is not installed")
+		}
+	}
+	for _, tool := range runners[language].Tools {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			return runnerNotReady("The " + language + " runner is not ready: " + tool + " is not installed")
+		}
+		if !sandboxVisible(path) {
+			return runnerNotReady("The " + language + " runner is not ready: " + tool + " is installed outside the sandbox")
+		}
+	}
+	return nil
+}
+
+// sandboxVisible tells whether path on the host is seen inside the sandbox
+func sandboxVisible(path string) bool {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	for _, dir := range sandboxBinds {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (sandboxRunner) Start(ctx context.Context, s *runSpec, stdout, stderr io.Writer) (Process, error) {
+	l := s.limits
+	// Per process limits. RLIMIT_NPROC counts per user namespace, so only
+	// the processes of this run.
+	args := []string{
+		"--data=" + strconv.Itoa(l.MemoryMB<<20),
+		"--fsize=" + strconv.Itoa(l.TmpfsMB<<20),
+		"--cpu=" + strconv.Itoa(max(1, int(l.timeout().Seconds()*l.CPUs+0.5))),
+		"--nproc=" + strconv.Itoa(l.Pids),
+		"--nofile=256",
+		"--", "bwrap", "--unshare-all", "--die-with-parent", "--new-session", "--clearenv",
+	}
+	if l.Network {
+		args = append(args, "--share-net")
+	}
+	for _, dir := range sandboxBinds {
+		args = append(args, "--ro-bind-try", dir, dir)
+	}
+	args = append(args, "--proc", "/proc", "--dev", "/dev",
+		"--size", strconv.Itoa(l.TmpfsMB<<20), "--tmpfs", "/tmp",
+		"--ro-bind", s.dir, sandboxProjectDir, "--chdir", sandboxProjectDir,
+		"--setenv", "HOME", "/tmp", "--setenv", "PATH", sandboxPath(s.runner))
+	for _, env := range s.runner.Env {
+		name, value, _ := strings.Cut(env, "=")
+		args = append(args, "--setenv", name, value)
+	}
+	args = append(args, "sh", "-c", s.script(), "sh", "./"+s.entry.Path)
+
+	cmd := exec.CommandContext(ctx, "prlimit", args...)
+	cmd.WaitDelay = 5 * time.Second
+	return startCommand(cmd, stdout, stderr)
+}
+
+// sandboxPath is the PATH of the sandbox: the usual directories and those of
+// the language tools
+func sandboxPath(r LanguageRunner) string {
+	dirs := []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	for _, tool := range r.Tools {
+		if path, err := exec.LookPath(tool); err == nil {
+			if dir := filepath.Dir(path); !slices.Contains(dirs, dir) {
+				dirs = append([]string{dir}, dirs...)
+			}
+		}
+	}
+	return strings.Join(dirs, ":")
+}
@@ -148,7 +148,7 @@ print_success "All dependencies installed and configured"
 echo ""
 echo "To start the server, run:"
 echo ""
-echo "    go run main.go handlers.go websockets.go"
+echo "    go run ."
 echo ""
 echo "Then open: http://localhost:8080"
 echo ""
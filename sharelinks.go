@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShareLink lets whoever opens it join a session in a role, until it expires,
+// is used up or revoked, or its creator may no longer grant the role
+type ShareLink struct {
+	LinkID    int    `json:"link_id"`
+	SessionID int    `json:"session_id"`
+	Role      string `json:"role"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"` // never if empty
+	MaxUses   int    `json:"max_uses,omitempty"`   // 0 for no limit
+	Uses      int    `json:"uses"`
+	URL       string `json:"url"` // path of the link on this site
+	nonce     string
+}
+
+// shareLinkRoles are the roles a share link may grant
+var shareLinkRoles = []string{roleViewer, roleEditor}
+
+// signature signs the link with the server's secret, so tokens cannot be
+// made up or pointed at another session or role
+func (l ShareLink) signature() string {
+	mac := hmac.New(sha256.New, jwtSecret())
+	mac.Write([]byte("share-link:" + strconv.Itoa(l.LinkID) + ":" + strconv.Itoa(l.SessionID) + ":" + l.Role + ":" + l.nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// token is what the link carries: its id, nonce and signature
+func (l ShareLink) token() string {
+	return strconv.Itoa(l.LinkID) + "." + l.nonce + "." + l.signature()
+}
+
+// problem tells why the link can no longer be used, or "" if it can
+func (l ShareLink) problem(revoked bool) string {
+	switch {
+	case revoked:
+		return "This share link was revoked"
+	case l.ExpiresAt != "" && l.ExpiresAt <= time.Now().UTC().Format(time.RFC3339):
+		return "This share link has expired"
+	case l.MaxUses > 0 && l.Uses >= l.MaxUses:
+		return "This share link has been used up"
+	}
+	return ""
+}
+
+// withdrawn tells whether the link's creator can no longer grant its role,
+// having been removed or demoted since they made it
+func (l ShareLink) withdrawn() (bool, error) {
+	role, err := sessionRole(l.SessionID, l.CreatedBy)
+	if errors.Is(err, errAccessDenied) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !canGrant(role, l.Role), nil
+}
+
+const shareLinkColumns = `l.link_id, l.session_id, l.role, COALESCE(u.username, ''), l.created_at,
+	COALESCE(l.expires_at, ''), l.max_uses, l.uses, l.nonce, l.revoked
+	FROM share_links l LEFT JOIN users u ON l.created_by = u.user_id`
+
+func scanShareLink(scan func(dest ...any) error) (ShareLink, bool, error) {
+	var l ShareLink
+	var revoked bool
+	err := scan(&l.LinkID, &l.SessionID, &l.Role, &l.CreatedBy, &l.CreatedAt, &l.ExpiresAt, &l.MaxUses, &l.Uses,
+		&l.nonce, &revoked)
+	l.URL = "/join?token=" + url.QueryEscape(l.token())
+	return l, revoked, err
+}
+
+// activeShareLinks returns the links of a session that can still be used, newest first
+func activeShareLinks(sessionID int) ([]ShareLink, error) {
+	rows, err := db.Query(`SELECT `+shareLinkColumns+` WHERE l.session_id = ? ORDER BY l.link_id DESC`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []ShareLink{}
+	for rows.Next() {
+		l, revoked, err := scanShareLink(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		if l.problem(revoked) == "" {
+			links = append(links, l)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	active := links[:0]
+	for _, l := range links {
+		withdrawn, err := l.withdrawn()
+		if err != nil {
+			return nil, err
+		}
+		if !withdrawn {
+			active = append(active, l)
+		}
+	}
+	return active, nil
+}
+
+// shareLinksHandler lists the active share links of a session
+func shareLinksHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionRoleAccess(w, r, r.URL.Query().Get("session_id"), roleMaintainer)
+	if !ok {
+		return
+	}
+	links, err := activeShareLinks(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, links)
+}
+
+// createShareLinkHandler makes a share link for the session that grants the
+// posted role, viewer or editor, and optionally expires after expires_hours
+// or max_uses people joined with it
+func createShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleMaintainer)
+	if !ok {
+		return
+	}
+	actor, err := sessionRole(sid, username)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	l := ShareLink{SessionID: sid, Role: r.FormValue("role"), CreatedBy: username}
+	if l.Role == "" {
+		l.Role = roleViewer
+	}
+	if !slices.Contains(shareLinkRoles, l.Role) || !canGrant(actor, l.Role) {
+		http.Error(w, "Invalid role: share links grant "+strings.Join(shareLinkRoles, " or "), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	l.CreatedAt = now.Format(time.RFC3339)
+	var expiresAt any
+	if v := r.FormValue("expires_hours"); v != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours <= 0 {
+			http.Error(w, "Invalid expires_hours", http.StatusBadRequest)
+			return
+		}
+		l.ExpiresAt = now.Add(time.Duration(hours) * time.Hour).Format(time.RFC3339)
+		expiresAt = l.ExpiresAt
+	}
+	if v := r.FormValue("max_uses"); v != "" {
+		l.MaxUses, err = strconv.Atoi(v)
+		if err != nil || l.MaxUses < 0 {
+			http.Error(w, "Invalid max_uses", http.StatusBadRequest)
+			return
+		}
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, "Error generating link", http.StatusInternalServerError)
+		return
+	}
+	l.nonce = hex.EncodeToString(nonce)
+	res, err := db.Exec(`INSERT INTO share_links(session_id, role, created_by, created_at, expires_at, max_uses, nonce)
+		VALUES (?, ?, (SELECT user_id FROM users WHERE username = ?), ?, ?, ?, ?)`,
+		sid, l.Role, username, l.CreatedAt, expiresAt, l.MaxUses, l.nonce)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	l.LinkID = int(id)
+	l.URL = "/join?token=" + url.QueryEscape(l.token())
+	writeJSON(w, l)
+}
+
+// revokeShareLinkHandler stops a share link from working. Those who joined
+// with it keep their access.
+func revokeShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleMaintainer)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("link_id"))
+	if err != nil {
+		http.Error(w, "Invalid link_id", http.StatusBadRequest)
+		return
+	}
+	res, err := db.Exec("UPDATE share_links SET revoked = 1 WHERE link_id = ? AND session_id = ?", id, sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("Share link revoked"))
+}
+
+// JoinPage asks the user to confirm joining a session with a share link
+type JoinPage struct {
+	Token       string
+	ProjectName string
+	Role        string
+	CreatedBy   string
+}
+
+// joinHandler opens a share link: a GET shows what the link grants and a
+// POST of its token makes the user a collaborator in the link's role, unless
+// they have access already, and lands in the editor. Visitors who are not
+// logged in come back here after logging in.
+func joinHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := authFromJwt(r)
+	if err != nil {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.FormValue("token")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		http.Error(w, "Invalid share link", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid share link", http.StatusBadRequest)
+		return
+	}
+	l, revoked, err := scanShareLink(db.QueryRow(`SELECT `+shareLinkColumns+` WHERE l.link_id = ?`, id).Scan)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (parts[1] != l.nonce || !hmac.Equal([]byte(parts[2]), []byte(l.signature())))) {
+		http.Error(w, "Invalid share link", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	editor := "/editor?session_id=" + strconv.Itoa(l.SessionID)
+	if _, err := sessionRole(l.SessionID, username); err == nil {
+		http.Redirect(w, r, editor, http.StatusSeeOther)
+		return
+	} else if !errors.Is(err, errAccessDenied) {
+		writeAccessError(w, err)
+		return
+	}
+	if problem := l.problem(revoked); problem != "" {
+		http.Error(w, problem, http.StatusGone)
+		return
+	}
+	if withdrawn, err := l.withdrawn(); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	} else if withdrawn {
+		http.Error(w, "This share link was withdrawn, its creator can no longer grant this role", http.StatusGone)
+		return
+	}
+
+	// Opening the link only asks, so other sites cannot make the user join
+	if r.Method == "GET" {
+		page := &JoinPage{Token: token, Role: l.Role, CreatedBy: l.CreatedBy}
+		err := db.QueryRow("SELECT COALESCE(project_name, '') FROM sessions WHERE session_id = ?", l.SessionID).Scan(&page.ProjectName)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		data := PageData{Template: "join", Username: username, Join: page}
+		if err := templates.ExecuteTemplate(w, "base.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Count the use unless someone else took the last one in the meantime
+	res, err := db.Exec(`UPDATE share_links SET uses = uses + 1
+		WHERE link_id = ? AND revoked = 0 AND (max_uses = 0 OR uses < max_uses)`, l.LinkID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "This share link has been used up", http.StatusGone)
+		return
+	}
+	_, err = db.Exec(`INSERT OR IGNORE INTO collabs(session_id, user_id, role)
+		VALUES (?, (SELECT user_id FROM users WHERE username = ?), ?)`, l.SessionID, username, l.Role)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, editor, http.StatusSeeOther)
+}
@@ -15,7 +15,7 @@ echo ""
 
 # 2. Verify Go compilation
 echo "🔨 Building Go server..."
-go build -o /tmp/cocode-server main.go handlers.go websockets.go
+go build -o /tmp/cocode-server .
 echo "✅ Server built: /tmp/cocode-server"
 echo ""
 
@@ -48,4 +48,4 @@ echo "Press Ctrl+C to stop server"
 echo ""
 
 # Start the server
-go run main.go handlers.go websockets.go
+go run .
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TestCase is an input of a session's program and the output it must write
+type TestCase struct {
+	CaseID         int    `json:"case_id"`
+	Name           string `json:"name"`
+	Stdin          string `json:"stdin"`
+	ExpectedStdout string `json:"expected_stdout"`
+	TimeoutMs      int    `json:"timeout_ms,omitempty"` // 0 uses the session's limit
+}
+
+// TestResult is how the program did on one test case in a test run
+type TestResult struct {
+	CaseID     int        `json:"case_id"`
+	Name       string     `json:"name"`
+	Passed     bool       `json:"passed"`
+	Expected   string     `json:"expected"`
+	Stdout     string     `json:"stdout"`
+	Stderr     string     `json:"stderr,omitempty"`
+	ExitCode   int        `json:"exit_code"`
+	LimitHit   string     `json:"limit_hit,omitempty"`
+	DurationMs int64      `json:"duration_ms"`
+	Diff       []DiffLine `json:"diff,omitempty"` // expected against actual output, for failed cases
+}
+
+// normalizeOutput ignores differences in line endings and in whitespace at
+// the end of lines and of the output when comparing it
+func normalizeOutput(s string) []string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// check fills in whether the result passed and its diff
+func (t *TestResult) check() {
+	expected, actual := normalizeOutput(t.Expected), normalizeOutput(t.Stdout)
+	t.Passed = t.ExitCode == 0 && t.LimitHit == "" && strings.Join(expected, "\n") == strings.Join(actual, "\n")
+	t.Diff = nil
+	if !t.Passed {
+		t.Diff = diffLines(expected, actual)
+	}
+}
+
+func sessionTestCases(sessionID int) ([]TestCase, error) {
+	rows, err := db.Query(`SELECT case_id, name, stdin, expected_stdout, timeout_ms FROM test_cases
+		WHERE session_id = ? ORDER BY case_id`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cases := []TestCase{}
+	for rows.Next() {
+		var c TestCase
+		if err := rows.Scan(&c.CaseID, &c.Name, &c.Stdin, &c.ExpectedStdout, &c.TimeoutMs); err != nil {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	return cases, rows.Err()
+}
+
+// testResults returns the results of a test run in case order
+func testResults(runID int) ([]TestResult, error) {
+	rows, err := db.Query(`SELECT case_id, name, passed, expected, stdout, stderr, exit_code, limit_hit, duration_ms
+		FROM test_results WHERE run_id = ? ORDER BY result_id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []TestResult{}
+	for rows.Next() {
+		var t TestResult
+		if err := rows.Scan(&t.CaseID, &t.Name, &t.Passed, &t.Expected, &t.Stdout, &t.Stderr, &t.ExitCode,
+			&t.LimitHit, &t.DurationMs); err != nil {
+			return nil, err
+		}
+		if !t.Passed {
+			t.Diff = diffLines(normalizeOutput(t.Expected), normalizeOutput(t.Stdout))
+		}
+		results = append(results, t)
+	}
+	return results, rows.Err()
+}
+
+// testCaseFromForm reads the fields of a test case posted to create or
+// update it, reporting a bad request itself
+func testCaseFromForm(w http.ResponseWriter, r *http.Request) (TestCase, bool) {
+	c := TestCase{
+		Name:           strings.TrimSpace(r.FormValue("name")),
+		Stdin:          r.FormValue("stdin"),
+		ExpectedStdout: r.FormValue("expected_stdout"),
+	}
+	if c.Name == "" {
+		http.Error(w, "Test case name required", http.StatusBadRequest)
+		return c, false
+	}
+	if v := r.FormValue("timeout_ms"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid timeout_ms", http.StatusBadRequest)
+			return c, false
+		}
+		if n > runnerConfig.Max.TimeoutMs {
+			http.Error(w, "timeout_ms may be at most "+strconv.Itoa(runnerConfig.Max.TimeoutMs), http.StatusBadRequest)
+			return c, false
+		}
+		c.TimeoutMs = n
+	}
+	return c, true
+}
+
+// testCaseFromRequest resolves the case_id form value to a test case of the session
+func testCaseFromRequest(w http.ResponseWriter, r *http.Request, sid int) (int, bool) {
+	caseID, err := strconv.Atoi(r.FormValue("case_id"))
+	if err != nil {
+		http.Error(w, "Invalid case_id", http.StatusBadRequest)
+		return 0, false
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM test_cases WHERE case_id = ? AND session_id = ?", caseID, sid).Scan(&n); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if n == 0 {
+		http.Error(w, "Test case not found", http.StatusNotFound)
+		return 0, false
+	}
+	return caseID, true
+}
+
+// testCasesHandler lists the test cases of a session
+func testCasesHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	cases, err := sessionTestCases(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, cases)
+}
+
+func createTestCaseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	c, ok := testCaseFromForm(w, r)
+	if !ok {
+		return
+	}
+	res, err := db.Exec("INSERT INTO test_cases(session_id, name, stdin, expected_stdout, timeout_ms) VALUES (?, ?, ?, ?, ?)",
+		sid, c.Name, c.Stdin, c.ExpectedStdout, c.TimeoutMs)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	c.CaseID = int(id)
+	writeJSON(w, c)
+}
+
+func updateTestCaseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	caseID, ok := testCaseFromRequest(w, r, sid)
+	if !ok {
+		return
+	}
+	c, ok := testCaseFromForm(w, r)
+	if !ok {
+		return
+	}
+	c.CaseID = caseID
+	_, err := db.Exec("UPDATE test_cases SET name = ?, stdin = ?, expected_stdout = ?, timeout_ms = ? WHERE case_id = ?",
+		c.Name, c.Stdin, c.ExpectedStdout, c.TimeoutMs, caseID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, c)
+}
+
+// deleteTestCaseHandler removes a test case, results of earlier runs keep it
+func deleteTestCaseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	caseID, ok := testCaseFromRequest(w, r, sid)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM test_cases WHERE case_id = ?", caseID); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Test case deleted"))
+}
+
+type TestRunResponse struct {
+	RunID   int          `json:"run_id"`
+	Passed  int          `json:"passed"`
+	Total   int          `json:"total"`
+	Results []TestResult `json:"results"`
+}
+
+// runTestsHandler runs the current code of the session against all its test
+// cases, one after another on one worker, and stores the report as a run.
+func runTestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	cases, err := sessionTestCases(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if len(cases) == 0 {
+		http.Error(w, "The session has no test cases", http.StatusBadRequest)
+		return
+	}
+
+	spec, finish, ok := prepareBatchRun(w, r, username, sid, r.FormValue("entrypoint"))
+	if !ok {
+		return
+	}
+	defer finish()
+
+	began := time.Now()
+	resp := TestRunResponse{Total: len(cases), Results: []TestResult{}}
+	for _, c := range cases {
+		timeout := spec.limits.timeout()
+		if c.TimeoutMs > 0 {
+			timeout = time.Duration(min(c.TimeoutMs, runnerConfig.Max.TimeoutMs)) * time.Millisecond
+		}
+		res, err := spec.runBatch(c.Stdin, timeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rec := res.record(spec, username)
+		t := TestResult{
+			CaseID:     c.CaseID,
+			Name:       c.Name,
+			Expected:   c.ExpectedStdout,
+			Stdout:     res.stdout,
+			Stderr:     res.stderr,
+			ExitCode:   res.exitCode,
+			LimitHit:   rec.LimitHit,
+			DurationMs: rec.DurationMs,
+		}
+		t.check()
+		if t.Passed {
+			resp.Passed++
+		}
+		resp.Results = append(resp.Results, t)
+	}
+
+	run := RunRecord{
+		Author:      username,
+		Language:    spec.language,
+		Entrypoint:  spec.entry.Path,
+		CodeHash:    spec.codeHash,
+		StartedAt:   began.UTC().Format(time.RFC3339),
+		DurationMs:  time.Since(began).Milliseconds(),
+		TestsTotal:  resp.Total,
+		TestsPassed: resp.Passed,
+	}
+	if err := recordTestRun(sid, &run, resp.Results); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	resp.RunID = run.RunID
+	writeJSON(w, resp)
+}
+
+// recordTestRun stores a test run and the results of its cases
+func recordTestRun(sessionID int, run *RunRecord, results []TestResult) error {
+	if err := recordRun(sessionID, run); err != nil {
+		return err
+	}
+	for _, t := range results {
+		_, err := db.Exec(`INSERT INTO test_results(run_id, case_id, name, passed, expected, stdout, stderr, exit_code,
+				limit_hit, duration_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			run.RunID, t.CaseID, t.Name, t.Passed, t.Expected, t.Stdout, t.Stderr, t.ExitCode, t.LimitHit, t.DurationMs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
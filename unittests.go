@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Statuses of a unit test
+const (
+	testPassed  = "passed"
+	testFailed  = "failed"
+	testSkipped = "skipped"
+	testError   = "error" // the test could not run, as reported by JUnit
+)
+
+// UnitTest is the outcome of one test found by a language's test tool
+type UnitTest struct {
+	Suite      string `json:"suite,omitempty"` // package, class or file of the test
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"duration_ms"`
+	Message    string `json:"message,omitempty"` // why it failed or was skipped
+	Output     string `json:"output,omitempty"`  // the tool's full report of a failure
+}
+
+// UnitTestReport is the result of running a session's unit tests
+type UnitTestReport struct {
+	RunID    int        `json:"run_id"`
+	Tool     string     `json:"tool"`
+	Total    int        `json:"total"`
+	Passed   int        `json:"passed"`
+	Failed   int        `json:"failed"`
+	Skipped  int        `json:"skipped"`
+	Tests    []UnitTest `json:"tests"`
+	ExitCode int        `json:"exit_code"`
+	LimitHit string     `json:"limit_hit,omitempty"`
+	// What the tool printed besides its report, like compiler errors, and
+	// where those point
+	Output      string       `json:"output,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// unitTestParsers read the report a test tool wrote to stdout. They return
+// the tests and any output that is not part of them.
+var unitTestParsers = map[string]func(report []byte) ([]UnitTest, string){
+	"pytest":  parseJUnitXML,
+	"JUnit":   parseJUnitXML,
+	"go test": parseGoTestJSON,
+	"jest":    parseJestJSON,
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Class   string        `xml:"classname,attr"`
+	Name    string        `xml:"name,attr"`
+	Time    string        `xml:"time,attr"`
+	Failure *junitProblem `xml:"failure"`
+	Error   *junitProblem `xml:"error"`
+	Skipped *junitProblem `xml:"skipped"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// parseJUnitXML reads JUnit XML reports, one or more <testsuites> or
+// <testsuite> documents in a row
+func parseJUnitXML(report []byte) ([]UnitTest, string) {
+	tests := []UnitTest{}
+	var walk func(s junitSuite)
+	walk = func(s junitSuite) {
+		for _, c := range s.Cases {
+			t := UnitTest{Suite: c.Class, Name: c.Name, Status: testPassed}
+			if secs, err := strconv.ParseFloat(c.Time, 64); err == nil {
+				t.DurationMs = int64(secs * 1000)
+			}
+			for _, p := range []struct {
+				problem *junitProblem
+				status  string
+			}{{c.Failure, testFailed}, {c.Error, testError}, {c.Skipped, testSkipped}} {
+				if p.problem != nil {
+					t.Status = p.status
+					t.Message = p.problem.Message
+					t.Output = strings.TrimSpace(p.problem.Text)
+					break
+				}
+			}
+			if t.Message == "" {
+				t.Message, _, _ = strings.Cut(t.Output, "\n")
+			}
+			tests = append(tests, t)
+		}
+		for _, child := range s.Suites {
+			walk(child)
+		}
+	}
+	d := xml.NewDecoder(bytes.NewReader(report))
+	for suites := 0; ; suites++ {
+		var s junitSuite
+		if err := d.Decode(&s); err != nil {
+			if suites == 0 {
+				// Not a report, like what a tool that did not run printed
+				return tests, string(report)
+			}
+			return tests, ""
+		}
+		walk(s)
+	}
+}
+
+// goTestEvent is a line of `go test -json`
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// parseGoTestJSON reads the events of `go test -json`. Output of packages
+// rather than tests, such as build errors, is returned as the extra output.
+func parseGoTestJSON(report []byte) ([]UnitTest, string) {
+	tests := []UnitTest{}
+	var extra strings.Builder
+	output := map[[2]string]*strings.Builder{}
+	sc := bufio.NewScanner(bytes.NewReader(report))
+	sc.Buffer(make([]byte, 64*1024), runOutputLimit)
+	for sc.Scan() {
+		var e goTestEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e.Action == "" {
+			extra.Write(sc.Bytes())
+			extra.WriteByte('\n')
+			continue
+		}
+		if e.Test == "" {
+			if e.Action == "output" || e.Action == "build-output" {
+				extra.WriteString(e.Output)
+			}
+			continue
+		}
+		key := [2]string{e.Package, e.Test}
+		switch e.Action {
+		case "output":
+			if output[key] == nil {
+				output[key] = &strings.Builder{}
+			}
+			output[key].WriteString(e.Output)
+		case "pass", "fail", "skip":
+			t := UnitTest{Suite: e.Package, Name: e.Test, DurationMs: int64(e.Elapsed * 1000)}
+			if t.Suite == "command-line-arguments" {
+				// Loose files rather than a module
+				t.Suite = ""
+			}
+			t.Status = map[string]string{"pass": testPassed, "fail": testFailed, "skip": testSkipped}[e.Action]
+			if b := output[key]; b != nil && t.Status != testPassed {
+				t.Output = strings.TrimSpace(b.String())
+				t.Message = goTestMessage(t.Output)
+			}
+			delete(output, key)
+			tests = append(tests, t)
+		}
+	}
+	return tests, extra.String()
+}
+
+// goTestMessage picks the first line a test logged out of its output, that
+// is not one of the run, pass or fail lines of go test
+func goTestMessage(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "=== ") && !strings.HasPrefix(line, "--- ") {
+			return line
+		}
+	}
+	return ""
+}
+
+type jestReport struct {
+	TestResults []struct {
+		Name             string `json:"name"`
+		Message          string `json:"message"`
+		AssertionResults []struct {
+			AncestorTitles  []string `json:"ancestorTitles"`
+			Title           string   `json:"title"`
+			Status          string   `json:"status"`
+			Duration        *float64 `json:"duration"`
+			FailureMessages []string `json:"failureMessages"`
+		} `json:"assertionResults"`
+	} `json:"testResults"`
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// parseJestJSON reads the report of `jest --json`. Test files that failed
+// as a whole, for example on a syntax error, are returned as extra output.
+func parseJestJSON(report []byte) ([]UnitTest, string) {
+	tests := []UnitTest{}
+	var r jestReport
+	if err := json.Unmarshal(report, &r); err != nil {
+		return tests, string(report)
+	}
+	var extra strings.Builder
+	for _, file := range r.TestResults {
+		suite := projectPath(file.Name)
+		if len(file.AssertionResults) == 0 && file.Message != "" {
+			extra.WriteString(suite + ":\n" + ansiEscape.ReplaceAllString(file.Message, "") + "\n")
+		}
+		for _, a := range file.AssertionResults {
+			t := UnitTest{
+				Suite:  suite,
+				Name:   strings.Join(append(append([]string{}, a.AncestorTitles...), a.Title), " › "),
+				Status: a.Status,
+			}
+			switch a.Status {
+			case "pending", "todo", "disabled":
+				t.Status = testSkipped
+			}
+			if a.Duration != nil {
+				t.DurationMs = int64(*a.Duration)
+			}
+			if len(a.FailureMessages) > 0 {
+				t.Output = ansiEscape.ReplaceAllString(strings.Join(a.FailureMessages, "\n"), "")
+				t.Message, _, _ = strings.Cut(strings.TrimSpace(t.Output), "\n")
+			}
+			tests = append(tests, t)
+		}
+	}
+	return tests, extra.String()
+}
+
+// projectPath turns an absolute path inside the runner into one relative to
+// the project. Docker and the sandbox mount it where sandboxProjectDir says.
+func projectPath(path string) string {
+	return strings.TrimPrefix(path, sandboxProjectDir+"/")
+}
+
+// newUnitTestReport counts the tests of a report
+func newUnitTestReport(tool string, tests []UnitTest) UnitTestReport {
+	report := UnitTestReport{Tool: tool, Total: len(tests), Tests: tests}
+	for _, t := range tests {
+		switch t.Status {
+		case testPassed:
+			report.Passed++
+		case testSkipped:
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+	}
+	return report
+}
+
+// unitTestResults returns the unit tests of a run in the order they were reported
+func unitTestResults(runID int) ([]UnitTest, error) {
+	rows, err := db.Query(`SELECT suite, name, status, duration_ms, message, output
+		FROM unit_test_results WHERE run_id = ? ORDER BY result_id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tests := []UnitTest{}
+	for rows.Next() {
+		var t UnitTest
+		if err := rows.Scan(&t.Suite, &t.Name, &t.Status, &t.DurationMs, &t.Message, &t.Output); err != nil {
+			return nil, err
+		}
+		tests = append(tests, t)
+	}
+	return tests, rows.Err()
+}
+
+// runUnitTestsHandler runs the unit tests of the session's current code with
+// the test tool of its language and stores the parsed report as a run.
+func runUnitTestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	language, err := sessionLanguage(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if runners[language].Test == "" {
+		http.Error(w, "Unit tests are not supported for "+language+" sessions", http.StatusBadRequest)
+		return
+	}
+	parse, ok := unitTestParsers[runners[language].TestTool]
+	if !ok {
+		http.Error(w, "No parser for the reports of "+runners[language].TestTool, http.StatusInternalServerError)
+		return
+	}
+	spec, finish, ok := prepareBatchRun(w, r, username, sid, r.FormValue("entrypoint"))
+	if !ok {
+		return
+	}
+	defer finish()
+
+	spec.command = spec.runner.Test
+	res, err := spec.runBatch("", spec.limits.timeout())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tests, extra := parse([]byte(res.stdout))
+	report := newUnitTestReport(spec.runner.TestTool, tests)
+	report.Output = strings.TrimSpace(extra + "\n" + res.stderr)
+	if res.err != nil {
+		report.Diagnostics = spec.diagnostics(report.Output)
+	}
+
+	run := res.record(spec, username)
+	report.ExitCode, report.LimitHit = res.exitCode, run.LimitHit
+	// Skipped tests count neither way in the run history
+	run.TestTool, run.TestsTotal, run.TestsPassed = report.Tool, report.Total-report.Skipped, report.Passed
+	run.Stdout, run.Stderr = "", report.Output
+	if err := recordUnitTestRun(sid, &run, tests); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	report.RunID = run.RunID
+	writeJSON(w, report)
+}
+
+// recordUnitTestRun stores a unit test run and its tests
+func recordUnitTestRun(sessionID int, run *RunRecord, tests []UnitTest) error {
+	if err := recordRun(sessionID, run); err != nil {
+		return err
+	}
+	for _, t := range tests {
+		_, err := db.Exec(`INSERT INTO unit_test_results(run_id, suite, name, status, duration_ms, message, output)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, run.RunID, t.Suite, t.Name, t.Status, t.DurationMs, t.Message, t.Output)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
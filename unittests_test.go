@@ -0,0 +1,205 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+type unitTestReportTest struct {
+	name   string
+	report string
+	want   []UnitTest
+	extra  string
+}
+
+// testUnitTestReports checks the tests and extra output parse finds in each report
+func testUnitTestReports(t *testing.T, parse func([]byte) ([]UnitTest, string), tests []unitTestReportTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, extra := parse([]byte(tt.report))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+			if extra != tt.extra {
+				t.Errorf("extra output %q, want %q", extra, tt.extra)
+			}
+		})
+	}
+}
+
+func TestParseJUnitXML(t *testing.T) {
+	testUnitTestReports(t, parseJUnitXML, []unitTestReportTest{
+		{
+			name: "pytest",
+			report: `<?xml version="1.0" encoding="utf-8"?><testsuites><testsuite name="pytest" errors="1" failures="1" skipped="1" tests="4" time="0.031" timestamp="2026-10-17T10:00:00.000000+00:00" hostname="runner">` +
+				`<testcase classname="test_calc" name="test_add" time="0.001" />` +
+				`<testcase classname="test_calc" name="test_div" time="0.002"><failure message="assert 0.5 == 2&#10; +  where 0.5 = div(1, 2)">def test_div():
+&gt;       assert div(1, 2) == 2
+E       assert 0.5 == 2
+E        +  where 0.5 = div(1, 2)
+
+test_calc.py:7: AssertionError</failure></testcase>` +
+				`<testcase classname="test_calc" name="test_later" time="0.000"><skipped type="pytest.skip" message="not yet">/home/runner/project/test_calc.py:9: not yet</skipped></testcase>` +
+				`<testcase classname="test_calc" name="test_file" time="0.003"><error message="failed on setup with &quot;file not found&quot;">file /home/runner/project/test_calc.py, line 11
+  def test_file(tmp):
+E       fixture 'tmp' not found</error></testcase>` +
+				`</testsuite></testsuites>`,
+			want: []UnitTest{
+				{Suite: "test_calc", Name: "test_add", Status: testPassed, DurationMs: 1},
+				{Suite: "test_calc", Name: "test_div", Status: testFailed, DurationMs: 2,
+					Message: "assert 0.5 == 2\n +  where 0.5 = div(1, 2)",
+					Output:  "def test_div():\n>       assert div(1, 2) == 2\nE       assert 0.5 == 2\nE        +  where 0.5 = div(1, 2)\n\ntest_calc.py:7: AssertionError"},
+				{Suite: "test_calc", Name: "test_later", Status: testSkipped, Message: "not yet", Output: "/home/runner/project/test_calc.py:9: not yet"},
+				{Suite: "test_calc", Name: "test_file", Status: testError, DurationMs: 3, Message: `failed on setup with "file not found"`,
+					Output: "file /home/runner/project/test_calc.py, line 11\n  def test_file(tmp):\nE       fixture 'tmp' not found"},
+			},
+		},
+		{
+			name: "JUnit reports in a row",
+			report: `<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="JUnit Jupiter" tests="2" skipped="0" failures="1" errors="0" time="0.05" hostname="runner">
+<properties><property name="java.version" value="21"/></properties>
+<testcase name="adds()" classname="CalcTest" time="0.012"/>
+<testcase name="divides()" classname="CalcTest" time="0.004">
+<failure message="expected: &lt;2&gt; but was: &lt;0&gt;" type="org.opentest4j.AssertionFailedError"><![CDATA[org.opentest4j.AssertionFailedError: expected: <2> but was: <0>
+	at CalcTest.divides(CalcTest.java:14)
+]]></failure>
+<system-out><![CDATA[unique-id: [engine:junit-jupiter]/[class:CalcTest]/[method:divides()]
+]]></system-out>
+</testcase>
+</testsuite>
+<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="JUnit Vintage" tests="1" skipped="1" failures="0" errors="0" time="0.001" hostname="runner">
+<testcase name="old" classname="LegacyTest" time="0"><skipped/></testcase>
+</testsuite>
+`,
+			want: []UnitTest{
+				{Suite: "CalcTest", Name: "adds()", Status: testPassed, DurationMs: 12},
+				{Suite: "CalcTest", Name: "divides()", Status: testFailed, DurationMs: 4, Message: "expected: <2> but was: <0>",
+					Output: "org.opentest4j.AssertionFailedError: expected: <2> but was: <0>\n\tat CalcTest.divides(CalcTest.java:14)"},
+				{Suite: "LegacyTest", Name: "old", Status: testSkipped},
+			},
+		},
+		{
+			name:   "message from the output",
+			report: `<testsuite><testcase classname="t" name="n"><failure>first line` + "\n" + `second line</failure></testcase></testsuite>`,
+			want:   []UnitTest{{Suite: "t", Name: "n", Status: testFailed, Message: "first line", Output: "first line\nsecond line"}},
+		},
+		{
+			name:   "no tests",
+			report: `<?xml version="1.0" encoding="utf-8"?><testsuites><testsuite name="pytest" errors="0" failures="0" skipped="0" tests="0" time="0.002" /></testsuites>`,
+			want:   []UnitTest{},
+		},
+		{
+			name:   "no report",
+			report: "",
+			want:   []UnitTest{},
+		},
+		{
+			name:   "not a report",
+			report: "ERROR: file or directory not found: tests\n",
+			want:   []UnitTest{},
+			extra:  "ERROR: file or directory not found: tests\n",
+		},
+		{
+			name:   "truncated after a suite",
+			report: `<testsuite><testcase classname="a" name="one" time="0.5"/></testsuite><testsuite><testcase classname="b" name="tw`,
+			want:   []UnitTest{{Suite: "a", Name: "one", Status: testPassed, DurationMs: 500}},
+		},
+		{
+			name:   "truncated in the first suite",
+			report: `<testsuite><testcase classname="a" name="one"`,
+			want:   []UnitTest{},
+			extra:  `<testsuite><testcase classname="a" name="one"`,
+		},
+	})
+}
+
+func TestParseGoTestJSON(t *testing.T) {
+	testUnitTestReports(t, parseGoTestJSON, []unitTestReportTest{
+		{
+			name: "passes, failures and skips",
+			report: `{"Time":"2026-10-17T10:00:00Z","Action":"start","Package":"example.com/calc"}
+{"Time":"2026-10-17T10:00:00Z","Action":"run","Package":"example.com/calc","Test":"TestAdd"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Test":"TestAdd","Output":"=== RUN   TestAdd\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Test":"TestAdd","Output":"--- PASS: TestAdd (0.00s)\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"pass","Package":"example.com/calc","Test":"TestAdd","Elapsed":0}
+{"Time":"2026-10-17T10:00:00Z","Action":"run","Package":"example.com/calc","Test":"TestDiv"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Test":"TestDiv","Output":"=== RUN   TestDiv\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Test":"TestDiv","Output":"    calc_test.go:12: div(1, 0) = 0, want an error\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Test":"TestDiv","Output":"--- FAIL: TestDiv (0.01s)\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"fail","Package":"example.com/calc","Test":"TestDiv","Elapsed":0.01}
+{"Time":"2026-10-17T10:00:00Z","Action":"run","Package":"example.com/calc","Test":"TestSlow"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Test":"TestSlow","Output":"=== RUN   TestSlow\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Test":"TestSlow","Output":"    calc_test.go:20: slow\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Test":"TestSlow","Output":"--- SKIP: TestSlow (0.00s)\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"skip","Package":"example.com/calc","Test":"TestSlow","Elapsed":0}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Output":"FAIL\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"output","Package":"example.com/calc","Output":"FAIL\texample.com/calc\t0.015s\n"}
+{"Time":"2026-10-17T10:00:00Z","Action":"fail","Package":"example.com/calc","Elapsed":0.015}
+`,
+			want: []UnitTest{
+				{Suite: "example.com/calc", Name: "TestAdd", Status: testPassed},
+				{Suite: "example.com/calc", Name: "TestDiv", Status: testFailed, DurationMs: 10, Message: "calc_test.go:12: div(1, 0) = 0, want an error",
+					Output: "=== RUN   TestDiv\n    calc_test.go:12: div(1, 0) = 0, want an error\n--- FAIL: TestDiv (0.01s)"},
+				{Suite: "example.com/calc", Name: "TestSlow", Status: testSkipped, Message: "calc_test.go:20: slow",
+					Output: "=== RUN   TestSlow\n    calc_test.go:20: slow\n--- SKIP: TestSlow (0.00s)"},
+			},
+			extra: "FAIL\nFAIL\texample.com/calc\t0.015s\n",
+		},
+		{
+			name: "loose files",
+			report: `{"Action":"run","Package":"command-line-arguments","Test":"TestMain"}
+{"Action":"pass","Package":"command-line-arguments","Test":"TestMain","Elapsed":1.5}
+`,
+			want: []UnitTest{{Name: "TestMain", Status: testPassed, DurationMs: 1500}},
+		},
+		{
+			name: "build failure",
+			report: `{"ImportPath":"example.com/calc [example.com/calc.test]","Action":"build-output","Output":"# example.com/calc [example.com/calc.test]\n"}
+{"ImportPath":"example.com/calc [example.com/calc.test]","Action":"build-output","Output":"./calc_test.go:5:2: undefined: x\n"}
+{"ImportPath":"example.com/calc [example.com/calc.test]","Action":"build-fail"}
+{"Action":"start","Package":"example.com/calc"}
+{"Action":"output","Package":"example.com/calc","Output":"FAIL\texample.com/calc [build failed]\n"}
+{"Action":"fail","Package":"example.com/calc","Elapsed":0,"FailedBuild":"example.com/calc [example.com/calc.test]"}
+`,
+			want:  []UnitTest{},
+			extra: "# example.com/calc [example.com/calc.test]\n./calc_test.go:5:2: undefined: x\nFAIL\texample.com/calc [build failed]\n",
+		},
+		{
+			name:   "not JSON",
+			report: "go: cannot find main module\n",
+			want:   []UnitTest{},
+			extra:  "go: cannot find main module\n",
+		},
+	})
+}
+
+func TestParseJestJSON(t *testing.T) {
+	testUnitTestReports(t, parseJestJSON, []unitTestReportTest{
+		{
+			name: "report",
+			report: `{"numTotalTests":3,"success":false,"testResults":[` +
+				`{"name":"/home/runner/project/sum.test.js","message":"","status":"failed","assertionResults":[` +
+				`{"ancestorTitles":["sum"],"fullName":"sum adds","title":"adds","status":"passed","duration":4,"failureMessages":[]},` +
+				`{"ancestorTitles":["sum","edge cases"],"fullName":"sum edge cases fails","title":"fails","status":"failed","duration":2,"failureMessages":["Error: \u001b[2mexpect(\u001b[22m\u001b[31mreceived\u001b[39m\u001b[2m).\u001b[22mtoBe\u001b[2m(\u001b[22m\u001b[32mexpected\u001b[39m\u001b[2m) // Object.is equality\u001b[22m\n\nExpected: \u001b[32m4\u001b[39m\nReceived: \u001b[31m3\u001b[39m\n    at Object.toBe (/home/runner/project/sum.test.js:9:20)"]},` +
+				`{"ancestorTitles":[],"fullName":"later","title":"later","status":"todo","duration":null,"failureMessages":[]}]},` +
+				`{"name":"/home/runner/project/broken.test.js","message":"\u001b[1mSyntaxError\u001b[22m: Unexpected token (3:1)","status":"failed","assertionResults":[]}]}`,
+			want: []UnitTest{
+				{Suite: "sum.test.js", Name: "sum › adds", Status: testPassed, DurationMs: 4},
+				{Suite: "sum.test.js", Name: "sum › edge cases › fails", Status: testFailed, DurationMs: 2,
+					Message: "Error: expect(received).toBe(expected) // Object.is equality",
+					Output:  "Error: expect(received).toBe(expected) // Object.is equality\n\nExpected: 4\nReceived: 3\n    at Object.toBe (/home/runner/project/sum.test.js:9:20)"},
+				{Suite: "sum.test.js", Name: "later", Status: testSkipped},
+			},
+			extra: "broken.test.js:\nSyntaxError: Unexpected token (3:1)\n",
+		},
+		{
+			name:   "not a report",
+			report: "Error: Cannot find module 'jest'\n",
+			want:   []UnitTest{},
+			extra:  "Error: Cannot find module 'jest'\n",
+		},
+	})
+}
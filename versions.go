@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Live documents get an automatic version at most this often
+	autoVersionInterval = 2 * time.Minute
+	// Unnamed versions beyond this count are pruned, named snapshots are kept forever
+	maxUnnamedVersions = 200
+	// Line diffs with more edits than this show the versions as fully replaced
+	maxDiffEdits = 4000
+)
+
+type SessionVersion struct {
+	VersionID    int    `json:"version_id"`
+	FileID       int    `json:"file_id"`
+	Author       string `json:"author,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	ContentHash  string `json:"content_hash"`
+	Name         string `json:"name,omitempty"`
+	RestoredFrom int    `json:"restored_from,omitempty"`
+	Content      string `json:"content,omitempty"`
+}
+
+type DiffLine struct {
+	Op   string `json:"op"` // " " unchanged, "-" removed, "+" added
+	Text string `json:"text"`
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordVersion stores content as a new version of a file of the session.
+// Unnamed versions identical to the latest one are skipped. author may be
+// empty for changes nobody can be credited with.
+func recordVersion(sessionID int, fileID int, author string, content string, name string, restoredFrom int) error {
+	hash := contentHash(content)
+	if name == "" && restoredFrom == 0 {
+		var latest string
+		err := db.QueryRow(`SELECT content_hash FROM session_versions WHERE file_id = ?
+			ORDER BY version_id DESC LIMIT 1`, fileID).Scan(&latest)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if latest == hash {
+			return nil
+		}
+	}
+	_, err := db.Exec(`INSERT INTO session_versions(session_id, file_id, user_id, created_at, content, content_hash, name, restored_from)
+		VALUES (?, ?, (SELECT user_id FROM users WHERE username = ?), ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0))`,
+		sessionID, fileID, author, time.Now().UTC().Format(time.RFC3339), content, hash, name, restoredFrom)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM session_versions WHERE file_id = ? AND name IS NULL AND version_id NOT IN (
+			SELECT version_id FROM session_versions WHERE file_id = ? AND name IS NULL
+			ORDER BY version_id DESC LIMIT ?)`, fileID, fileID, maxUnnamedVersions)
+	return err
+}
+
+func getVersion(sessionID, versionID int) (SessionVersion, error) {
+	var v SessionVersion
+	var author, name sql.NullString
+	var restoredFrom sql.NullInt64
+	err := db.QueryRow(`SELECT v.version_id, v.file_id, u.username, v.created_at, v.content_hash, v.name, v.restored_from, v.content
+		FROM session_versions v LEFT JOIN users u ON v.user_id = u.user_id
+		WHERE v.session_id = ? AND v.version_id = ?`, sessionID, versionID).
+		Scan(&v.VersionID, &v.FileID, &author, &v.CreatedAt, &v.ContentHash, &name, &restoredFrom, &v.Content)
+	v.Author, v.Name, v.RestoredFrom = author.String, name.String, int(restoredFrom.Int64)
+	return v, err
+}
+
+// versionFromRequest loads the version named by the given query parameter,
+// writing the error response if that fails.
+func versionFromRequest(w http.ResponseWriter, r *http.Request, sid int, param string) (SessionVersion, bool) {
+	versionID, err := strconv.Atoi(r.FormValue(param))
+	if err != nil {
+		http.Error(w, "Invalid "+param, http.StatusBadRequest)
+		return SessionVersion{}, false
+	}
+	v, err := getVersion(sid, versionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return SessionVersion{}, false
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return SessionVersion{}, false
+	}
+	return v, true
+}
+
+// sessionVersionsHandler lists the versions of a file, newest first, without their content
+func sessionVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	f, ok := fileFromRequest(w, r, sid)
+	if !ok {
+		return
+	}
+	rows, err := db.Query(`SELECT v.version_id, v.file_id, u.username, v.created_at, v.content_hash, v.name, v.restored_from
+		FROM session_versions v LEFT JOIN users u ON v.user_id = u.user_id
+		WHERE v.file_id = ? ORDER BY v.version_id DESC`, f.FileID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	versions := []SessionVersion{}
+	for rows.Next() {
+		var v SessionVersion
+		var author, name sql.NullString
+		var restoredFrom sql.NullInt64
+		if err := rows.Scan(&v.VersionID, &v.FileID, &author, &v.CreatedAt, &v.ContentHash, &name, &restoredFrom); err == nil {
+			v.Author, v.Name, v.RestoredFrom = author.String, name.String, int(restoredFrom.Int64)
+			versions = append(versions, v)
+		}
+	}
+	writeJSON(w, versions)
+}
+
+// sessionVersionHandler returns one version including its content
+func sessionVersionHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	if v, ok := versionFromRequest(w, r, sid, "version_id"); ok {
+		writeJSON(w, v)
+	}
+}
+
+// diffVersionsHandler returns a line diff between version "from" and version
+// "to", or the current content of its file if "to" is not given.
+func diffVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	_, sid, ok := sessionAccess(w, r, r.URL.Query().Get("session_id"))
+	if !ok {
+		return
+	}
+	from, ok := versionFromRequest(w, r, sid, "from")
+	if !ok {
+		return
+	}
+	var to string
+	if r.URL.Query().Get("to") != "" {
+		v, ok := versionFromRequest(w, r, sid, "to")
+		if !ok {
+			return
+		}
+		to = v.Content
+	} else {
+		var err error
+		if to, err = fileText(from.FileID); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, diffLines(strings.Split(from.Content, "\n"), strings.Split(to, "\n")))
+}
+
+// restoreVersionHandler makes an old version the current content of its file
+// for everyone, after recording the content it replaces
+func restoreVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	v, ok := versionFromRequest(w, r, sid, "version_id")
+	if !ok {
+		return
+	}
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM session_files WHERE file_id = ?", v.FileID).Scan(&exists); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if exists == 0 {
+		http.Error(w, "The file of this version was deleted", http.StatusBadRequest)
+		return
+	}
+	// Keep what is there now, edits since the last version would be lost otherwise
+	current, err := fileText(v.FileID)
+	if err == nil {
+		err = recordVersion(sid, v.FileID, username, current, "", 0)
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if err := setFileText(v.FileID, v.Content, username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordVersion(sid, v.FileID, username, v.Content, "", v.VersionID); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SaveResponse{Success: true})
+}
+
+// createSnapshotHandler stores the current content of every file of the
+// session as a named version that is never pruned
+func createSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, sid, ok := sessionRoleAccess(w, r, r.FormValue("session_id"), roleEditor)
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Snapshot name required", http.StatusBadRequest)
+		return
+	}
+	files, err := sessionFiles(sid)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	for _, f := range files {
+		content, err := fileText(f.FileID)
+		if err == nil {
+			err = recordVersion(sid, f.FileID, username, content, name, 0)
+		}
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, SaveResponse{Success: true})
+}
+
+// diffLines computes a line diff with the Myers algorithm. Common leading and
+// trailing lines are stripped first, which keeps typical edits cheap.
+func diffLines(a, b []string) []DiffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var out []DiffLine
+	for _, line := range a[:prefix] {
+		out = append(out, DiffLine{" ", line})
+	}
+	out = append(out, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		out = append(out, DiffLine{" ", line})
+	}
+	return out
+}
+
+func myersDiff(a, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	// v[k] is the furthest x reached on diagonal k; trace[d] keeps v for
+	// diagonals -d-1..d+1 as it was before step d, for backtracking.
+	v := map[int]int{1: 0}
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		if d > maxDiffEdits {
+			return replacedLines(a, b)
+		}
+		snap := make([]int, 2*d+3)
+		for k := -d - 1; k <= d+1; k++ {
+			snap[k+d+1] = v[k]
+		}
+		trace = append(trace, snap)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1] < v[k+1]) {
+				x = v[k+1]
+			} else {
+				x = v[k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackDiff(a, b []string, trace [][]int) []DiffLine {
+	var out []DiffLine
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		snap := trace[d]
+		at := func(k int) int { return snap[k+d+1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			out = append(out, DiffLine{" ", a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				out = append(out, DiffLine{"+", b[y-1]})
+				y--
+			} else {
+				out = append(out, DiffLine{"-", a[x-1]})
+				x--
+			}
+		}
+	}
+	slices.Reverse(out)
+	return out
+}
+
+func replacedLines(a, b []string) []DiffLine {
+	out := make([]DiffLine, 0, len(a)+len(b))
+	for _, line := range a {
+		out = append(out, DiffLine{"-", line})
+	}
+	for _, line := range b {
+		out = append(out, DiffLine{"+", line})
+	}
+	return out
+}
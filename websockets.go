@@ -0,0 +1,604 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// y-websocket message types
+const (
+	messageSync           = 0
+	messageAwareness      = 1
+	messageAuth           = 2
+	messageQueryAwareness = 3
+)
+
+// y-protocols sync message types
+const (
+	syncStep1  = 0
+	syncStep2  = 1
+	syncUpdate = 2
+)
+
+const (
+	// Name of the Y.Text the editor binds CodeMirror to
+	sharedTextName = "shared-text"
+	// How often live documents are written back to the sessions table
+	docPersistInterval = 5 * time.Second
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = 30 * time.Second
+	wsMaxMessageSize = 16 << 20
+)
+
+// The default CheckOrigin only accepts same-origin requests, which together
+// with the jwt cookie keeps other sites from opening sync connections.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// awarenessState is the last known awareness entry of a Yjs client.
+// state is the JSON sent by the client, "null" once it went offline.
+type awarenessState struct {
+	clock uint64
+	state string
+}
+
+// yRoom is the shared document of one file and everyone connected to it.
+type yRoom struct {
+	mu        sync.Mutex
+	sessionID int
+	fileID    int
+	doc       *yDoc
+	conns     map[*yConn]map[uint64]bool // awareness client ids controlled by each connection
+	awareness map[uint64]awarenessState
+	saved     uint64 // doc.changes at the last persist
+	closed    bool   // taken out of rooms, so it is no longer saved
+
+	// Automatic versions of the live document
+	lastEditor  string
+	unversioned bool
+	versioned   time.Time
+}
+
+// wsConn is the write side shared by the WebSocket endpoints: messages are
+// queued on send and written by a single writePump goroutine.
+type wsConn struct {
+	ws        *websocket.Conn
+	msgType   int // websocket.BinaryMessage or websocket.TextMessage
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWsConn(ws *websocket.Conn, msgType int) wsConn {
+	return wsConn{
+		ws:      ws,
+		msgType: msgType,
+		send:    make(chan []byte, 256),
+		done:    make(chan struct{}),
+	}
+}
+
+type yConn struct {
+	wsConn
+	username string
+	readOnly bool // a viewer, whose updates are ignored
+}
+
+var (
+	roomsMu sync.Mutex
+	rooms   = make(map[int]*yRoom) // by file id
+)
+
+// loadRoom creates a room for the file from the state stored in the database.
+// Files that were never opened only have plain text, which becomes the
+// initial content of a fresh document.
+func loadRoom(fileID int) (*yRoom, error) {
+	var sessionID int
+	var content string
+	var state []byte
+	err := db.QueryRow("SELECT session_id, COALESCE(content, ''), ydoc FROM session_files WHERE file_id = ?", fileID).Scan(&sessionID, &content, &state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	room := &yRoom{
+		sessionID: sessionID,
+		fileID:    fileID,
+		doc:       newYDoc(),
+		conns:     make(map[*yConn]map[uint64]bool),
+		awareness: make(map[uint64]awarenessState),
+	}
+	if len(state) > 0 {
+		if err := room.doc.applyUpdate(state); err != nil {
+			return nil, err
+		}
+	} else if content != "" {
+		room.doc.replaceText(sharedTextName, room.doc.newClientID(), content)
+	}
+	room.saved = room.doc.changes
+	return room, nil
+}
+
+// save stores the compacted document and its text if anything changed.
+// The caller must hold room.mu.
+func (room *yRoom) save() error {
+	if room.doc.changes == room.saved {
+		return nil
+	}
+	room.doc.compact()
+	_, err := db.Exec("UPDATE session_files SET content = ?, ydoc = ? WHERE file_id = ?",
+		room.doc.text(sharedTextName), room.doc.encodeStateAsUpdate(nil), room.fileID)
+	if err != nil {
+		return err
+	}
+	room.saved = room.doc.changes
+	room.unversioned = true
+	return nil
+}
+
+// persist saves the room and records a version of the text every autoVersionInterval.
+// The caller must hold room.mu.
+func (room *yRoom) persist() error {
+	if err := room.save(); err != nil {
+		return err
+	}
+	if room.unversioned && time.Since(room.versioned) >= autoVersionInterval {
+		if err := recordVersion(room.sessionID, room.fileID, room.lastEditor, room.doc.text(sharedTextName), "", 0); err != nil {
+			return err
+		}
+		room.unversioned = false
+		room.versioned = time.Now()
+	}
+	return nil
+}
+
+// persistRooms periodically writes every live document back to the database.
+func persistRooms(interval time.Duration) {
+	for range time.Tick(interval) {
+		roomsMu.Lock()
+		live := make([]*yRoom, 0, len(rooms))
+		for _, room := range rooms {
+			live = append(live, room)
+		}
+		roomsMu.Unlock()
+		for _, room := range live {
+			room.mu.Lock()
+			if room.closed {
+				// Its file was deleted since, or it was saved as it emptied
+				room.mu.Unlock()
+				continue
+			}
+			if err := room.persist(); err != nil {
+				log.Printf("ws: saving file %d: %v", room.fileID, err)
+			}
+			room.mu.Unlock()
+		}
+	}
+}
+
+// liveFileContent returns the current text of a file that is open in an editor.
+func liveFileContent(fileID int) (string, bool) {
+	roomsMu.Lock()
+	room := rooms[fileID]
+	roomsMu.Unlock()
+	if room == nil {
+		return "", false
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return room.doc.text(sharedTextName), true
+}
+
+// openRoom returns the room of the file with room.mu held, loading it if
+// nobody has the file open. A room closed meanwhile is left to whoever
+// closed it, or dropped if they did not yet, and the file is looked up again.
+func openRoom(fileID int) (*yRoom, error) {
+	for {
+		roomsMu.Lock()
+		room := rooms[fileID]
+		if room == nil {
+			var err error
+			if room, err = loadRoom(fileID); err != nil {
+				roomsMu.Unlock()
+				return nil, err
+			}
+			rooms[fileID] = room
+		}
+		roomsMu.Unlock()
+		room.mu.Lock()
+		if !room.closed {
+			return room, nil
+		}
+		room.mu.Unlock()
+		dropRoom(room)
+	}
+}
+
+// dropRoom takes a closed room out of rooms, unless the file has a new one
+func dropRoom(room *yRoom) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	if rooms[room.fileID] == room {
+		delete(rooms, room.fileID)
+	}
+}
+
+// setFileText replaces the text of a file as one edit by username, sends the
+// edit to everyone who has the file open and stores the result.
+// Callers record the version themselves.
+func setFileText(fileID int, text string, username string) error {
+	room, err := openRoom(fileID)
+	if err != nil {
+		return err
+	}
+	update := room.doc.replaceText(sharedTextName, room.doc.newClientID(), text)
+	room.broadcast(syncMessage(syncUpdate, update), nil)
+	room.lastEditor = username
+	err = room.save()
+	if len(room.conns) > 0 {
+		room.mu.Unlock()
+		return err
+	}
+	// Nobody has the file open, the database has it all
+	room.closed = true
+	room.mu.Unlock()
+	dropRoom(room)
+	return err
+}
+
+// closeRoom disconnects everyone from a file that is going away, without saving it.
+func closeRoom(fileID int) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	room := rooms[fileID]
+	if room == nil {
+		return
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	for c := range room.conns {
+		c.close()
+	}
+	room.conns = make(map[*yConn]map[uint64]bool)
+	room.closed = true
+	delete(rooms, fileID)
+}
+
+func joinRoom(fileID int, c *yConn) (*yRoom, error) {
+	room, err := openRoom(fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer room.mu.Unlock()
+	room.conns[c] = make(map[uint64]bool)
+
+	// Start the sync handshake and tell the newcomer who is already here
+	c.sendMessage(syncMessage(syncStep1, encodeStateVector(room.doc.stateVector())))
+	var online []uint64
+	for id, s := range room.awareness {
+		if s.state != "null" {
+			online = append(online, id)
+		}
+	}
+	if len(online) > 0 {
+		c.sendMessage(room.awarenessMessage(online))
+	}
+	return room, nil
+}
+
+// leaveRoom removes a connection from the room. The last one to leave saves
+// the room and closes it, outside roomsMu so other files need not wait.
+func leaveRoom(room *yRoom, c *yConn) {
+	room.mu.Lock()
+	ids := room.conns[c]
+	delete(room.conns, c)
+	if len(ids) > 0 {
+		// Mark the awareness states of this connection as offline for everyone else
+		var gone []uint64
+		for id := range ids {
+			s := room.awareness[id]
+			room.awareness[id] = awarenessState{clock: s.clock + 1, state: "null"}
+			gone = append(gone, id)
+		}
+		room.broadcast(room.awarenessMessage(gone), nil)
+	}
+	if len(room.conns) > 0 || room.closed {
+		room.mu.Unlock()
+		return
+	}
+	// Always keep a version of what everybody left behind
+	room.versioned = time.Time{}
+	if err := room.persist(); err != nil {
+		log.Printf("ws: saving file %d: %v", room.fileID, err)
+	}
+	room.closed = true
+	room.mu.Unlock()
+	dropRoom(room)
+}
+
+// broadcast sends msg to every connection of the room except skip.
+// The caller must hold room.mu.
+func (room *yRoom) broadcast(msg []byte, skip *yConn) {
+	for c := range room.conns {
+		if c != skip {
+			c.sendMessage(msg)
+		}
+	}
+}
+
+func syncMessage(step uint64, payload []byte) []byte {
+	e := &yEncoder{}
+	e.writeVarUint(messageSync)
+	e.writeVarUint(step)
+	e.writeVarUint8Array(payload)
+	return e.buf
+}
+
+// awarenessMessage encodes the awareness states of the given clients.
+// The caller must hold room.mu.
+func (room *yRoom) awarenessMessage(ids []uint64) []byte {
+	u := &yEncoder{}
+	u.writeVarUint(uint64(len(ids)))
+	for _, id := range ids {
+		s := room.awareness[id]
+		u.writeVarUint(id)
+		u.writeVarUint(s.clock)
+		u.writeVarString(s.state)
+	}
+	e := &yEncoder{}
+	e.writeVarUint(messageAwareness)
+	e.writeVarUint8Array(u.buf)
+	return e.buf
+}
+
+func (room *yRoom) handleMessage(c *yConn, msg []byte) error {
+	d := &yDecoder{buf: msg}
+	msgType, err := d.readVarUint()
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case messageSync:
+		step, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+		payload, err := d.readVarUint8Array()
+		if err != nil {
+			return err
+		}
+		return room.handleSync(c, step, payload)
+	case messageAwareness:
+		payload, err := d.readVarUint8Array()
+		if err != nil {
+			return err
+		}
+		return room.applyAwareness(c, payload)
+	case messageQueryAwareness:
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		ids := make([]uint64, 0, len(room.awareness))
+		for id := range room.awareness {
+			ids = append(ids, id)
+		}
+		c.sendMessage(room.awarenessMessage(ids))
+	case messageAuth:
+		// Permissions are checked before the upgrade, nothing to do here
+	}
+	return nil
+}
+
+func (room *yRoom) handleSync(c *yConn, step uint64, payload []byte) error {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	switch step {
+	case syncStep1:
+		sv, err := decodeStateVector(payload)
+		if err != nil {
+			return err
+		}
+		c.sendMessage(syncMessage(syncStep2, room.doc.encodeStateAsUpdate(sv)))
+	case syncStep2, syncUpdate:
+		if c.readOnly {
+			// Viewers follow the document but never change it
+			return nil
+		}
+		before := room.doc.changes
+		if err := room.doc.applyUpdate(payload); err != nil {
+			return err
+		}
+		// Relay everything that changed the document or could not be applied
+		// yet; other clients may already know the missing dependencies.
+		if room.doc.changes != before || len(room.doc.pending) > 0 || len(room.doc.pendingDeletes) > 0 {
+			room.broadcast(syncMessage(syncUpdate, payload), c)
+		}
+		if room.doc.changes != before {
+			room.lastEditor = c.username
+		}
+	default:
+		return errors.New("unknown sync message")
+	}
+	return nil
+}
+
+// applyAwareness records the awareness update of c and relays it to the room,
+// including the sender, the same way the y-websocket server does. Viewers,
+// and anyone watching a public session, follow the others without showing
+// up themselves, and a client id belongs to the connection that used it
+// first, so nobody can move someone else's cursor.
+func (room *yRoom) applyAwareness(c *yConn, update []byte) error {
+	if c.readOnly {
+		return nil
+	}
+	d := &yDecoder{buf: update}
+	n, err := d.readVarUint()
+	if err != nil {
+		return err
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	var accepted []uint64
+	for i := uint64(0); i < n; i++ {
+		id, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+		state, err := d.readVarString()
+		if err != nil {
+			return err
+		}
+		if room.awarenessTaken(id, c) {
+			continue
+		}
+		cur, ok := room.awareness[id]
+		if !ok || cur.clock < clock || (cur.clock == clock && state == "null" && cur.state != "null") {
+			room.awareness[id] = awarenessState{clock: clock, state: state}
+		}
+		if state == "null" {
+			delete(room.conns[c], id)
+		} else {
+			room.conns[c][id] = true
+		}
+		accepted = append(accepted, id)
+	}
+	if len(accepted) > 0 {
+		room.broadcast(room.awarenessMessage(accepted), nil)
+	}
+	return nil
+}
+
+// awarenessTaken tells whether a connection other than c controls the
+// awareness client id. The caller must hold room.mu.
+func (room *yRoom) awarenessTaken(id uint64, c *yConn) bool {
+	for other, ids := range room.conns {
+		if other != c && ids[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMessage queues msg for the connection. A client that can't keep up is
+// disconnected; y-websocket reconnects and resyncs on its own.
+func (c *wsConn) sendMessage(msg []byte) {
+	select {
+	case c.send <- msg:
+	case <-c.done:
+	default:
+		c.close()
+	}
+}
+
+func (c *wsConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.ws.Close()
+	})
+}
+
+func (c *wsConn) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.close()
+	}()
+	for {
+		select {
+		case msg := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.ws.WriteMessage(c.msgType, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *yConn) readPump(room *yRoom) {
+	defer func() {
+		leaveRoom(room, c)
+		c.close()
+	}()
+	c.ws.SetReadLimit(wsMaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		msgType, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+		if err := room.handleMessage(c, msg); err != nil {
+			log.Printf("ws: dropping connection of %s to file %d: %v", c.username, room.fileID, err)
+			return
+		}
+	}
+}
+
+// serveYjsWs speaks the y-websocket protocol for /ws?session=<id>&file=<id>,
+// with one document per file. Only the owner and collaborators of the session
+// may join its rooms, and viewers and anyone watching a public session only
+// to follow along.
+func serveYjsWs(w http.ResponseWriter, r *http.Request) {
+	username, sessionID, role, ok := viewerAccess(w, r, r.URL.Query().Get("session"))
+	if !ok {
+		return
+	}
+	fileID, err := strconv.Atoi(r.URL.Query().Get("file"))
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := getSessionFile(sessionID, fileID); errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied with an error
+		return
+	}
+	c := &yConn{wsConn: newWsConn(ws, websocket.BinaryMessage), username: username, readOnly: !atLeast(role, roleEditor)}
+	room, err := joinRoom(fileID, c)
+	if err != nil {
+		log.Printf("ws: loading file %d: %v", fileID, err)
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "session unavailable"), time.Now().Add(wsWriteWait))
+		ws.Close()
+		return
+	}
+	go c.writePump()
+	c.readPump(room)
+}
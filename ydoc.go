@@ -0,0 +1,1031 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sort"
+)
+
+// A minimal server-side implementation of the Yjs CRDT (update format v1).
+// It can merge updates coming from y-websocket clients, answer sync requests
+// with the missing part of the document and project a Y.Text to plain text.
+// The integration algorithm mirrors Item.integrate from yjs, so the server
+// ends up with the same document as every browser.
+
+// yID identifies a struct in a Yjs document.
+type yID struct {
+	client uint64
+	clock  uint64
+}
+
+// Content ref numbers of the Yjs update format.
+const (
+	contentGC      = 0
+	contentDeleted = 1
+	contentJSON    = 2
+	contentBinary  = 3
+	contentString  = 4
+	contentEmbed   = 5
+	contentFormat  = 6
+	contentType    = 7
+	contentAny     = 8
+	contentDoc     = 9
+	contentSkip    = 10
+)
+
+// Items longer than this are rejected as malformed (JS numbers are only safe up to 2^53).
+const maxStructLength = 1 << 53
+
+// Structs and delete ranges waiting for updates we have not seen yet are
+// capped, so updates that never resolve cannot grow a document without
+// limit. Past the cap they are dropped and the update is rejected.
+const (
+	maxPendingStructs = 10000
+	maxPendingDeletes = 10000
+)
+
+type yContent struct {
+	ref  byte
+	str  []uint16 // contentString
+	vals [][]byte // contentJSON and contentAny, one encoded value per element
+	raw  []byte   // single element contents are kept in their encoded form
+	n    uint64   // contentDeleted
+	typ  *yType   // contentType
+}
+
+func (c *yContent) length() uint64 {
+	switch c.ref {
+	case contentDeleted:
+		return c.n
+	case contentString:
+		return uint64(len(c.str))
+	case contentJSON, contentAny:
+		return uint64(len(c.vals))
+	}
+	return 1
+}
+
+func (c *yContent) countable() bool {
+	return c.ref != contentDeleted && c.ref != contentFormat
+}
+
+// splice cuts the content at offset, keeping the left part and returning the right one.
+func (c *yContent) splice(offset uint64) yContent {
+	switch c.ref {
+	case contentDeleted:
+		right := yContent{ref: contentDeleted, n: c.n - offset}
+		c.n = offset
+		return right
+	case contentString:
+		right := yContent{ref: contentString, str: slices.Clone(c.str[offset:])}
+		c.str = c.str[:offset:offset]
+		// Same as yjs: never leave half of a surrogate pair on either side
+		if last := c.str[offset-1]; last >= 0xd800 && last <= 0xdbff {
+			c.str[offset-1] = 0xfffd
+			right.str[0] = 0xfffd
+		}
+		return right
+	case contentJSON, contentAny:
+		right := yContent{ref: c.ref, vals: slices.Clone(c.vals[offset:])}
+		c.vals = c.vals[:offset:offset]
+		return right
+	}
+	return yContent{ref: c.ref, raw: c.raw}
+}
+
+// mergeWith appends right to c if both have the same mergeable kind.
+func (c *yContent) mergeWith(right *yContent) bool {
+	if c.ref != right.ref {
+		return false
+	}
+	switch c.ref {
+	case contentDeleted:
+		c.n += right.n
+		return true
+	case contentString:
+		c.str = append(c.str, right.str...)
+		return true
+	case contentJSON, contentAny:
+		c.vals = append(c.vals, right.vals...)
+		return true
+	}
+	return false
+}
+
+func (c *yContent) write(e *yEncoder, offset uint64) {
+	switch c.ref {
+	case contentDeleted:
+		e.writeVarUint(c.n - offset)
+	case contentString:
+		e.writeVarString(fromUTF16(c.str[offset:]))
+	case contentJSON, contentAny:
+		e.writeVarUint(uint64(len(c.vals)) - offset)
+		for _, v := range c.vals[offset:] {
+			e.writeRaw(v)
+		}
+	default:
+		e.writeRaw(c.raw)
+	}
+}
+
+func readContent(d *yDecoder, ref byte) (yContent, error) {
+	c := yContent{ref: ref}
+	start := d.pos
+	var err error
+	switch ref {
+	case contentDeleted:
+		c.n, err = d.readVarUint()
+	case contentString:
+		var s string
+		s, err = d.readVarString()
+		c.str = toUTF16(s)
+	case contentJSON, contentAny:
+		var n uint64
+		if n, err = d.readVarUint(); err != nil {
+			return c, err
+		}
+		for i := uint64(0); i < n; i++ {
+			vstart := d.pos
+			if ref == contentJSON {
+				_, err = d.readVarUint8Array()
+			} else {
+				_, err = d.readAnyRaw()
+			}
+			if err != nil {
+				return c, err
+			}
+			c.vals = append(c.vals, d.buf[vstart:d.pos])
+		}
+	case contentBinary, contentEmbed:
+		_, err = d.readVarUint8Array()
+	case contentFormat:
+		if _, err = d.readVarUint8Array(); err == nil {
+			_, err = d.readVarUint8Array()
+		}
+	case contentType:
+		var typeRef uint64
+		typeRef, err = d.readVarUint()
+		// YXmlElement and YXmlHook carry a node name / hook name
+		if err == nil && (typeRef == 3 || typeRef == 5) {
+			_, err = d.readVarUint8Array()
+		}
+		c.typ = &yType{}
+	case contentDoc:
+		if _, err = d.readVarUint8Array(); err == nil {
+			_, err = d.readAnyRaw()
+		}
+	default:
+		return c, errors.New("unknown content type")
+	}
+	if err != nil {
+		return c, err
+	}
+	if c.raw == nil && c.str == nil && c.vals == nil && ref != contentDeleted {
+		c.raw = d.buf[start:d.pos]
+	}
+	return c, nil
+}
+
+// yType is a shared type (Y.Text, Y.Map, ...) that items are inserted into.
+type yType struct {
+	item    *yItem // nil for root types
+	name    string // root type name
+	start   *yItem
+	entries map[string]*yItem
+	length  uint64
+}
+
+// yItem is either an Item or a GC struct of the Yjs struct store.
+type yItem struct {
+	id          yID
+	length      uint64
+	origin      *yID
+	rightOrigin *yID
+	left, right *yItem
+	parent      *yType
+	parentID    *yID // parent reference that is resolved on integration
+	parentSub   string
+	hasSub      bool
+	content     yContent
+	deleted     bool
+	gc          bool
+}
+
+func (s *yItem) lastID() yID {
+	return yID{s.id.client, s.id.clock + s.length - 1}
+}
+
+func (s *yItem) toGC() {
+	s.gc = true
+	s.deleted = true
+	s.content = yContent{}
+	s.parent = nil
+	s.left, s.right = nil, nil
+}
+
+type yDeleteRange struct {
+	client, clock, length uint64
+}
+
+// yDoc holds the merged state of one shared document.
+type yDoc struct {
+	structs        map[uint64][]*yItem
+	roots          map[string]*yType
+	pending        map[uint64][]*yItem // structs waiting for updates we have not seen yet
+	pendingDeletes []yDeleteRange
+	changes        uint64 // bumped on every insert or delete
+}
+
+func newYDoc() *yDoc {
+	return &yDoc{
+		structs: make(map[uint64][]*yItem),
+		roots:   make(map[string]*yType),
+		pending: make(map[uint64][]*yItem),
+	}
+}
+
+func (doc *yDoc) root(name string) *yType {
+	t, ok := doc.roots[name]
+	if !ok {
+		t = &yType{name: name}
+		doc.roots[name] = t
+	}
+	return t
+}
+
+func (doc *yDoc) getState(client uint64) uint64 {
+	structs := doc.structs[client]
+	if len(structs) == 0 {
+		return 0
+	}
+	last := structs[len(structs)-1]
+	return last.id.clock + last.length
+}
+
+// stateVector returns the next expected clock of every known client.
+func (doc *yDoc) stateVector() map[uint64]uint64 {
+	sv := make(map[uint64]uint64, len(doc.structs))
+	for client := range doc.structs {
+		sv[client] = doc.getState(client)
+	}
+	return sv
+}
+
+func findStructIndex(structs []*yItem, clock uint64) int {
+	i := sort.Search(len(structs), func(i int) bool {
+		return structs[i].id.clock+structs[i].length > clock
+	})
+	if i < len(structs) && structs[i].id.clock <= clock {
+		return i
+	}
+	return -1
+}
+
+func (doc *yDoc) getItem(id yID) *yItem {
+	structs := doc.structs[id.client]
+	if i := findStructIndex(structs, id.clock); i >= 0 {
+		return structs[i]
+	}
+	return nil
+}
+
+// splitItem splits the struct at index i of client's structs so that the right
+// part starts diff units after the beginning, and returns the right part.
+func (doc *yDoc) splitItem(client uint64, i int, diff uint64) *yItem {
+	left := doc.structs[client][i]
+	right := &yItem{
+		id:          yID{left.id.client, left.id.clock + diff},
+		length:      left.length - diff,
+		origin:      &yID{left.id.client, left.id.clock + diff - 1},
+		rightOrigin: left.rightOrigin,
+		left:        left,
+		right:       left.right,
+		parent:      left.parent,
+		parentSub:   left.parentSub,
+		hasSub:      left.hasSub,
+		content:     left.content.splice(diff),
+		deleted:     left.deleted,
+	}
+	left.right = right
+	if right.right != nil {
+		right.right.left = right
+	}
+	if right.hasSub && right.right == nil && right.parent != nil {
+		right.parent.entries[right.parentSub] = right
+	}
+	left.length = diff
+	doc.structs[client] = slices.Insert(doc.structs[client], i+1, right)
+	return right
+}
+
+// getItemCleanStart returns the item starting at id, splitting if necessary.
+func (doc *yDoc) getItemCleanStart(id yID) *yItem {
+	i := findStructIndex(doc.structs[id.client], id.clock)
+	if i < 0 {
+		return nil
+	}
+	s := doc.structs[id.client][i]
+	if s.id.clock < id.clock && !s.gc {
+		return doc.splitItem(id.client, i, id.clock-s.id.clock)
+	}
+	return s
+}
+
+// getItemCleanEnd returns the item ending at id, splitting if necessary.
+func (doc *yDoc) getItemCleanEnd(id yID) *yItem {
+	i := findStructIndex(doc.structs[id.client], id.clock)
+	if i < 0 {
+		return nil
+	}
+	s := doc.structs[id.client][i]
+	if id.clock != s.id.clock+s.length-1 && !s.gc {
+		doc.splitItem(id.client, i, id.clock-s.id.clock+1)
+	}
+	return s
+}
+
+func readID(d *yDecoder) (*yID, error) {
+	client, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	clock, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return &yID{client, clock}, nil
+}
+
+// readUpdate decodes a v1 update into structs grouped by client and a delete set.
+// Skip structs only mark gaps, so they are dropped here.
+func (doc *yDoc) readUpdate(update []byte) (map[uint64][]*yItem, []yDeleteRange, error) {
+	d := &yDecoder{buf: update}
+	refs := make(map[uint64][]*yItem)
+	numClients, err := d.readVarUint()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := uint64(0); i < numClients; i++ {
+		numStructs, err := d.readVarUint()
+		if err != nil {
+			return nil, nil, err
+		}
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, nil, err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, nil, err
+		}
+		for j := uint64(0); j < numStructs; j++ {
+			info, err := d.readUint8()
+			if err != nil {
+				return nil, nil, err
+			}
+			s := &yItem{id: yID{client, clock}}
+			switch info & 0x1f {
+			case contentGC, contentSkip:
+				if s.length, err = d.readVarUint(); err != nil {
+					return nil, nil, err
+				}
+				s.gc, s.deleted = true, true
+			default:
+				if info&0x80 != 0 {
+					if s.origin, err = readID(d); err != nil {
+						return nil, nil, err
+					}
+				}
+				if info&0x40 != 0 {
+					if s.rightOrigin, err = readID(d); err != nil {
+						return nil, nil, err
+					}
+				}
+				if info&0xc0 == 0 {
+					parentInfo, err := d.readVarUint()
+					if err != nil {
+						return nil, nil, err
+					}
+					if parentInfo == 1 {
+						name, err := d.readVarString()
+						if err != nil {
+							return nil, nil, err
+						}
+						s.parent = doc.root(name)
+					} else if s.parentID, err = readID(d); err != nil {
+						return nil, nil, err
+					}
+					if info&0x20 != 0 {
+						if s.parentSub, err = d.readVarString(); err != nil {
+							return nil, nil, err
+						}
+						s.hasSub = true
+					}
+				}
+				if s.content, err = readContent(d, info&0x1f); err != nil {
+					return nil, nil, err
+				}
+				if s.content.typ != nil {
+					s.content.typ.item = s
+				}
+				s.length = s.content.length()
+			}
+			if s.length == 0 || clock > maxStructLength || s.length > maxStructLength-clock {
+				return nil, nil, errors.New("invalid struct length")
+			}
+			clock += s.length
+			if info&0x1f != contentSkip {
+				refs[client] = append(refs[client], s)
+			}
+		}
+	}
+	deletes, err := readDeleteSet(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	return refs, deletes, nil
+}
+
+func readDeleteSet(d *yDecoder) ([]yDeleteRange, error) {
+	var deletes []yDeleteRange
+	numClients, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numClients; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < n; j++ {
+			clock, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			length, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			if length > 0 && clock <= maxStructLength && length <= maxStructLength-clock {
+				deletes = append(deletes, yDeleteRange{client, clock, length})
+			}
+		}
+	}
+	return deletes, nil
+}
+
+// applyUpdate merges a v1 update into the document. Structs whose
+// dependencies are still unknown are kept until a later update provides them.
+func (doc *yDoc) applyUpdate(update []byte) error {
+	refs, deletes, err := doc.readUpdate(update)
+	if err != nil {
+		return err
+	}
+	for client, structs := range refs {
+		queue := append(doc.pending[client], structs...)
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].id.clock < queue[j].id.clock })
+		doc.pending[client] = queue
+	}
+	doc.integratePending()
+	doc.pendingDeletes = append(doc.pendingDeletes, deletes...)
+	doc.applyPendingDeletes()
+	pending := 0
+	for _, queue := range doc.pending {
+		pending += len(queue)
+	}
+	if pending > maxPendingStructs || len(doc.pendingDeletes) > maxPendingDeletes {
+		doc.pending = make(map[uint64][]*yItem)
+		doc.pendingDeletes = nil
+		return errors.New("too many pending structs")
+	}
+	return nil
+}
+
+func (doc *yDoc) integratePending() {
+	for progress := true; progress; {
+		progress = false
+		for client, queue := range doc.pending {
+			for len(queue) > 0 {
+				s := queue[0]
+				state := doc.getState(client)
+				if s.id.clock > state {
+					break
+				}
+				offset := state - s.id.clock
+				if offset >= s.length {
+					queue = queue[1:]
+					continue
+				}
+				if doc.isMissing(s) {
+					break
+				}
+				doc.integrate(s, offset)
+				queue = queue[1:]
+				progress = true
+			}
+			if len(queue) == 0 {
+				delete(doc.pending, client)
+			} else {
+				doc.pending[client] = queue
+			}
+		}
+	}
+}
+
+// isMissing reports whether s refers to structs that were not integrated yet.
+func (doc *yDoc) isMissing(s *yItem) bool {
+	if s.gc {
+		return false
+	}
+	for _, id := range []*yID{s.origin, s.rightOrigin, s.parentID} {
+		if id != nil && id.clock >= doc.getState(id.client) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameID(a, b *yID) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// integrate inserts s into the document, following Item.integrate from yjs.
+func (doc *yDoc) integrate(s *yItem, offset uint64) {
+	if !s.gc {
+		doc.resolve(s)
+	}
+	if offset > 0 {
+		s.id.clock += offset
+		s.length -= offset
+		if !s.gc {
+			s.left = doc.getItemCleanEnd(yID{s.id.client, s.id.clock - 1})
+			last := s.left.lastID()
+			s.origin = &last
+			s.content = s.content.splice(offset)
+		}
+	}
+	doc.changes++
+	if s.gc || s.parent == nil {
+		s.toGC()
+		doc.structs[s.id.client] = append(doc.structs[s.id.client], s)
+		return
+	}
+
+	parent := s.parent
+	if (s.left == nil && (s.right == nil || s.right.left != nil)) || (s.left != nil && s.left.right != s.right) {
+		left := s.left
+		var o *yItem
+		if left != nil {
+			o = left.right
+		} else if s.hasSub {
+			o = parent.entries[s.parentSub]
+			for o != nil && o.left != nil {
+				o = o.left
+			}
+		} else {
+			o = parent.start
+		}
+		conflicting := make(map[*yItem]bool)
+		beforeOrigin := make(map[*yItem]bool)
+		for o != nil && o != s.right {
+			beforeOrigin[o] = true
+			conflicting[o] = true
+			if sameID(s.origin, o.origin) {
+				if o.id.client < s.id.client {
+					left = o
+					clear(conflicting)
+				} else if sameID(s.rightOrigin, o.rightOrigin) {
+					break
+				}
+			} else if o.origin != nil && beforeOrigin[doc.getItem(*o.origin)] {
+				if !conflicting[doc.getItem(*o.origin)] {
+					left = o
+					clear(conflicting)
+				}
+			} else {
+				break
+			}
+			o = o.right
+		}
+		s.left = left
+	}
+
+	if s.left != nil {
+		s.right = s.left.right
+		s.left.right = s
+	} else {
+		var r *yItem
+		if s.hasSub {
+			r = parent.entries[s.parentSub]
+			for r != nil && r.left != nil {
+				r = r.left
+			}
+		} else {
+			r = parent.start
+			parent.start = s
+		}
+		s.right = r
+	}
+	if s.right != nil {
+		s.right.left = s
+	} else if s.hasSub {
+		if parent.entries == nil {
+			parent.entries = make(map[string]*yItem)
+		}
+		parent.entries[s.parentSub] = s
+		if s.left != nil {
+			// s is the current value of the map key now
+			doc.deleteItem(s.left)
+		}
+	}
+	if !s.hasSub && s.content.countable() && !s.deleted {
+		parent.length += s.length
+	}
+	doc.structs[s.id.client] = append(doc.structs[s.id.client], s)
+	if (parent.item != nil && parent.item.deleted) || (s.hasSub && s.right != nil) {
+		doc.deleteItem(s)
+	}
+}
+
+// resolve looks up the neighbours and the parent of s, like Item.getMissing in yjs.
+func (doc *yDoc) resolve(s *yItem) {
+	if s.origin != nil {
+		s.left = doc.getItemCleanEnd(*s.origin)
+		if s.left == nil {
+			s.parent = nil
+			return
+		}
+		last := s.left.lastID()
+		s.origin = &last
+	}
+	if s.rightOrigin != nil {
+		s.right = doc.getItemCleanStart(*s.rightOrigin)
+		if s.right == nil {
+			s.parent = nil
+			return
+		}
+		id := s.right.id
+		s.rightOrigin = &id
+	}
+	switch {
+	case (s.left != nil && s.left.gc) || (s.right != nil && s.right.gc):
+		s.parent = nil
+	case s.parentID != nil:
+		s.parent = nil
+		if p := doc.getItem(*s.parentID); p != nil && !p.gc && p.content.typ != nil {
+			s.parent = p.content.typ
+		}
+	case s.parent == nil:
+		if s.left != nil {
+			s.parent, s.parentSub, s.hasSub = s.left.parent, s.left.parentSub, s.left.hasSub
+		} else if s.right != nil {
+			s.parent, s.parentSub, s.hasSub = s.right.parent, s.right.parentSub, s.right.hasSub
+		}
+	}
+}
+
+func (doc *yDoc) deleteItem(s *yItem) {
+	if s.deleted {
+		return
+	}
+	if s.parent != nil && !s.hasSub && s.content.countable() {
+		s.parent.length -= s.length
+	}
+	s.deleted = true
+	doc.changes++
+	if t := s.content.typ; t != nil {
+		for it := t.start; it != nil; it = it.right {
+			doc.deleteItem(it)
+		}
+		for _, it := range t.entries {
+			doc.deleteItem(it)
+		}
+	}
+}
+
+// applyPendingDeletes deletes every known part of the pending delete ranges
+// and keeps the rest for later.
+func (doc *yDoc) applyPendingDeletes() {
+	var rest []yDeleteRange
+	for _, r := range doc.pendingDeletes {
+		end := r.clock + r.length
+		if state := doc.getState(r.client); end > state {
+			from := max(r.clock, state)
+			rest = append(rest, yDeleteRange{r.client, from, end - from})
+			end = from
+		}
+		if r.clock < end {
+			doc.deleteRange(r.client, r.clock, end)
+		}
+	}
+	doc.pendingDeletes = rest
+}
+
+func (doc *yDoc) deleteRange(client, clock, end uint64) {
+	i := findStructIndex(doc.structs[client], clock)
+	if i < 0 {
+		return
+	}
+	if s := doc.structs[client][i]; !s.deleted && s.id.clock < clock {
+		doc.splitItem(client, i, clock-s.id.clock)
+		i++
+	}
+	for ; i < len(doc.structs[client]); i++ {
+		s := doc.structs[client][i]
+		if s.id.clock >= end {
+			break
+		}
+		if !s.deleted {
+			if end < s.id.clock+s.length {
+				doc.splitItem(client, i, end-s.id.clock)
+			}
+			doc.deleteItem(s)
+		}
+	}
+}
+
+func writeID(e *yEncoder, id yID) {
+	e.writeVarUint(id.client)
+	e.writeVarUint(id.clock)
+}
+
+func (doc *yDoc) writeStruct(e *yEncoder, s *yItem, offset uint64) {
+	if s.gc {
+		e.writeUint8(contentGC)
+		e.writeVarUint(s.length - offset)
+		return
+	}
+	origin := s.origin
+	if offset > 0 {
+		origin = &yID{s.id.client, s.id.clock + offset - 1}
+	}
+	info := s.content.ref & 0x1f
+	if origin != nil {
+		info |= 0x80
+	}
+	if s.rightOrigin != nil {
+		info |= 0x40
+	}
+	if s.hasSub {
+		info |= 0x20
+	}
+	e.writeUint8(info)
+	if origin != nil {
+		writeID(e, *origin)
+	}
+	if s.rightOrigin != nil {
+		writeID(e, *s.rightOrigin)
+	}
+	if origin == nil && s.rightOrigin == nil {
+		if s.parent.item == nil {
+			e.writeVarUint(1)
+			e.writeVarString(s.parent.name)
+		} else {
+			e.writeVarUint(0)
+			writeID(e, s.parent.item.id)
+		}
+		if s.hasSub {
+			e.writeVarString(s.parentSub)
+		}
+	}
+	s.content.write(e, offset)
+}
+
+// sortedClients returns the clients of m in descending order, as yjs writes them.
+func sortedClients[V any](m map[uint64]V) []uint64 {
+	clients := make([]uint64, 0, len(m))
+	for client := range m {
+		clients = append(clients, client)
+	}
+	slices.Sort(clients)
+	slices.Reverse(clients)
+	return clients
+}
+
+// encodeStateAsUpdate encodes everything the owner of state vector sv is
+// missing, followed by the full delete set of the document.
+func (doc *yDoc) encodeStateAsUpdate(sv map[uint64]uint64) []byte {
+	e := &yEncoder{}
+	var clients []uint64
+	for _, client := range sortedClients(doc.structs) {
+		if doc.getState(client) > sv[client] {
+			clients = append(clients, client)
+		}
+	}
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		structs := doc.structs[client]
+		clock := sv[client]
+		i := findStructIndex(structs, clock)
+		e.writeVarUint(uint64(len(structs) - i))
+		e.writeVarUint(client)
+		e.writeVarUint(clock)
+		doc.writeStruct(e, structs[i], clock-structs[i].id.clock)
+		for _, s := range structs[i+1:] {
+			doc.writeStruct(e, s, 0)
+		}
+	}
+	doc.writeDeleteSet(e)
+	return e.buf
+}
+
+func (doc *yDoc) writeDeleteSet(e *yEncoder) {
+	ranges := make(map[uint64][]yDeleteRange)
+	for client, structs := range doc.structs {
+		for _, s := range structs {
+			if !s.deleted {
+				continue
+			}
+			rs := ranges[client]
+			if n := len(rs); n > 0 && rs[n-1].clock+rs[n-1].length == s.id.clock {
+				rs[n-1].length += s.length
+			} else {
+				ranges[client] = append(rs, yDeleteRange{client, s.id.clock, s.length})
+			}
+		}
+	}
+	e.writeVarUint(uint64(len(ranges)))
+	for _, client := range sortedClients(ranges) {
+		e.writeVarUint(client)
+		e.writeVarUint(uint64(len(ranges[client])))
+		for _, r := range ranges[client] {
+			e.writeVarUint(r.clock)
+			e.writeVarUint(r.length)
+		}
+	}
+}
+
+func encodeStateVector(sv map[uint64]uint64) []byte {
+	e := &yEncoder{}
+	e.writeVarUint(uint64(len(sv)))
+	for _, client := range sortedClients(sv) {
+		e.writeVarUint(client)
+		e.writeVarUint(sv[client])
+	}
+	return e.buf
+}
+
+func decodeStateVector(b []byte) (map[uint64]uint64, error) {
+	d := &yDecoder{buf: b}
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	sv := make(map[uint64]uint64)
+	for i := uint64(0); i < n; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		sv[client] = clock
+	}
+	return sv, nil
+}
+
+// text returns the plain text of the root Y.Text called name.
+func (doc *yDoc) text(name string) string {
+	t := doc.roots[name]
+	if t == nil {
+		return ""
+	}
+	var buf []uint16
+	for it := t.start; it != nil; it = it.right {
+		if !it.deleted && it.content.ref == contentString {
+			buf = append(buf, it.content.str...)
+		}
+	}
+	return fromUTF16(buf)
+}
+
+// compact replaces the content of deleted items with a tombstone and merges
+// neighbouring structs, like the yjs garbage collector does. Deleted shared
+// types are left alone because their children still refer to them.
+func (doc *yDoc) compact() {
+	for client, structs := range doc.structs {
+		for _, s := range structs {
+			if s.deleted && !s.gc && s.content.typ == nil && s.content.ref != contentDeleted {
+				s.content = yContent{ref: contentDeleted, n: s.length}
+			}
+		}
+		merged := structs[:1]
+		for _, s := range structs[1:] {
+			if !doc.tryMerge(merged[len(merged)-1], s) {
+				merged = append(merged, s)
+			}
+		}
+		clear(structs[len(merged):])
+		doc.structs[client] = merged
+	}
+}
+
+// tryMerge appends right to left if right directly continues left.
+func (doc *yDoc) tryMerge(left, right *yItem) bool {
+	if left.gc || right.gc {
+		if left.gc && right.gc {
+			left.length += right.length
+			return true
+		}
+		return false
+	}
+	if right.origin == nil || *right.origin != left.lastID() || left.right != right ||
+		!sameID(left.rightOrigin, right.rightOrigin) || left.deleted != right.deleted ||
+		!left.content.mergeWith(&right.content) {
+		return false
+	}
+	left.right = right.right
+	if left.right != nil {
+		left.right.left = left
+	}
+	if right.hasSub && right.parent.entries[right.parentSub] == right {
+		right.parent.entries[right.parentSub] = left
+	}
+	left.length += right.length
+	return true
+}
+
+// newClientID picks a random Yjs client id that is not used in the document
+// yet, for changes made by the server itself.
+func (doc *yDoc) newClientID() uint64 {
+	for {
+		client := uint64(rand.Uint32())
+		if _, ok := doc.structs[client]; !ok {
+			return client
+		}
+	}
+}
+
+// replaceText turns the root Y.Text called name into text with one delete and
+// one insert, made as client, and returns the update describing the change.
+// Positions count string content only, which is all CodeMirror ever inserts.
+func (doc *yDoc) replaceText(name string, client uint64, text string) []byte {
+	before := doc.stateVector()
+	old, nw := toUTF16(doc.text(name)), toUTF16(text)
+	prefix := 0
+	for prefix < len(old) && prefix < len(nw) && old[prefix] == nw[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(nw)-prefix && old[len(old)-1-suffix] == nw[len(nw)-1-suffix] {
+		suffix++
+	}
+	t := doc.root(name)
+
+	// Find the item left of the change, splitting the one the change starts in
+	var left *yItem
+	pos := uint64(0)
+	for it := t.start; it != nil && pos < uint64(prefix); it = it.right {
+		if !it.deleted && it.content.ref == contentString {
+			if pos+it.length > uint64(prefix) {
+				doc.getItemCleanEnd(yID{it.id.client, it.id.clock + uint64(prefix) - pos - 1})
+			}
+			pos += it.length
+		}
+		left = it
+	}
+	right := t.start
+	if left != nil {
+		right = left.right
+	}
+
+	remaining := uint64(len(old) - prefix - suffix)
+	for it := right; it != nil && remaining > 0; it = it.right {
+		if it.deleted || it.content.ref != contentString {
+			continue
+		}
+		if remaining < it.length {
+			doc.getItemCleanEnd(yID{it.id.client, it.id.clock + remaining - 1})
+		}
+		remaining -= it.length
+		doc.deleteItem(it)
+	}
+
+	if ins := nw[prefix : len(nw)-suffix]; len(ins) > 0 {
+		s := &yItem{
+			id:      yID{client, doc.getState(client)},
+			length:  uint64(len(ins)),
+			content: yContent{ref: contentString, str: slices.Clone(ins)},
+		}
+		if left != nil {
+			last := left.lastID()
+			s.origin = &last
+		}
+		if right != nil {
+			id := right.id
+			s.rightOrigin = &id
+		}
+		if s.origin == nil && s.rightOrigin == nil {
+			s.parent = t
+		}
+		doc.integrate(s, 0)
+	}
+	return doc.encodeStateAsUpdate(before)
+}
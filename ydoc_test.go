@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// Client ids of the fixtures, random 32 bit numbers like yjs picks
+const (
+	clientA = 3922815383
+	clientB = 1158329546
+)
+
+// Updates as yjs encodes them (v1). Client A types "hello" into a fresh
+// document, B appends " world" and A then deletes "lo w".
+var (
+	updateHello = []byte{
+		0x01,                               // one client
+		0x01,                               // one struct
+		0x97, 0xd3, 0xc5, 0xce, 0x0e, 0x00, // client A from clock 0
+		0x04,                                                              // string, no origins
+		0x01, 0x0b, 's', 'h', 'a', 'r', 'e', 'd', '-', 't', 'e', 'x', 't', // parent is the root "shared-text"
+		0x05, 'h', 'e', 'l', 'l', 'o',
+		0x00, // empty delete set
+	}
+	updateWorld = []byte{
+		0x01, 0x01,
+		0xca, 0xe9, 0xaa, 0xa8, 0x04, 0x00, // client B from clock 0
+		0x84, 0x97, 0xd3, 0xc5, 0xce, 0x0e, 0x04, // string right of A:4
+		0x06, ' ', 'w', 'o', 'r', 'l', 'd',
+		0x00,
+	}
+	updateDeleteLoW = []byte{
+		0x00,                                           // no structs
+		0x02,                                           // deletes of two clients
+		0x97, 0xd3, 0xc5, 0xce, 0x0e, 0x01, 0x03, 0x02, // A: clock 3, length 2
+		0xca, 0xe9, 0xaa, 0xa8, 0x04, 0x01, 0x00, 0x02, // B: clock 0, length 2
+	}
+	// What yjs stores after the three, once its garbage collector replaced
+	// the deleted text
+	stateHelorld = []byte{
+		0x02,
+		0x02, 0x97, 0xd3, 0xc5, 0xce, 0x0e, 0x00,
+		0x04, 0x01, 0x0b, 's', 'h', 'a', 'r', 'e', 'd', '-', 't', 'e', 'x', 't', 0x03, 'h', 'e', 'l',
+		0x81, 0x97, 0xd3, 0xc5, 0xce, 0x0e, 0x02, 0x02, // deleted, right of A:2
+		0x02, 0xca, 0xe9, 0xaa, 0xa8, 0x04, 0x00,
+		0x81, 0x97, 0xd3, 0xc5, 0xce, 0x0e, 0x04, 0x02,
+		0x84, 0xca, 0xe9, 0xaa, 0xa8, 0x04, 0x01, 0x04, 'o', 'r', 'l', 'd',
+		0x02,
+		0x97, 0xd3, 0xc5, 0xce, 0x0e, 0x01, 0x03, 0x02,
+		0xca, 0xe9, 0xaa, 0xa8, 0x04, 0x01, 0x00, 0x02,
+	}
+)
+
+// ytextUpdate encodes an update of one string inserted by client at clock.
+// Without origin the string goes at the start of "shared-text".
+func ytextUpdate(client, clock uint64, origin, rightOrigin *yID, text string) []byte {
+	e := &yEncoder{}
+	e.writeVarUint(1)
+	e.writeVarUint(1)
+	e.writeVarUint(client)
+	e.writeVarUint(clock)
+	info := byte(contentString)
+	if origin != nil {
+		info |= 0x80
+	}
+	if rightOrigin != nil {
+		info |= 0x40
+	}
+	e.writeUint8(info)
+	if origin != nil {
+		writeID(e, *origin)
+	}
+	if rightOrigin != nil {
+		writeID(e, *rightOrigin)
+	}
+	if origin == nil && rightOrigin == nil {
+		e.writeVarUint(1)
+		e.writeVarString(sharedTextName)
+	}
+	e.writeVarString(text)
+	e.writeVarUint(0)
+	return e.buf
+}
+
+// deleteUpdate encodes an update that deletes a range of client's structs
+func deleteUpdate(client, clock, length uint64) []byte {
+	e := &yEncoder{}
+	e.writeVarUint(0)
+	e.writeVarUint(1)
+	e.writeVarUint(client)
+	e.writeVarUint(1)
+	e.writeVarUint(clock)
+	e.writeVarUint(length)
+	return e.buf
+}
+
+// applyAll applies updates to a fresh document
+func applyAll(t *testing.T, updates ...[]byte) *yDoc {
+	t.Helper()
+	doc := newYDoc()
+	for i, u := range updates {
+		if err := doc.applyUpdate(u); err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+	}
+	return doc
+}
+
+// pendingStructs counts the structs waiting for updates
+func pendingStructs(doc *yDoc) int {
+	n := 0
+	for _, queue := range doc.pending {
+		n += len(queue)
+	}
+	return n
+}
+
+func TestYDocRoundTrip(t *testing.T) {
+	doc := applyAll(t, updateHello)
+	if got := doc.encodeStateAsUpdate(nil); !bytes.Equal(got, updateHello) {
+		t.Errorf("state %x, want %x", got, updateHello)
+	}
+	sv := doc.stateVector()
+	if err := doc.applyUpdate(updateWorld); err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.encodeStateAsUpdate(sv); !bytes.Equal(got, updateWorld) {
+		t.Errorf("update since %v is %x, want %x", sv, got, updateWorld)
+	}
+	if err := doc.applyUpdate(updateDeleteLoW); err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.text(sharedTextName); got != "helorld" {
+		t.Fatalf("text %q, want %q", got, "helorld")
+	}
+
+	doc.compact()
+	state := doc.encodeStateAsUpdate(nil)
+	if !bytes.Equal(state, stateHelorld) {
+		t.Errorf("compacted state %x, want %x", state, stateHelorld)
+	}
+	copied := applyAll(t, state)
+	if got := copied.text(sharedTextName); got != "helorld" {
+		t.Errorf("copy has text %q, want %q", got, "helorld")
+	}
+	if got := copied.encodeStateAsUpdate(nil); !bytes.Equal(got, state) {
+		t.Errorf("copy encodes as %x, want %x", got, state)
+	}
+	// Updates the document has seen already change nothing
+	for _, u := range [][]byte{updateHello, updateWorld, updateDeleteLoW, state} {
+		if err := copied.applyUpdate(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := copied.encodeStateAsUpdate(nil); !bytes.Equal(got, state) {
+		t.Errorf("after applying again %x, want %x", got, state)
+	}
+}
+
+func TestYDocUTF16(t *testing.T) {
+	// yjs counts in UTF-16 code units, the emoji takes two clocks
+	doc := applyAll(t,
+		ytextUpdate(clientA, 0, nil, nil, "a😀b"),
+		ytextUpdate(clientB, 0, &yID{clientA, 2}, &yID{clientA, 3}, "!"))
+	if got := doc.text(sharedTextName); got != "a😀!b" {
+		t.Errorf("text %q, want %q", got, "a😀!b")
+	}
+	if got := doc.getState(clientA); got != 4 {
+		t.Errorf("state of A %d, want 4", got)
+	}
+}
+
+func TestYDocConcurrentInserts(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    [][]byte
+		inserts [][]byte
+		want    string
+	}{
+		{
+			name: "empty document",
+			inserts: [][]byte{
+				ytextUpdate(clientA, 0, nil, nil, "a"),
+				ytextUpdate(clientB, 0, nil, nil, "b"),
+				ytextUpdate(7, 0, nil, nil, "c"),
+			},
+			want: "cba",
+		},
+		{
+			name: "end of the text",
+			base: [][]byte{updateHello},
+			inserts: [][]byte{
+				ytextUpdate(clientA, 5, &yID{clientA, 4}, nil, "X"),
+				ytextUpdate(clientB, 0, &yID{clientA, 4}, nil, "Y"),
+				ytextUpdate(7, 0, &yID{clientA, 4}, nil, "Z"),
+			},
+			want: "helloZYX",
+		},
+		{
+			name: "between two characters",
+			base: [][]byte{updateHello},
+			inserts: [][]byte{
+				ytextUpdate(clientB, 0, &yID{clientA, 1}, &yID{clientA, 2}, "BB"),
+				ytextUpdate(7, 0, &yID{clientA, 1}, &yID{clientA, 2}, "C"),
+				ytextUpdate(8, 0, &yID{clientA, 1}, &yID{clientA, 2}, "D"),
+			},
+			want: "heCDBBllo",
+		},
+	}
+	orders := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state []byte
+			for _, order := range orders {
+				doc := applyAll(t, tt.base...)
+				for _, i := range order {
+					if err := doc.applyUpdate(tt.inserts[i]); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if got := doc.text(sharedTextName); got != tt.want {
+					t.Errorf("order %v: text %q, want %q", order, got, tt.want)
+				}
+				// Every order ends with the same document
+				doc.compact()
+				if s := doc.encodeStateAsUpdate(nil); state == nil {
+					state = s
+				} else if !bytes.Equal(s, state) {
+					t.Errorf("order %v: state %x, want %x", order, s, state)
+				}
+			}
+		})
+	}
+}
+
+func TestYDocDeleteAcrossMergedStructs(t *testing.T) {
+	abc := ytextUpdate(clientA, 0, nil, nil, "abc")
+	def := ytextUpdate(clientA, 3, &yID{clientA, 2}, nil, "def")
+	tests := []struct {
+		name    string
+		updates [][]byte
+		want    string
+	}{
+		{"inside one struct", [][]byte{deleteUpdate(clientA, 1, 4)}, "af"},
+		{"to the end", [][]byte{deleteUpdate(clientA, 2, 4)}, "ab"},
+		{"overlapping ranges", [][]byte{deleteUpdate(clientA, 1, 2), deleteUpdate(clientA, 2, 2)}, "aef"},
+		{"twice", [][]byte{deleteUpdate(clientA, 0, 3), deleteUpdate(clientA, 0, 3)}, "def"},
+		{"past the known clock", [][]byte{deleteUpdate(clientA, 4, 10)}, "abcd"},
+		{
+			"across clients",
+			[][]byte{ytextUpdate(clientB, 0, &yID{clientA, 2}, &yID{clientA, 3}, "XY"), updateDeleteRanges(
+				yDeleteRange{clientA, 2, 2}, yDeleteRange{clientB, 0, 1})},
+			"abYef",
+		},
+	}
+	for _, tt := range tests {
+		for _, compact := range []bool{false, true} {
+			name := tt.name
+			if compact {
+				name += " compacted"
+			}
+			t.Run(name, func(t *testing.T) {
+				doc := applyAll(t, abc, def)
+				if compact {
+					doc.compact()
+					if n := len(doc.structs[clientA]); n != 1 {
+						t.Fatalf("%d structs after compacting, want 1", n)
+					}
+				}
+				for _, u := range tt.updates {
+					if err := doc.applyUpdate(u); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if got := doc.text(sharedTextName); got != tt.want {
+					t.Errorf("text %q, want %q", got, tt.want)
+				}
+				doc.compact()
+				copied := applyAll(t, doc.encodeStateAsUpdate(nil))
+				if got := copied.text(sharedTextName); got != tt.want {
+					t.Errorf("copy has text %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// updateDeleteRanges encodes an update that only deletes, one range per client
+func updateDeleteRanges(ranges ...yDeleteRange) []byte {
+	e := &yEncoder{}
+	e.writeVarUint(0)
+	e.writeVarUint(uint64(len(ranges)))
+	for _, r := range ranges {
+		e.writeVarUint(r.client)
+		e.writeVarUint(1)
+		e.writeVarUint(r.clock)
+		e.writeVarUint(r.length)
+	}
+	return e.buf
+}
+
+func TestYDocOutOfOrder(t *testing.T) {
+	abc := ytextUpdate(clientA, 0, nil, nil, "abc")
+	def := ytextUpdate(clientA, 3, &yID{clientA, 2}, nil, "def")
+	tests := []struct {
+		name    string
+		early   [][]byte // wait in the pending queue
+		late    [][]byte // make them apply
+		want    string
+		wantNow string // text before the late updates
+	}{
+		{"insert of another client", [][]byte{updateWorld}, [][]byte{updateHello}, "hello world", ""},
+		{"later clock of the same client", [][]byte{def}, [][]byte{abc}, "abcdef", ""},
+		{"delete before its insert", [][]byte{updateDeleteLoW}, [][]byte{updateHello, updateWorld}, "helorld", ""},
+		{"delete of a missing part", [][]byte{updateHello, updateDeleteLoW}, [][]byte{updateWorld}, "helorld", "hel"},
+		{
+			"chain",
+			[][]byte{updateDeleteLoW, ytextUpdate(7, 0, &yID{clientB, 5}, nil, "!"), updateWorld},
+			[][]byte{updateHello},
+			"helorld!", "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := applyAll(t, tt.early...)
+			if got := doc.text(sharedTextName); got != tt.wantNow {
+				t.Errorf("text before %q, want %q", got, tt.wantNow)
+			}
+			if pendingStructs(doc) == 0 && len(doc.pendingDeletes) == 0 {
+				t.Error("nothing is pending")
+			}
+			for _, u := range tt.late {
+				if err := doc.applyUpdate(u); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := doc.text(sharedTextName); got != tt.want {
+				t.Errorf("text %q, want %q", got, tt.want)
+			}
+			if n := pendingStructs(doc); n > 0 || len(doc.pendingDeletes) > 0 {
+				t.Errorf("%d structs and %d deletes still pending", n, len(doc.pendingDeletes))
+			}
+		})
+	}
+}
+
+func TestYDocOverlappingUpdate(t *testing.T) {
+	// The whole state arrives at a document that has its start already
+	doc := applyAll(t, ytextUpdate(clientA, 0, nil, nil, "abc"), ytextUpdate(clientA, 3, &yID{clientA, 2}, nil, "def"))
+	doc.compact()
+	state := doc.encodeStateAsUpdate(nil)
+	partial := applyAll(t, ytextUpdate(clientA, 0, nil, nil, "abc"), state)
+	if got := partial.text(sharedTextName); got != "abcdef" {
+		t.Errorf("text %q, want %q", got, "abcdef")
+	}
+}
+
+func TestYDocMalformedUpdates(t *testing.T) {
+	tests := []struct {
+		name   string
+		update []byte
+	}{
+		{"empty", nil},
+		{"unknown content", []byte{0x01, 0x01, 0x01, 0x00, 0x1f, 0x01, 0x01, 'x', 0x00}},
+		{"empty string", ytextUpdate(clientA, 0, nil, nil, "")},
+		{"string longer than the update", []byte{0x01, 0x01, 0x01, 0x00, 0x04, 0x01, 0x01, 'x', 0x7f, 'y', 0x00}},
+		{"varuint of eleven bytes", []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"parent name longer than the update", []byte{0x01, 0x01, 0x01, 0x00, 0x04, 0x01, 0xff, 0xff, 0x03}},
+		{"JSON values missing", []byte{0x01, 0x01, 0x01, 0x00, 0x02, 0x01, 0x01, 'x', 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"no delete set", []byte{0x00}},
+		{"delete set cut short", []byte{0x00, 0x01, 0x01, 0x02, 0x00, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := newYDoc().applyUpdate(tt.update); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+
+	// Every update cut anywhere is incomplete
+	for _, u := range [][]byte{updateHello, updateWorld, updateDeleteLoW, stateHelorld} {
+		for n := range len(u) {
+			if err := newYDoc().applyUpdate(u[:n]); err == nil {
+				t.Errorf("%x cut at %d: no error", u, n)
+			}
+		}
+	}
+}
+
+func TestYDocGarbledUpdatesDoNotPanic(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	fixtures := [][]byte{updateHello, updateWorld, updateDeleteLoW, stateHelorld}
+	for range 20000 {
+		u := slices.Clone(fixtures[r.IntN(len(fixtures))])
+		for range 1 + r.IntN(3) {
+			u[r.IntN(len(u))] = byte(r.UintN(256))
+		}
+		doc := applyAll(t, updateHello)
+		doc.applyUpdate(u)
+		doc.text(sharedTextName)
+		doc.compact()
+		doc.encodeStateAsUpdate(nil)
+	}
+	for range 20000 {
+		u := make([]byte, r.IntN(40))
+		for i := range u {
+			u[i] = byte(r.UintN(256))
+		}
+		newYDoc().applyUpdate(u)
+	}
+}
+
+func TestYDocOverflows(t *testing.T) {
+	tests := []struct {
+		name   string
+		update []byte
+	}{
+		{"clock past 2^53", ytextUpdate(clientA, 1<<53+1, nil, nil, "x")},
+		{"clock and length past 2^53", ytextUpdate(clientA, 1<<53-1, nil, nil, "xy")},
+		{"GC struct of 2^64-1", []byte{0x01, 0x01, 0x01, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x00}},
+		{"skip of 2^63", []byte{0x01, 0x01, 0x01, 0x00, 0x0a, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0x00}},
+		{"deleted content of 2^63", []byte{0x01, 0x01, 0x01, 0x00, 0x01, 0x01, 0x01, 'x', 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0x00}},
+		{"structs adding up past 2^53", []byte{0x01, 0x02, 0x01, 0x00,
+			0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0f, // GC of 2^53-1
+			0x00, 0x02, 0x00}},
+		{"string of 2^63 bytes", []byte{0x01, 0x01, 0x01, 0x00, 0x04, 0x01, 0x01, 'x', 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := newYDoc()
+			if err := doc.applyUpdate(tt.update); err == nil {
+				t.Error("no error")
+			}
+			if len(doc.structs) > 0 || pendingStructs(doc) > 0 {
+				t.Error("the document kept structs of the update")
+			}
+		})
+	}
+
+	t.Run("delete ranges past 2^53", func(t *testing.T) {
+		doc := newYDoc()
+		for _, u := range [][]byte{deleteUpdate(clientA, 1<<60, 1), deleteUpdate(clientA, 0, 1<<64-1), deleteUpdate(clientA, 1<<53-1, 2)} {
+			if err := doc.applyUpdate(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(doc.pendingDeletes) > 0 {
+			t.Errorf("pending deletes %v", doc.pendingDeletes)
+		}
+	})
+}
+
+func TestYDocPendingIsCapped(t *testing.T) {
+	t.Run("structs", func(t *testing.T) {
+		// Structs right of a client that never shows up
+		e := &yEncoder{}
+		e.writeVarUint(1)
+		e.writeVarUint(maxPendingStructs + 1)
+		e.writeVarUint(clientB)
+		e.writeVarUint(0)
+		for range maxPendingStructs + 1 {
+			e.writeUint8(0x84)
+			writeID(e, yID{7, 0})
+			e.writeVarString("x")
+		}
+		e.writeVarUint(0)
+		doc := applyAll(t, updateHello, ytextUpdate(clientB, 0, &yID{7, 0}, nil, "x"))
+		if n := pendingStructs(doc); n != 1 {
+			t.Fatalf("%d structs pending, want 1", n)
+		}
+		if err := doc.applyUpdate(e.buf); err == nil {
+			t.Error("no error")
+		}
+		if n := pendingStructs(doc); n > 0 {
+			t.Errorf("%d structs still pending", n)
+		}
+		if got := doc.text(sharedTextName); got != "hello" {
+			t.Errorf("text %q, want %q", got, "hello")
+		}
+	})
+	t.Run("deletes", func(t *testing.T) {
+		doc := newYDoc()
+		for i := range uint64(maxPendingDeletes) {
+			if err := doc.applyUpdate(deleteUpdate(clientA, 2*i, 1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := doc.applyUpdate(deleteUpdate(clientA, 2*maxPendingDeletes, 1)); err == nil {
+			t.Error("no error")
+		}
+		if len(doc.pendingDeletes) > 0 {
+			t.Errorf("%d deletes still pending", len(doc.pendingDeletes))
+		}
+	})
+}
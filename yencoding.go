@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"unicode/utf16"
+)
+
+// lib0 binary encoding as used by Yjs and y-protocols.
+// Only the pieces the sync server needs are implemented here.
+
+var errUnexpectedEOF = errors.New("unexpected end of message")
+
+type yEncoder struct {
+	buf []byte
+}
+
+func (e *yEncoder) writeUint8(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *yEncoder) writeVarUint(n uint64) {
+	for n > 0x7f {
+		e.buf = append(e.buf, byte(n&0x7f)|0x80)
+		n >>= 7
+	}
+	e.buf = append(e.buf, byte(n))
+}
+
+func (e *yEncoder) writeVarUint8Array(b []byte) {
+	e.writeVarUint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *yEncoder) writeVarString(s string) {
+	e.writeVarUint8Array([]byte(s))
+}
+
+func (e *yEncoder) writeRaw(b []byte) {
+	e.buf = append(e.buf, b...)
+}
+
+type yDecoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *yDecoder) hasContent() bool {
+	return d.pos < len(d.buf)
+}
+
+func (d *yDecoder) readUint8() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, errUnexpectedEOF
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *yDecoder) readVarUint() (uint64, error) {
+	var n uint64
+	var shift uint
+	for {
+		b, err := d.readUint8()
+		if err != nil {
+			return 0, err
+		}
+		if shift > 63 {
+			return 0, errors.New("varuint overflow")
+		}
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n, nil
+		}
+		shift += 7
+	}
+}
+
+func (d *yDecoder) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.buf)-d.pos) {
+		return nil, errUnexpectedEOF
+	}
+	b := d.buf[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *yDecoder) readVarUint8Array() ([]byte, error) {
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return d.readBytes(n)
+}
+
+func (d *yDecoder) readVarString() (string, error) {
+	b, err := d.readVarUint8Array()
+	return string(b), err
+}
+
+// skipVarInt skips a lib0 signed varint (sign bit lives in the first byte,
+// but the continuation bit is always 0x80).
+func (d *yDecoder) skipVarInt() error {
+	for {
+		b, err := d.readUint8()
+		if err != nil {
+			return err
+		}
+		if b < 0x80 {
+			return nil
+		}
+	}
+}
+
+// readAnyRaw reads one lib0 "any" value and returns its encoded bytes, so the
+// value can be written back out unchanged without interpreting it.
+func (d *yDecoder) readAnyRaw() ([]byte, error) {
+	start := d.pos
+	if err := d.skipAny(0); err != nil {
+		return nil, err
+	}
+	return d.buf[start:d.pos], nil
+}
+
+func (d *yDecoder) skipAny(depth int) error {
+	if depth > 64 {
+		return errors.New("value nested too deep")
+	}
+	t, err := d.readUint8()
+	if err != nil {
+		return err
+	}
+	switch t {
+	case 127, 126, 121, 120: // undefined, null, false, true
+		return nil
+	case 125: // integer
+		return d.skipVarInt()
+	case 124: // float32
+		_, err = d.readBytes(4)
+		return err
+	case 123, 122: // float64, bigint64
+		_, err = d.readBytes(8)
+		return err
+	case 119: // string
+		_, err = d.readVarUint8Array()
+		return err
+	case 118: // object
+		n, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.readVarUint8Array(); err != nil {
+				return err
+			}
+			if err := d.skipAny(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 117: // array
+		n, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := d.skipAny(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 116: // Uint8Array
+		_, err = d.readVarUint8Array()
+		return err
+	}
+	return errors.New("unknown value type")
+}
+
+// JavaScript strings are UTF-16, and Yjs measures text in UTF-16 code units,
+// so text content is kept in that form on the server as well.
+func toUTF16(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
+
+func fromUTF16(s []uint16) string {
+	return string(utf16.Decode(s))
+}